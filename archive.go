@@ -0,0 +1,614 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.starlark.net/starlark"
+)
+
+// The archive builders produce reproducible archives: entries are sorted by
+// path, timestamps are fixed, ownership is dropped and permissions are
+// normalized to 0755/0644 (cache artifacts are read-only, which isn't worth
+// preserving in an archive).
+
+// archiveEpoch is the modification time of every archive entry. It's the
+// earliest time that zip files can represent.
+var archiveEpoch = time.Date(1980, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+//
+// tree
+//
+
+// starlarkTree implements the `tree(name, entries={...}, symlink=False)`
+// builtin, which assembles existing artifacts (targets, paths and globs)
+// into a directory. With `symlink=True`, entries are symlinks into the cache
+// rather than copies.
+func starlarkTree(
+	args starlark.Tuple,
+	kwargs []starlark.Tuple,
+) (starlark.Value, error) {
+	var name string
+	var entries *starlark.Dict
+	var symlink bool
+	if err := starlark.UnpackArgs(
+		"tree",
+		args,
+		kwargs,
+		"name",
+		&name,
+		"entries",
+		&entries,
+		"symlink?",
+		&symlink,
+	); err != nil {
+		return nil, err
+	}
+
+	entryArgs, err := directoryEntryArgs(entries)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(entryArgs); i += 3 {
+		if entryArgs[i] != String(directoryEntryCopy) {
+			return nil, errors.Errorf(
+				"Entry '%s': expected a target, path or glob",
+				entryArgs[i+1],
+			)
+		}
+		if symlink {
+			entryArgs[i] = String(directoryEntryLink)
+		}
+	}
+
+	return &Target{
+		Name:    name,
+		Builder: nativeBuilderPrefix + "directory",
+		Args:    entryArgs,
+		Env:     []string{},
+	}, nil
+}
+
+//
+// tar
+//
+
+// starlarkTar implements the `tar(name, src, gzip=False)` builtin, which
+// archives the artifact `src` (a target, path or glob).
+func starlarkTar(
+	args starlark.Tuple,
+	kwargs []starlark.Tuple,
+) (starlark.Value, error) {
+	var name string
+	var src starlark.Value
+	var gzipped bool
+	if err := starlark.UnpackArgs(
+		"tar",
+		args,
+		kwargs,
+		"name",
+		&name,
+		"src",
+		&src,
+		"gzip?",
+		&gzipped,
+	); err != nil {
+		return nil, err
+	}
+
+	srcArg, err := starlarkValueToArtifactArg(src)
+	if err != nil {
+		return nil, errors.Wrap(err, "Argument 'src'")
+	}
+	compression := "none"
+	if gzipped {
+		compression = "gzip"
+	}
+	return &Target{
+		Name:    name,
+		Builder: nativeBuilderPrefix + "tar",
+		Args:    []Arg{String(compression), srcArg},
+		Env:     []string{},
+	}, nil
+}
+
+// buildTar expects the args `[compression, src]`.
+func buildTar(cachePath string, args []string, out string) error {
+	if len(args) != 2 {
+		return errors.Errorf(
+			"Expected args [compression, src]; found %d",
+			len(args),
+		)
+	}
+
+	file, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer properClose(file)
+
+	var w io.Writer = file
+	var gz *gzip.Writer
+	switch args[0] {
+	case "none":
+	case "gzip":
+		// The zero-value header has no name or timestamp.
+		gz = gzip.NewWriter(file)
+		w = gz
+	default:
+		return errors.Errorf("Unknown compression '%s'", args[0])
+	}
+
+	if err := writeTar(w, filepath.Join(cachePath, args[1])); err != nil {
+		return err
+	}
+	if gz != nil {
+		return gz.Close()
+	}
+	return nil
+}
+
+// writeTar writes a reproducible tar archive of the file or directory at
+// `root` to `w`. If `root` is a file, the archive contains a single entry
+// named after it.
+func writeTar(w io.Writer, root string) error {
+	tw := tar.NewWriter(w)
+	if err := walkArchiveEntries(root, func(e archiveEntry) error {
+		hdr := &tar.Header{
+			Name:    e.name,
+			Mode:    int64(e.mode),
+			ModTime: archiveEpoch,
+			Format:  tar.FormatPAX,
+		}
+		switch {
+		case e.fi.IsDir():
+			hdr.Typeflag = tar.TypeDir
+			hdr.Name += "/"
+		case e.link != "":
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = e.link
+		default:
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = e.fi.Size()
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			return copyFileTo(tw, e.path)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+//
+// zip
+//
+
+// starlarkZip implements the `zip(name, src)` builtin, which archives the
+// artifact `src` (a target, path or glob).
+func starlarkZip(
+	args starlark.Tuple,
+	kwargs []starlark.Tuple,
+) (starlark.Value, error) {
+	var name string
+	var src starlark.Value
+	if err := starlark.UnpackArgs(
+		"zip",
+		args,
+		kwargs,
+		"name",
+		&name,
+		"src",
+		&src,
+	); err != nil {
+		return nil, err
+	}
+
+	srcArg, err := starlarkValueToArtifactArg(src)
+	if err != nil {
+		return nil, errors.Wrap(err, "Argument 'src'")
+	}
+	return &Target{
+		Name:    name,
+		Builder: nativeBuilderPrefix + "zip",
+		Args:    []Arg{srcArg},
+		Env:     []string{},
+	}, nil
+}
+
+// buildZip expects the args `[src]`.
+func buildZip(cachePath string, args []string, out string) error {
+	if len(args) != 1 {
+		return errors.Errorf("Expected args [src]; found %d", len(args))
+	}
+
+	file, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer properClose(file)
+
+	zw := zip.NewWriter(file)
+	if err := walkArchiveEntries(
+		filepath.Join(cachePath, args[0]),
+		func(e archiveEntry) error {
+			hdr := &zip.FileHeader{
+				Name:     e.name,
+				Method:   zip.Deflate,
+				Modified: archiveEpoch,
+			}
+			mode := e.mode
+			if e.fi.IsDir() {
+				hdr.Name += "/"
+				hdr.Method = zip.Store
+				mode |= os.ModeDir
+			} else if e.link != "" {
+				mode |= os.ModeSymlink
+			}
+			hdr.SetMode(mode)
+
+			w, err := zw.CreateHeader(hdr)
+			if err != nil {
+				return err
+			}
+			switch {
+			case e.fi.IsDir():
+				return nil
+			case e.link != "":
+				_, err := io.WriteString(w, e.link)
+				return err
+			default:
+				return copyFileTo(w, e.path)
+			}
+		},
+	); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+//
+// extract
+//
+
+// starlarkExtract implements the `extract(name, archive)` builtin, which
+// unpacks a tar (optionally gzipped) or zip archive into a directory. The
+// format is detected from the archive's contents.
+func starlarkExtract(
+	args starlark.Tuple,
+	kwargs []starlark.Tuple,
+) (starlark.Value, error) {
+	var name string
+	var archive starlark.Value
+	if err := starlark.UnpackArgs(
+		"extract",
+		args,
+		kwargs,
+		"name",
+		&name,
+		"archive",
+		&archive,
+	); err != nil {
+		return nil, err
+	}
+
+	archiveArg, err := starlarkValueToArtifactArg(archive)
+	if err != nil {
+		return nil, errors.Wrap(err, "Argument 'archive'")
+	}
+	return &Target{
+		Name:    name,
+		Builder: nativeBuilderPrefix + "extract",
+		Args:    []Arg{archiveArg},
+		Env:     []string{},
+	}, nil
+}
+
+// buildExtract expects the args `[archive]`.
+func buildExtract(cachePath string, args []string, out string) error {
+	if len(args) != 1 {
+		return errors.Errorf("Expected args [archive]; found %d", len(args))
+	}
+	return extractArchive(filepath.Join(cachePath, args[0]), out)
+}
+
+// extractArchive unpacks the tar, gzipped tar or zip archive at `src` into
+// the directory `dst`. Entries may not escape `dst`.
+func extractArchive(src, dst string) error {
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer properClose(file)
+
+	br := bufio.NewReader(file)
+	magic, err := br.Peek(4)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+	switch {
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")):
+		fi, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		return extractZip(file, fi.Size(), dst)
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer properClose(gz)
+		return extractTar(gz, dst)
+	default:
+		return extractTar(br, dst)
+	}
+}
+
+func extractTar(r io.Reader, dst string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "Reading tar archive")
+		}
+
+		target, err := archiveEntryPath(dst, hdr.Name)
+		if err != nil {
+			return err
+		}
+		mode := os.FileMode(hdr.Mode).Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0755)
+		case tar.TypeReg, tar.TypeRegA:
+			err = writeArchiveFile(target, mode, tr)
+		case tar.TypeSymlink:
+			err = writeArchiveSymlink(target, hdr.Linkname)
+		case tar.TypeLink:
+			var linked string
+			if linked, err = archiveEntryPath(dst, hdr.Linkname); err == nil {
+				err = os.Link(linked, target)
+			}
+		case tar.TypeXGlobalHeader:
+		default:
+			err = errors.Errorf("unsupported entry type %q", hdr.Typeflag)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "Extracting '%s'", hdr.Name)
+		}
+	}
+}
+
+func extractZip(r io.ReaderAt, size int64, dst string) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return errors.Wrap(err, "Reading zip archive")
+	}
+	for _, zf := range zr.File {
+		if err := extractZipEntry(zf, dst); err != nil {
+			return errors.Wrapf(err, "Extracting '%s'", zf.Name)
+		}
+	}
+	return nil
+}
+
+func extractZipEntry(zf *zip.File, dst string) error {
+	target, err := archiveEntryPath(dst, zf.Name)
+	if err != nil {
+		return err
+	}
+	if zf.Mode().IsDir() {
+		return os.MkdirAll(target, 0755)
+	}
+
+	rc, err := zf.Open()
+	if err != nil {
+		return err
+	}
+	defer properClose(rc)
+
+	if zf.Mode()&os.ModeSymlink != 0 {
+		var link strings.Builder
+		if _, err := io.Copy(&link, rc); err != nil {
+			return err
+		}
+		return writeArchiveSymlink(target, link.String())
+	}
+	return writeArchiveFile(target, zf.Mode().Perm(), rc)
+}
+
+// archiveEntryPath resolves an archive entry name inside of `dst`, rejecting
+// names that would escape it. Since an earlier entry may be a symlink to
+// anywhere, no existing component of the path beneath `dst` (including the
+// entry itself) may be a symlink; otherwise, writing the entry would follow
+// the link.
+func archiveEntryPath(dst, name string) (string, error) {
+	if strings.HasPrefix(name, "/") || hasParentElement(name) {
+		return "", errors.Errorf("Archive entry '%s' escapes the output", name)
+	}
+	target := dst
+	for _, element := range strings.Split(name, "/") {
+		if element == "" || element == "." {
+			continue
+		}
+		target = filepath.Join(target, element)
+		fi, err := os.Lstat(target)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Nothing beneath a missing component exists yet.
+				return filepath.Join(dst, filepath.FromSlash(name)), nil
+			}
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return "", errors.Errorf(
+				"Archive entry '%s' is beneath or replaces the symlink '%s'",
+				name,
+				target,
+			)
+		}
+	}
+	return target, nil
+}
+
+func writeArchiveFile(target string, mode os.FileMode, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(
+		target,
+		os.O_WRONLY|os.O_CREATE|os.O_TRUNC,
+		mode|0200,
+	)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, r); err != nil {
+		properClose(file)
+		return err
+	}
+	return file.Close()
+}
+
+func writeArchiveSymlink(target, link string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	return os.Symlink(link, target)
+}
+
+//
+// helpers
+//
+
+// archiveEntry is a file, directory or symlink to be written to an archive.
+type archiveEntry struct {
+	// name is the slash-separated path of the entry within the archive.
+	name string
+	path string
+	fi   os.FileInfo
+	mode os.FileMode
+	link string
+}
+
+// walkArchiveEntries calls `f` for each file, directory and symlink beneath
+// `root` (excluding `root` itself unless it's a file) in sorted order.
+func walkArchiveEntries(root string, f func(archiveEntry) error) error {
+	fi, err := os.Lstat(root)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return visitArchiveEntry(filepath.Base(root), root, fi, f)
+	}
+
+	var relPaths []string
+	if err := filepath.Walk(
+		root,
+		func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if path != root {
+				relPaths = append(relPaths, path[len(root)+1:])
+			}
+			return nil
+		},
+	); err != nil {
+		return err
+	}
+	sort.Strings(relPaths)
+
+	for _, relPath := range relPaths {
+		path := filepath.Join(root, relPath)
+		fi, err := os.Lstat(path)
+		if err != nil {
+			return err
+		}
+		if err := visitArchiveEntry(
+			filepath.ToSlash(relPath),
+			path,
+			fi,
+			f,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func visitArchiveEntry(
+	name string,
+	path string,
+	fi os.FileInfo,
+	f func(archiveEntry) error,
+) error {
+	e := archiveEntry{name: name, path: path, fi: fi, mode: 0644}
+	switch {
+	case fi.IsDir():
+		e.mode = 0755
+	case fi.Mode()&os.ModeSymlink != 0:
+		link, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		e.link, e.mode = link, 0777
+	case fi.Mode().IsRegular():
+		if fi.Mode()&0111 != 0 {
+			e.mode = 0755
+		}
+	default:
+		return errors.Errorf(
+			"Can't archive '%s': unsupported file type %s",
+			path,
+			fi.Mode().Type(),
+		)
+	}
+	return f(e)
+}
+
+func copyFileTo(w io.Writer, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer properClose(file)
+	_, err = io.Copy(w, file)
+	return err
+}
+
+// starlarkValueToArtifactArg converts a value into an arg whose frozen value
+// is a cache path.
+func starlarkValueToArtifactArg(v starlark.Value) (Arg, error) {
+	switch x := v.(type) {
+	case *Target, Path, GlobGroup:
+		return x.(Arg), nil
+	default:
+		return nil, errors.Errorf(
+			"TypeError: expected a Target, Path or GlobGroup; found %s",
+			v.Type(),
+		)
+	}
+}
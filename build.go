@@ -30,7 +30,14 @@ func BuildRecursive(
 	}
 	if exists {
 		color.Green("Already built %s", d.ID)
-		return nil
+
+		// Outputs which were built before derivations were recorded get
+		// their records now.
+		return errors.Wrapf(
+			fsc.WriteDerivationRecord(d),
+			"Recording derivation '%s'",
+			d.ID,
+		)
 	}
 
 	for _, dependency := range d.Dependencies {
@@ -55,8 +62,6 @@ func BuildRecursive(
 // distributions seem to put the tmp dir on a tmpfs file system and
 // consequently an explicit tmpDirBase value must be passed).
 func Build(fsc *FileSystemCache, d *Derivation, tmpDirBase string) error {
-	var output bytes.Buffer
-
 	tmpDir, err := ioutil.TempDir(tmpDirBase, "*")
 	if err != nil {
 		return errors.Wrap(err, "Creating temporary build directory")
@@ -68,22 +73,18 @@ func Build(fsc *FileSystemCache, d *Derivation, tmpDirBase string) error {
 	}()
 	tmpOutPath := filepath.Join(tmpDir, randString())
 
-	cmd := exec.Command(d.Builder, d.Args...)
+	if builder, found := nativeBuilders[d.Builder]; found {
+		if err := builder(fsc.Root(), d.Args, tmpOutPath); err != nil {
+			return err
+		}
+	} else if err := runBuilderCommand(fsc, d, tmpDir, tmpOutPath); err != nil {
+		return err
+	}
 
-	// Make a copy of the derivation's env slice and prepend to it the output
-	// env copy slice. It's important that we prepend instead of append so that
-	// it overrides any other "out" env vars that were present in the
-	// original environment.
-	envCopy := make([]string, len(d.Env)+2)
-	copy(envCopy[:len(envCopy)-1], d.Env)
-	envCopy[len(envCopy)-1] = "out=" + tmpOutPath
-	envCopy[len(envCopy)-2] = "cachePath=" + fsc.Root()
-	cmd.Env = envCopy
-	cmd.Dir = tmpDir
-	cmd.Stderr = &output
-	cmd.Stdout = &output
-	if err := cmd.Run(); err != nil {
-		return errors.Wrapf(err, "OUTPUT: '%s'", &output)
+	if d.OutputHash != "" {
+		if err := verifyOutputHash(tmpOutPath, d.OutputHash); err != nil {
+			return err
+		}
 	}
 
 	// Make the artifact immutable before moving it into the cache.
@@ -91,7 +92,7 @@ func Build(fsc *FileSystemCache, d *Derivation, tmpDirBase string) error {
 		return errors.Wrap(err, "Chmodding output artifact")
 	}
 
-	// Builder exited OK; move the output file into the cache. If the output
+	// Builder succeeded; move the output file into the cache. If the output
 	// file doesn't exist, report a distinct error.
 	if err := fsc.MoveFile(tmpOutPath, d.ID); err != nil {
 		if os.IsNotExist(err) {
@@ -102,6 +103,38 @@ func Build(fsc *FileSystemCache, d *Derivation, tmpDirBase string) error {
 		return errors.Wrap(err, "Moving output file into cache")
 	}
 
+	return errors.Wrap(
+		fsc.WriteDerivationRecord(d),
+		"Recording derivation",
+	)
+}
+
+// runBuilderCommand builds a derivation by running its builder as an external
+// program in `tmpDir`, with the `out` env var set to `tmpOutPath`.
+func runBuilderCommand(
+	fsc *FileSystemCache,
+	d *Derivation,
+	tmpDir string,
+	tmpOutPath string,
+) error {
+	var output bytes.Buffer
+	cmd := exec.Command(d.Builder, d.Args...)
+
+	// Make a copy of the derivation's env slice and prepend to it the output
+	// env copy slice. It's important that we prepend instead of append so that
+	// it overrides any other "out" env vars that were present in the
+	// original environment.
+	envCopy := make([]string, len(d.Env)+2)
+	copy(envCopy[:len(envCopy)-1], d.Env)
+	envCopy[len(envCopy)-1] = "out=" + tmpOutPath
+	envCopy[len(envCopy)-2] = "cachePath=" + fsc.Root()
+	cmd.Env = envCopy
+	cmd.Dir = tmpDir
+	cmd.Stderr = &output
+	cmd.Stdout = &output
+	if err := cmd.Run(); err != nil {
+		return errors.Wrapf(err, "OUTPUT: '%s'", &output)
+	}
 	return nil
 }
 
@@ -114,6 +147,12 @@ func makeImmutable(path string) error {
 }
 
 func makeImmutableHelper(path string, fi os.FileInfo) error {
+	// Chmod follows symlinks, so leave them alone rather than changing the
+	// mode of whatever they point to.
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+
 	if fi.IsDir() {
 		files, err := ioutil.ReadDir(path)
 		if err != nil {
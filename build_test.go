@@ -1,7 +1,18 @@
 package main
 
 import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
 
 	"github.com/pkg/errors"
@@ -9,20 +20,1264 @@ import (
 
 func TestBuild(t *testing.T) {
 	d := Derivation{
-		ID:           "foo",
-		Hash:         []byte("barhash"),
-		Builder:      "/bin/bash",
-		Args:         []string{"-c", "echo 'hello' > $out"},
-		Dependencies: nil,
-		Env:          os.Environ(),
+		ID:            "foo",
+		Hash:          []byte("barhash"),
+		HashAlgorithm: "sha256",
+		Builder:       "/bin/bash",
+		Args:          []string{"-c", "echo 'hello' > $out"},
+		Dependencies:  nil,
+		Env:           os.Environ(),
 	}
 
 	if err := withTempDir(func(tmpDir string) error {
-		fsc, err := FileSystemCacheFromTempDir(tmpDir)
+		fsc, err := FileSystemCacheFromTempDir(tmpDir, sha256.New)
 		if err != nil {
 			return errors.Wrap(err, "Creating temp FileSystemCache directory")
 		}
-		return errors.Wrap(Build(fsc, &d, tmpDir), "Building test derivation")
+		if err := Build(fsc, &d, tmpDir); err != nil {
+			return errors.Wrap(err, "Building test derivation")
+		}
+
+		// The full hash is recorded next to the output.
+		record, err := fsc.DerivationRecord(d.ID)
+		if err != nil {
+			return err
+		}
+		wanted := derivationRecord{
+			Hash:          hex.EncodeToString(d.Hash),
+			HashAlgorithm: "sha256",
+		}
+		if record == nil || *record != wanted {
+			return errors.Errorf("Wanted record %+v; got %+v", wanted, record)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBuild_nativeBuilders(t *testing.T) {
+	if err := withTempDir(func(tmpDir string) error {
+		fsc, err := FileSystemCacheFromTempDir(tmpDir, sha256.New)
+		if err != nil {
+			return errors.Wrap(err, "Creating temp FileSystemCache directory")
+		}
+		defer makeWritable(tmpDir)
+
+		// Put an existing artifact into the cache for the directory target to
+		// copy.
+		if err := os.MkdirAll(filepath.Join(tmpDir, "src/bin"), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(
+			filepath.Join(tmpDir, "src/bin/tool"),
+			[]byte("#!/bin/sh"),
+			0755,
+		); err != nil {
+			return err
+		}
+
+		for _, d := range []*Derivation{{
+			ID:      "script",
+			Builder: nativeBuilderPrefix + "write_file",
+			Args:    []string{"0755", "#!/bin/sh\necho hi\n"},
+		}, {
+			ID:      "release",
+			Builder: nativeBuilderPrefix + "directory",
+			Args: []string{
+				directoryEntryContent, "etc/app.conf", "debug = false",
+				directoryEntryCopy, "tools", "src",
+			},
+		}} {
+			if err := Build(fsc, d, tmpDir); err != nil {
+				return errors.Wrapf(err, "Building '%s'", d.ID)
+			}
+		}
+
+		for relPath, wanted := range map[string]struct {
+			contents string
+			mode     os.FileMode
+		}{
+			"script":                 {"#!/bin/sh\necho hi\n", 0555},
+			"release/etc/app.conf":   {"debug = false", 0444},
+			"release/tools/bin/tool": {"#!/bin/sh", 0555},
+		} {
+			path := filepath.Join(tmpDir, relPath)
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			if string(data) != wanted.contents {
+				return errors.Errorf(
+					"%s: wanted contents '%s'; got '%s'",
+					relPath,
+					wanted.contents,
+					data,
+				)
+			}
+			fi, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+			if fi.Mode().Perm() != wanted.mode {
+				return errors.Errorf(
+					"%s: wanted mode %s; got %s",
+					relPath,
+					wanted.mode,
+					fi.Mode().Perm(),
+				)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// makeWritable undoes `makeImmutable()` so that test directories can be
+// cleaned up by users other than root.
+func TestBuild_merge(t *testing.T) {
+	if err := withTempDir(func(tmpDir string) error {
+		fsc, err := FileSystemCacheFromTempDir(tmpDir, sha256.New)
+		if err != nil {
+			return errors.Wrap(err, "Creating temp FileSystemCache directory")
+		}
+		defer makeWritable(tmpDir)
+
+		for relPath, contents := range map[string]string{
+			"a/shared/LICENSE": "MIT",
+			"a/a.txt":          "a",
+			"b/shared/LICENSE": "MIT",
+			"b/b.txt":          "b",
+			"c/a.txt":          "not a",
+		} {
+			path := filepath.Join(tmpDir, relPath)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+				return err
+			}
+		}
+		if err := makeImmutable(filepath.Join(tmpDir, "a")); err != nil {
+			return err
+		}
+
+		if err := Build(fsc, &Derivation{
+			ID:      "merged",
+			Builder: nativeBuilderPrefix + "merge",
+			Args:    []string{"a", "b"},
+		}, tmpDir); err != nil {
+			return err
+		}
+		for relPath, wanted := range map[string]string{
+			"merged/shared/LICENSE": "MIT",
+			"merged/a.txt":          "a",
+			"merged/b.txt":          "b",
+		} {
+			data, err := ioutil.ReadFile(filepath.Join(tmpDir, relPath))
+			if err != nil {
+				return err
+			}
+			if string(data) != wanted {
+				return errors.Errorf(
+					"%s: wanted contents '%s'; got '%s'",
+					relPath,
+					wanted,
+					data,
+				)
+			}
+		}
+
+		err = Build(fsc, &Derivation{
+			ID:      "conflict",
+			Builder: nativeBuilderPrefix + "merge",
+			Args:    []string{"a", "c"},
+		}, tmpDir)
+		if err == nil || !strings.Contains(err.Error(), "Conflicting file") {
+			return errors.Errorf("Wanted a conflicting file error; got %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBuild_outputHash(t *testing.T) {
+	if err := withTempDir(func(tmpDir string) error {
+		fsc, err := FileSystemCacheFromTempDir(tmpDir, sha256.New)
+		if err != nil {
+			return errors.Wrap(err, "Creating temp FileSystemCache directory")
+		}
+		defer makeWritable(tmpDir)
+
+		// sha256("hello")
+		const helloHash = "sha256:" +
+			"2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+		for _, testCase := range []struct {
+			id         string
+			outputHash string
+			wantedErr  string
+		}{
+			{id: "match", outputHash: helloHash},
+			{id: "opaque", outputHash: "h1:not-verified-by-g8r"},
+			{
+				id:         "mismatch",
+				outputHash: "sha256:" + strings.Repeat("0", 64),
+				wantedErr:  "Output hash mismatch",
+			},
+		} {
+			err := Build(fsc, &Derivation{
+				ID:         testCase.id,
+				Builder:    nativeBuilderPrefix + "write_file",
+				Args:       []string{"0644", "hello"},
+				OutputHash: testCase.outputHash,
+			}, tmpDir)
+			if testCase.wantedErr == "" && err != nil {
+				return errors.Wrapf(err, "Building '%s'", testCase.id)
+			}
+			if testCase.wantedErr != "" &&
+				(err == nil || !strings.Contains(err.Error(), testCase.wantedErr)) {
+				return errors.Errorf(
+					"Building '%s': wanted error '%s'; got %v",
+					testCase.id,
+					testCase.wantedErr,
+					err,
+				)
+			}
+
+			exists, err := fsc.Exists(testCase.id)
+			if err != nil {
+				return err
+			}
+			if exists != (testCase.wantedErr == "") {
+				return errors.Errorf(
+					"Building '%s': wanted cached=%t; got %t",
+					testCase.id,
+					testCase.wantedErr == "",
+					exists,
+				)
+			}
+
+			// Only committed outputs are recorded, along with the hash
+			// they were verified against.
+			record, err := fsc.DerivationRecord(testCase.id)
+			if err != nil {
+				return err
+			}
+			if exists != (record != nil) ||
+				(record != nil && record.OutputHash != testCase.outputHash) {
+				return errors.Errorf(
+					"Building '%s': unexpected derivation record %+v",
+					testCase.id,
+					record,
+				)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func makeWritable(dir string) {
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode()&os.ModeSymlink == 0 {
+			os.Chmod(path, fi.Mode()|0200)
+		}
+		return nil
+	})
+}
+
+func TestBuild_archives(t *testing.T) {
+	if err := withTempDir(func(tmpDir string) error {
+		fsc, err := FileSystemCacheFromTempDir(tmpDir, sha256.New)
+		if err != nil {
+			return errors.Wrap(err, "Creating temp FileSystemCache directory")
+		}
+		defer makeWritable(tmpDir)
+
+		files := map[string]string{
+			"src/bin/app":     "binary",
+			"src/etc/app.cfg": "config",
+			// Names may contain `..` as long as no path element is `..`.
+			"src/etc/v1..2.txt": "notes",
+		}
+		for relPath, contents := range files {
+			path := filepath.Join(tmpDir, relPath)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(path, []byte(contents), 0755); err != nil {
+				return err
+			}
+		}
+		if err := os.Symlink("bin/app", filepath.Join(tmpDir, "src/app")); err != nil {
+			return err
+		}
+
+		for _, d := range []*Derivation{{
+			ID:      "release.tar.gz",
+			Builder: nativeBuilderPrefix + "tar",
+			Args:    []string{"gzip", "src"},
+		}, {
+			// Building the same archive twice should produce the same bytes
+			// regardless of timestamps.
+			ID:      "release-again.tar.gz",
+			Builder: nativeBuilderPrefix + "tar",
+			Args:    []string{"gzip", "src"},
+		}, {
+			ID:      "release.zip",
+			Builder: nativeBuilderPrefix + "zip",
+			Args:    []string{"src"},
+		}, {
+			ID:      "from-tar",
+			Builder: nativeBuilderPrefix + "extract",
+			Args:    []string{"release.tar.gz"},
+		}, {
+			ID:      "from-zip",
+			Builder: nativeBuilderPrefix + "extract",
+			Args:    []string{"release.zip"},
+		}} {
+			if err := Build(fsc, d, tmpDir); err != nil {
+				return errors.Wrapf(err, "Building '%s'", d.ID)
+			}
+		}
+
+		first, err := ioutil.ReadFile(filepath.Join(tmpDir, "release.tar.gz"))
+		if err != nil {
+			return err
+		}
+		second, err := ioutil.ReadFile(
+			filepath.Join(tmpDir, "release-again.tar.gz"),
+		)
+		if err != nil {
+			return err
+		}
+		if string(first) != string(second) {
+			return errors.Errorf("Wanted identical archives")
+		}
+
+		for _, extracted := range []string{"from-tar", "from-zip"} {
+			for relPath, wanted := range map[string]string{
+				"bin/app":       "binary",
+				"etc/app.cfg":   "config",
+				"etc/v1..2.txt": "notes",
+				"app":           "binary",
+			} {
+				data, err := ioutil.ReadFile(
+					filepath.Join(tmpDir, extracted, relPath),
+				)
+				if err != nil {
+					return err
+				}
+				if string(data) != wanted {
+					return errors.Errorf(
+						"%s/%s: wanted '%s'; got '%s'",
+						extracted,
+						relPath,
+						wanted,
+						data,
+					)
+				}
+			}
+			link, err := os.Readlink(filepath.Join(tmpDir, extracted, "app"))
+			if err != nil {
+				return err
+			}
+			if link != "bin/app" {
+				return errors.Errorf("Wanted symlink to 'bin/app'; got '%s'", link)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBuild_extractSymlinkEscape(t *testing.T) {
+	if err := withTempDir(func(tmpDir string) error {
+		fsc, err := FileSystemCacheFromTempDir(tmpDir, sha256.New)
+		if err != nil {
+			return errors.Wrap(err, "Creating temp FileSystemCache directory")
+		}
+		defer makeWritable(tmpDir)
+
+		// An archive whose symlink entry points outside of the output, followed
+		// by an entry beneath the symlink.
+		outside := filepath.Join(tmpDir, "outside")
+		if err := os.Mkdir(outside, 0755); err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     "a",
+			Typeflag: tar.TypeSymlink,
+			Linkname: outside,
+		}); err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     "a/b/c",
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			Size:     int64(len("escaped")),
+		}); err != nil {
+			return err
+		}
+		if _, err := tw.Write([]byte("escaped")); err != nil {
+			return err
+		}
+		if err := tw.Close(); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(
+			filepath.Join(tmpDir, "evil.tar"),
+			buf.Bytes(),
+			0644,
+		); err != nil {
+			return err
+		}
+
+		if err := Build(fsc, &Derivation{
+			ID:      "extracted",
+			Builder: nativeBuilderPrefix + "extract",
+			Args:    []string{"evil.tar"},
+		}, tmpDir); err == nil || !strings.Contains(err.Error(), "symlink") {
+			return errors.Errorf("Wanted a symlink escape error; got %v", err)
+		}
+		if _, err := os.Lstat(filepath.Join(outside, "b")); !os.IsNotExist(err) {
+			return errors.Errorf("Wanted nothing written outside the output")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBuild_ociImage(t *testing.T) {
+	if err := withTempDir(func(tmpDir string) error {
+		fsc, err := FileSystemCacheFromTempDir(tmpDir, sha256.New)
+		if err != nil {
+			return errors.Wrap(err, "Creating temp FileSystemCache directory")
+		}
+		defer makeWritable(tmpDir)
+
+		if err := os.MkdirAll(filepath.Join(tmpDir, "rootfs/bin"), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(
+			filepath.Join(tmpDir, "rootfs/bin/app"),
+			[]byte("binary"),
+			0755,
+		); err != nil {
+			return err
+		}
+
+		settings := func(s ociImageSettings) string {
+			data, err := json.Marshal(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return string(data)
+		}
+		for _, d := range []*Derivation{{
+			ID:      "base",
+			Builder: nativeBuilderPrefix + "oci_image",
+			Args: []string{
+				settings(ociImageSettings{
+					OS:   "linux",
+					Arch: "amd64",
+					Cmd:  []string{"/bin/sh"},
+					Env:  []string{"PATH=/bin", "MODE=debug"},
+				}),
+				"rootfs",
+			},
+		}, {
+			ID:      "base.tar",
+			Builder: nativeBuilderPrefix + "tar",
+			Args:    []string{"none", "base"},
+		}, {
+			ID:      "app",
+			Builder: nativeBuilderPrefix + "oci_image",
+			Args: []string{
+				settings(ociImageSettings{
+					OS:         "linux",
+					Arch:       "amd64",
+					Entrypoint: []string{"/bin/app"},
+					Env:        []string{"MODE=release"},
+					HasBase:    true,
+				}),
+				"base",
+				"rootfs",
+			},
+		}} {
+			if err := Build(fsc, d, tmpDir); err != nil {
+				return errors.Wrapf(err, "Building '%s'", d.ID)
+			}
+		}
+
+		layout := ociLayout(filepath.Join(tmpDir, "app"))
+		var index ociIndex
+		data, err := ioutil.ReadFile(filepath.Join(string(layout), "index.json"))
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &index); err != nil {
+			return err
+		}
+		var manifest ociManifest
+		if err := layout.readJSON(index.Manifests[0].Digest, &manifest); err != nil {
+			return err
+		}
+		if len(manifest.Layers) != 2 {
+			return errors.Errorf("Wanted 2 layers; got %d", len(manifest.Layers))
+		}
+		// The same directory always produces the same layer.
+		if manifest.Layers[0].Digest != manifest.Layers[1].Digest {
+			return errors.Errorf("Wanted reproducible layer digests")
+		}
+
+		var config struct {
+			Config struct {
+				Entrypoint []string
+				Cmd        []string
+				Env        []string
+			} `json:"config"`
+			RootFS struct {
+				DiffIDs []string `json:"diff_ids"`
+			} `json:"rootfs"`
+		}
+		if err := layout.readJSON(manifest.Config.Digest, &config); err != nil {
+			return err
+		}
+		if !stringsEqual(config.Config.Entrypoint, []string{"/bin/app"}) {
+			return errors.Errorf("Unexpected entrypoint %v", config.Config.Entrypoint)
+		}
+		if config.Config.Cmd != nil {
+			return errors.Errorf("Wanted the entrypoint to reset cmd")
+		}
+		if wanted := []string{"PATH=/bin", "MODE=release"}; !stringsEqual(
+			config.Config.Env,
+			wanted,
+		) {
+			return errors.Errorf("Wanted env %v; got %v", wanted, config.Config.Env)
+		}
+		if len(config.RootFS.DiffIDs) != 2 {
+			return errors.Errorf("Wanted 2 diff IDs; got %v", config.RootFS.DiffIDs)
+		}
+
+		// A checksummed base tarball must match its checksum, and the base's
+		// blobs must match their digests.
+		if err := expectOCIBaseChecksumMismatch(
+			fsc,
+			tmpDir,
+			settings,
+		); err != nil {
+			return err
+		}
+		return expectOCITamperedBaseMismatch(fsc, tmpDir, settings)
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectOCITamperedBaseMismatch(
+	fsc *FileSystemCache,
+	tmpDir string,
+	settings func(ociImageSettings) string,
+) error {
+	if err := Build(fsc, &Derivation{
+		ID:      "tampered-base",
+		Builder: nativeBuilderPrefix + "oci_image",
+		Args: []string{
+			settings(ociImageSettings{OS: "linux", Arch: "amd64"}),
+			"rootfs",
+		},
+	}, tmpDir); err != nil {
+		return err
+	}
+	layout := ociLayout(filepath.Join(fsc.Root(), "tampered-base"))
+	makeWritable(string(layout))
+
+	var index ociIndex
+	data, err := ioutil.ReadFile(filepath.Join(string(layout), "index.json"))
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return err
+	}
+	var manifest ociManifest
+	if err := layout.readJSON(index.Manifests[0].Digest, &manifest); err != nil {
+		return err
+	}
+	layer, err := layout.blobPath(manifest.Layers[0].Digest)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(layer, []byte("tampered"), 0644); err != nil {
+		return err
+	}
+
+	err = Build(fsc, &Derivation{
+		ID:      "tampered-app",
+		Builder: nativeBuilderPrefix + "oci_image",
+		Args: []string{
+			settings(ociImageSettings{OS: "linux", Arch: "amd64", HasBase: true}),
+			"tampered-base",
+			"rootfs",
+		},
+	}, tmpDir)
+	if err == nil || !strings.Contains(err.Error(), "Checksum mismatch") {
+		return errors.Errorf(
+			"Wanted checksum mismatch error for a tampered layer; got %v",
+			err,
+		)
+	}
+	return nil
+}
+
+func expectOCIBaseChecksumMismatch(
+	fsc *FileSystemCache,
+	tmpDir string,
+	settings func(ociImageSettings) string,
+) error {
+	err := Build(fsc, &Derivation{
+		ID:      "bad-base",
+		Builder: nativeBuilderPrefix + "oci_image",
+		Args: []string{
+			settings(ociImageSettings{
+				OS:         "linux",
+				Arch:       "amd64",
+				HasBase:    true,
+				BaseSHA256: "0000",
+			}),
+			"base.tar",
+		},
+	}, tmpDir)
+	if err == nil || !strings.Contains(err.Error(), "Checksum mismatch") {
+		return errors.Errorf("Wanted checksum mismatch error; got %v", err)
+	}
+	return nil
+}
+
+func TestVerifySHA256_uppercase(t *testing.T) {
+	if err := withTempDir(func(tmpDir string) error {
+		path := filepath.Join(tmpDir, "base.tar")
+		if err := ioutil.WriteFile(path, []byte("base"), 0644); err != nil {
+			return err
+		}
+		sum := sha256.Sum256([]byte("base"))
+		return verifySHA256(
+			path,
+			"sha256:"+strings.ToUpper(hex.EncodeToString(sum[:])),
+		)
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBuild_goTestMain(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Compiles the Go standard library")
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("No Go toolchain on the host")
+	}
+	modules, err := filepath.Abs("modules")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A TestMain which doesn't call `os.Exit()` mustn't mask failing tests.
+	testFile := func(answer string) string {
+		return `package answer
+
+import "testing"
+
+func TestMain(m *testing.M) { m.Run() }
+
+func TestAnswer(t *testing.T) {
+	if ` + answer + ` != 42 {
+		t.Fatal("wrong answer")
+	}
+}
+`
+	}
+	if err := withTempDir(func(root string) error {
+		if err := os.Symlink(
+			modules,
+			filepath.Join(root, "modules"),
+		); err != nil {
+			return err
+		}
+		if err := writeTestFiles(root, map[string]string{
+			"default.star": `
+load("modules/go", "go_test")
+GO = host_tool("go")
+passing = go_test("passing", "answer", glob("passing/*.go"), "passing",
+    goTool = GO)
+failing = go_test("failing", "answer", glob("failing/*.go"), "failing",
+    goTool = GO)
+`,
+			"passing/answer_test.go": testFile("42"),
+			"failing/answer_test.go": testFile("41"),
+		}); err != nil {
+			return err
+		}
+
+		fsc, err := FileSystemCacheFromTempDir(
+			filepath.Join(root, "cache"),
+			sha256.New,
+		)
+		if err != nil {
+			return err
+		}
+		defer fsc.Close()
+		globals, err := execModule("", makeLoader(root, nil))
+		if err != nil {
+			return err
+		}
+		build := func(name string) error {
+			d, err := FreezeTarget(
+				root,
+				hashAlgorithms["sha256"],
+				fsc,
+				nil,
+				nil,
+				buildSettings(runtime.GOOS, runtime.GOARCH, nil),
+				globals[name].(*Target),
+			)
+			if err != nil {
+				return err
+			}
+			return BuildRecursive(fsc, d, fsc.tmpDir)
+		}
+
+		if err := build("passing"); err != nil {
+			return errors.Wrap(err, "Wanted the passing tests to pass")
+		}
+		if err := build("failing"); err == nil ||
+			!strings.Contains(err.Error(), "wrong answer") {
+			return errors.Errorf(
+				"Wanted the failing tests to fail; got %v",
+				err,
+			)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBuild_cc(t *testing.T) {
+	for _, tool := range []string{"cc", "ar"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("No %s on the host", tool)
+		}
+	}
+	modules, err := filepath.Abs("modules")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := withTempDir(func(root string) error {
+		if err := os.Symlink(
+			modules,
+			filepath.Join(root, "modules"),
+		); err != nil {
+			return err
+		}
+		// `lib/greet.c` and `lib_greet.c` must compile to distinct objects.
+		// The app only depends on `shout`, so `greet`'s headers and archive
+		// must reach it through `shout`.
+		if err := writeTestFiles(root, map[string]string{
+			"default.star": `
+load("modules/cc", "host_toolchain", "cc_library", "cc_binary", "cc_test",
+    "compile_commands")
+CC = host_toolchain("host-cc")
+greet = cc_library("greet", srcs = ["lib/greet.c", "lib_greet.c"],
+    hdrs = ["lib/greet.h"], includes = ["lib"])
+shout = cc_library("shout", srcs = ["shout.c"], deps = [greet])
+app_binary = cc_binary("app", srcs = ["main.c"], deps = [shout],
+    toolchain = CC)
+app_test = cc_test("app-test", srcs = ["main.c"], deps = [greet])
+commands = compile_commands("commands", [greet, app_binary])
+`,
+			"lib/greet.h":  "const char *greeting(void);\nint answer(void);\n",
+			"lib/unused.h": "int unused(void);\n",
+			"lib/greet.c":  "#include \"greet.h\"\nconst char *greeting(void) { return \"hello\"; }\n",
+			"lib_greet.c":  "int answer(void) { return 42; }\n",
+			"shout.c":      "#include <greet.h>\nint shout(void) { return answer(); }\n",
+			"main.c": `#include <stdio.h>
+#include <greet.h>
+int main(void) {
+	printf("%s %d\n", greeting(), answer());
+	return 0;
+}
+`,
+		}); err != nil {
+			return err
+		}
+
+		fsc, err := FileSystemCacheFromTempDir(
+			filepath.Join(root, "cache"),
+			sha256.New,
+		)
+		if err != nil {
+			return err
+		}
+		defer fsc.Close()
+		freeze := func(name string) (*Derivation, error) {
+			globals, err := execModule("", makeLoader(root, nil))
+			if err != nil {
+				return nil, err
+			}
+			// The rules which aren't passed a toolchain use the registered
+			// "cc" toolchain.
+			return FreezeTarget(
+				root,
+				hashAlgorithms["sha256"],
+				fsc,
+				nil,
+				map[string]Arg{"cc": globals["CC"].(*Target)},
+				buildSettings(runtime.GOOS, runtime.GOARCH, nil),
+				globals[name].(*Target),
+			)
+		}
+		build := func(name string) (string, error) {
+			d, err := freeze(name)
+			if err != nil {
+				return "", err
+			}
+			if err := BuildRecursive(fsc, d, fsc.tmpDir); err != nil {
+				return "", err
+			}
+			return filepath.Join(fsc.Root(), d.ID), nil
+		}
+
+		app, err := build("app_binary")
+		if err != nil {
+			return errors.Wrap(err, "Building app")
+		}
+		output, err := exec.Command(app).CombinedOutput()
+		if err != nil {
+			return errors.Wrapf(err, "Running app: %s", output)
+		}
+		if string(output) != "hello 42\n" {
+			return errors.Errorf("Wanted 'hello 42'; got '%s'", output)
+		}
+		testOutput, err := build("app_test")
+		if err != nil {
+			return errors.Wrap(err, "Running the test")
+		}
+		if data, err := ioutil.ReadFile(testOutput); err != nil {
+			return err
+		} else if string(data) != "hello 42\n" {
+			return errors.Errorf("Wanted test output 'hello 42'; got '%s'", data)
+		}
+
+		// Only the headers that a source includes are inputs to its object.
+		before, err := freeze("app_binary")
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(
+			filepath.Join(root, "lib/unused.h"),
+			[]byte("int unused(int);\n"),
+			0644,
+		); err != nil {
+			return err
+		}
+		after, err := freeze("app_binary")
+		if err != nil {
+			return err
+		}
+		if before.ID != after.ID {
+			return errors.Errorf("Wanted unused headers not to affect the app")
+		}
+		if err := ioutil.WriteFile(
+			filepath.Join(root, "lib/greet.h"),
+			[]byte("const char *greeting(void);\nint answer(void);\n\n"),
+			0644,
+		); err != nil {
+			return err
+		}
+		if after, err = freeze("app_binary"); err != nil {
+			return err
+		}
+		if before.ID == after.ID {
+			return errors.Errorf("Wanted included headers to affect the app")
+		}
+
+		// The compile commands script fills in the directory it's given.
+		script, err := build("commands")
+		if err != nil {
+			return errors.Wrap(err, "Building compile commands")
+		}
+		if output, err := exec.Command(script, root).CombinedOutput(); err != nil {
+			return errors.Wrapf(err, "Running compile commands: %s", output)
+		}
+		data, err := ioutil.ReadFile(filepath.Join(root, "compile_commands.json"))
+		if err != nil {
+			return err
+		}
+		var commands []struct {
+			Directory string `json:"directory"`
+			File      string `json:"file"`
+		}
+		if err := json.Unmarshal(data, &commands); err != nil {
+			return err
+		}
+		var files []string
+		for _, command := range commands {
+			if command.Directory != root {
+				return errors.Errorf(
+					"Wanted directory '%s'; got '%s'",
+					root,
+					command.Directory,
+				)
+			}
+			files = append(files, command.File)
+		}
+		if wanted := []string{
+			"lib/greet.c",
+			"lib_greet.c",
+			"main.c",
+			"shout.c",
+		}; !stringsEqual(files, wanted) {
+			return errors.Errorf("Wanted files %v; got %v", wanted, files)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileSystemCache_idempotentCommit(t *testing.T) {
+	if err := withTempDir(func(tmpDir string) error {
+		fsc, err := FileSystemCacheFromTempDir(tmpDir, sha256.New)
+		if err != nil {
+			return errors.Wrap(err, "Creating temp FileSystemCache directory")
+		}
+		defer fsc.Close()
+
+		commit := func(contents string) error {
+			return fsc.NewDirEntry(
+				func(dir CacheDir) error {
+					return dir.File(
+						"file",
+						nil,
+						func(w io.Writer) (os.FileMode, error) {
+							_, err := io.WriteString(w, contents)
+							return 0644, err
+						},
+					)
+				},
+				func() string { return "entry" },
+			)
+		}
+		if err := commit("first"); err != nil {
+			return err
+		}
+		path := filepath.Join(tmpDir, "entry", "file")
+		before, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+
+		// Committing the entry again leaves the existing entry in place and
+		// discards the new copy.
+		if err := commit("second"); err != nil {
+			return err
+		}
+		after, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if !os.SameFile(before, after) {
+			return errors.Errorf("Wanted the existing entry to be kept")
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if string(data) != "first" {
+			return errors.Errorf("Wanted contents 'first'; got '%s'", data)
+		}
+		leftovers, err := ioutil.ReadDir(fsc.tmpDir)
+		if err != nil {
+			return err
+		}
+		if len(leftovers) > 0 {
+			return errors.Errorf(
+				"Wanted no temporary artifacts; found %d",
+				len(leftovers),
+			)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileSystemCache_blobs(t *testing.T) {
+	if err := withTempDir(func(tmpDir string) error {
+		fsc, err := FileSystemCacheFromTempDir(tmpDir, sha256.New)
+		if err != nil {
+			return errors.Wrap(err, "Creating temp FileSystemCache directory")
+		}
+		defer fsc.Close()
+
+		commit := func(name string, files map[string]string) error {
+			return fsc.NewDirEntry(
+				func(dir CacheDir) error {
+					for relPath, contents := range files {
+						contents := contents
+						if err := dir.File(
+							relPath,
+							nil,
+							func(w io.Writer) (os.FileMode, error) {
+								_, err := io.WriteString(w, contents)
+								return 0644, err
+							},
+						); err != nil {
+							return err
+						}
+					}
+					return nil
+				},
+				func() string { return name },
+			)
+		}
+		if err := commit("a", map[string]string{
+			"same":  "hello",
+			"other": "goodbye",
+		}); err != nil {
+			return err
+		}
+		if err := commit("b", map[string]string{"same": "hello"}); err != nil {
+			return err
+		}
+
+		// Files with the same contents share a blob.
+		a, err := os.Stat(filepath.Join(tmpDir, "a", "same"))
+		if err != nil {
+			return err
+		}
+		b, err := os.Stat(filepath.Join(tmpDir, "b", "same"))
+		if err != nil {
+			return err
+		}
+		if !os.SameFile(a, b) {
+			return errors.Errorf("Wanted a/same and b/same to be linked")
+		}
+		// Shared blobs are read-only so that no entry can modify another's
+		// files.
+		if a.Mode().Perm()&0222 != 0 {
+			return errors.Errorf("Wanted a read-only blob; got %s", a.Mode())
+		}
+
+		stats, err := fsc.Stats()
+		if err != nil {
+			return err
+		}
+		wanted := cacheStats{
+			Entries:      2,
+			Blobs:        2,
+			LogicalSize:  int64(len("hello")*2 + len("goodbye")),
+			PhysicalSize: int64(len("hello") + len("goodbye")),
+		}
+		if stats != wanted {
+			return errors.Errorf("Wanted stats %+v; got %+v", wanted, stats)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateLegacyCache(t *testing.T) {
+	if err := withTempDir(func(cacheDir string) error {
+		commit := func(root string, name string) error {
+			fsc, err := FileSystemCacheFromTempDir(root, sha256.New)
+			if err != nil {
+				return err
+			}
+			defer fsc.Close()
+			return fsc.NewDirEntry(
+				func(dir CacheDir) error {
+					return dir.File(
+						"file",
+						nil,
+						func(w io.Writer) (os.FileMode, error) {
+							_, err := io.WriteString(w, name)
+							return 0644, err
+						},
+					)
+				},
+				func() string { return name },
+			)
+		}
+
+		// A legacy cache with entries `a` and `b`, of which the sha256 cache
+		// already has `b`, and entries with hex-encoded IDs (from before IDs
+		// were base32-encoded), which can no longer be reached.
+		id := func(name string) string {
+			sum := sha256.Sum256([]byte(name))
+			return derivationID(sum[:], name)
+		}
+		hexID := func(name string) string {
+			sum := sha256.Sum256([]byte(name))
+			return hex.EncodeToString(sum[:]) + "-" + name
+		}
+		algorithmDir := filepath.Join(cacheDir, defaultHashAlgorithm)
+		for _, name := range []string{id("a"), id("b"), hexID("c")} {
+			if err := commit(cacheDir, name); err != nil {
+				return err
+			}
+		}
+		for _, name := range []string{id("b"), hexID("d")} {
+			if err := commit(algorithmDir, name); err != nil {
+				return err
+			}
+		}
+		if err := os.Mkdir(
+			filepath.Join(cacheDir, gitCacheDirName),
+			0755,
+		); err != nil {
+			return err
+		}
+
+		migrated, removed, err := migrateLegacyCache(cacheDir)
+		if err != nil {
+			return err
+		}
+		if wanted := 4; migrated != wanted { // a, b, blobs and tmp
+			return errors.Errorf(
+				"Wanted %d migrated files; got %d",
+				wanted,
+				migrated,
+			)
+		}
+		if wanted := 2; removed != wanted { // c and d
+			return errors.Errorf(
+				"Wanted %d removed entries; got %d",
+				wanted,
+				removed,
+			)
+		}
+		remaining, err := legacyCacheEntries(cacheDir)
+		if err != nil {
+			return err
+		}
+		if len(remaining) > 0 {
+			return errors.Errorf(
+				"Wanted no legacy entries; found %v",
+				remaining,
+			)
+		}
+		if _, err := os.Stat(
+			filepath.Join(cacheDir, gitCacheDirName),
+		); err != nil {
+			return errors.Wrap(err, "Wanted the git directory to be kept")
+		}
+		for _, name := range []string{id("a"), id("b")} {
+			data, err := ioutil.ReadFile(
+				filepath.Join(algorithmDir, name, "file"),
+			)
+			if err != nil {
+				return err
+			}
+			if string(data) != name {
+				return errors.Errorf(
+					"Wanted %s/file contents '%s'; got '%s'",
+					name,
+					name,
+					data,
+				)
+			}
+		}
+		for _, name := range []string{hexID("c"), hexID("d")} {
+			if _, err := os.Stat(
+				filepath.Join(algorithmDir, name),
+			); !os.IsNotExist(err) {
+				return errors.Errorf("Wanted '%s' to be removed", name)
+			}
+		}
+
+		// The blob stores are merged.
+		fsc, err := FileSystemCacheFromTempDir(algorithmDir, sha256.New)
+		if err != nil {
+			return err
+		}
+		defer fsc.Close()
+		stats, err := fsc.Stats()
+		if err != nil {
+			return err
+		}
+		if stats.Entries != 2 || stats.Blobs != 2 {
+			return errors.Errorf(
+				"Wanted 2 entries and 2 blobs; got %+v",
+				stats,
+			)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileSystemCache_resolve(t *testing.T) {
+	if err := withTempDir(func(tmpDir string) error {
+		fsc, err := FileSystemCacheFromTempDir(tmpDir, sha256.New)
+		if err != nil {
+			return errors.Wrap(err, "Creating temp FileSystemCache directory")
+		}
+		defer fsc.Close()
+
+		for _, name := range []string{"b0a-one", "b0b-two"} {
+			if err := fsc.NewFileEntry(
+				func(w io.Writer) (os.FileMode, error) {
+					_, err := io.WriteString(w, name)
+					return 0644, err
+				},
+				func() string { return name },
+			); err != nil {
+				return err
+			}
+		}
+
+		if err := fsc.WriteDerivationRecord(
+			&Derivation{ID: "b0a-one", HashAlgorithm: "sha256"},
+		); err != nil {
+			return err
+		}
+
+		// The blob store, the temporary directory and derivation records
+		// aren't entries.
+		for prefix, wanted := range map[string][]string{
+			"b":       {"b0a-one", "b0b-two"},
+			"b0a":     {"b0a-one"},
+			"b0b-two": {"b0b-two"},
+			"c":       nil,
+		} {
+			got, err := fsc.Resolve(prefix)
+			if err != nil {
+				return err
+			}
+			if strings.Join(got, ",") != strings.Join(wanted, ",") {
+				return errors.Errorf(
+					"Resolving '%s': wanted %v; got %v",
+					prefix,
+					wanted,
+					got,
+				)
+			}
+		}
+		return nil
 	}); err != nil {
 		t.Fatal(err)
 	}
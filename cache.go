@@ -1,16 +1,46 @@
 package main
 
 import (
+	"fmt"
 	"io"
 	"os"
 )
 
 type CacheFileCallback func(io.Writer) (os.FileMode, error)
 
-type CacheDir func(relpath string, callback CacheFileCallback) error
+// CacheDir adds files to a directory entry. Its methods may be called
+// concurrently, and they create parent directories as necessary.
+type CacheDir interface {
+	// File adds a regular file whose contents are written by `callback`. If
+	// `hash` isn't nil, it's the expected hash of the contents, and a file
+	// whose contents don't match is rejected with a `contentHashMismatchErr`.
+	File(relpath string, hash []byte, callback CacheFileCallback) error
+
+	// Symlink adds a symbolic link to `target`.
+	Symlink(relpath string, target string) error
+
+	// Dir adds a (possibly empty) directory with the given permissions.
+	Dir(relpath string, mode os.FileMode) error
+}
 
 type CacheDirCallback func(CacheDir) error
 
+// contentHashMismatchErr is returned when a file's contents don't match the
+// hash that they were expected to have (e.g., because the file changed
+// between being hashed and being copied into the cache).
+type contentHashMismatchErr struct {
+	wanted []byte
+	got    []byte
+}
+
+func (err contentHashMismatchErr) Error() string {
+	return fmt.Sprintf(
+		"Content hash mismatch: wanted %x; got %x",
+		err.wanted,
+		err.got,
+	)
+}
+
 type NameCallback func() string
 
 // NOTE: Cache methods take a NameCallback (a function that returns the name)
@@ -25,7 +55,10 @@ type NameCallback func() string
 // an error--at some point we should explore these other options and see what
 // is most ergonomic).
 
+// Cache is a content-addressed store. Committing an entry whose name already
+// exists leaves the existing entry in place.
 type Cache interface {
 	NewDirEntry(CacheDirCallback, NameCallback) error
 	NewFileEntry(CacheFileCallback, NameCallback) error
+	Exists(name string) (bool, error)
 }
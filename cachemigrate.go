@@ -0,0 +1,190 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// legacyCacheEntries returns the names of the files in the cache directory at
+// `cacheDir` which belong to a cache from before each hash algorithm had its
+// own directory, when the cache's entries (and its blob store, temporary
+// directory and file hash cache) were stored in the cache directory itself.
+func legacyCacheEntries(cacheDir string) ([]string, error) {
+	fileInfos, err := ioutil.ReadDir(cacheDir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, fi := range fileInfos {
+		name := fi.Name()
+		if _, found := hashAlgorithms[name]; found ||
+			name == gitCacheDirName ||
+			name == packageHashCacheName {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// warnLegacyCache logs a warning if the cache directory at `cacheDir` has a
+// legacy cache which should be migrated.
+func warnLegacyCache(cacheDir string) {
+	names, err := legacyCacheEntries(cacheDir)
+	if err == nil && len(names) > 0 {
+		log.Printf(
+			"WARN %s has %d files in the legacy cache layout; run "+
+				"`g8r cache migrate` to move them into %s and remove the "+
+				"entries which are no longer reachable",
+			cacheDir,
+			len(names),
+			filepath.Join(cacheDir, defaultHashAlgorithm),
+		)
+	}
+}
+
+// reachableEntry returns true if `name` is the name of a cache entry that
+// current builds can look up, i.e., its hash is encoded like a derivation ID
+// (see `encodeHash()`). Entries with older (hex-encoded) hashes can never be
+// reached again.
+func reachableEntry(name string) bool {
+	if i := strings.Index(name, "-"); i >= 0 {
+		name = name[:i]
+	}
+	if len(name) != idEncoding.EncodedLen(idHashSize) {
+		return false
+	}
+	_, err := idEncoding.DecodeString(name)
+	return err == nil
+}
+
+// cacheBookkeeping returns true if `name` is one of the files in a cache
+// directory which isn't an entry.
+func cacheBookkeeping(name string) bool {
+	return name == cacheBlobDirName ||
+		name == cacheTmpDirName ||
+		name == fileHashCacheName
+}
+
+// migrateLegacyCache moves the legacy cache in the cache directory at
+// `cacheDir` (see `legacyCacheEntries()`) into the directory of the default
+// hash algorithm, which was the only algorithm that legacy caches used, and
+// removes the entries in the cache directory and in each algorithm's
+// directory which are no longer reachable (see `reachableEntry()`), along
+// with the blobs which only they used. It returns the number of files that it
+// moved and the number of entries that it removed. It mustn't run while builds
+// are using the cache, since they may be about to link a blob that it
+// removes. Entries which are already in the algorithm's directory are
+// identical to the legacy ones (since entries are content-addressed), so the
+// legacy copies are removed. The legacy blob store is merged into the
+// algorithm's blob store.
+func migrateLegacyCache(cacheDir string) (int, int, error) {
+	names, err := legacyCacheEntries(cacheDir)
+	if err != nil {
+		return 0, 0, err
+	}
+	algorithmDir := filepath.Join(cacheDir, defaultHashAlgorithm)
+	if err := os.MkdirAll(algorithmDir, 0755); err != nil {
+		return 0, 0, err
+	}
+	var migrated, removed int
+	for _, name := range names {
+		src := filepath.Join(cacheDir, name)
+		if !cacheBookkeeping(name) && !reachableEntry(name) {
+			if err := removeArtifact(src); err != nil {
+				return migrated, removed, err
+			}
+			removed++
+			continue
+		}
+		if err := moveLegacyFile(
+			src,
+			filepath.Join(algorithmDir, name),
+			name == cacheBlobDirName,
+		); err != nil {
+			return migrated, removed, err
+		}
+		migrated++
+	}
+
+	for algorithm := range hashAlgorithms {
+		fileInfos, err := ioutil.ReadDir(filepath.Join(cacheDir, algorithm))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return migrated, removed, err
+		}
+		for _, fi := range fileInfos {
+			if cacheBookkeeping(fi.Name()) || reachableEntry(fi.Name()) {
+				continue
+			}
+			if err := removeArtifact(
+				filepath.Join(cacheDir, algorithm, fi.Name()),
+			); err != nil {
+				return migrated, removed, err
+			}
+			removed++
+		}
+		if err := removeUnlinkedBlobs(
+			filepath.Join(cacheDir, algorithm, cacheBlobDirName),
+		); err != nil {
+			return migrated, removed, err
+		}
+	}
+	return migrated, removed, nil
+}
+
+// removeUnlinkedBlobs removes the blobs in the blob store at `blobDir` which
+// no entry links to. Blobs whose link counts are unknown are kept.
+func removeUnlinkedBlobs(blobDir string) error {
+	err := filepath.Walk(
+		blobDir,
+		func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if fi.Mode().IsRegular() && fileLinks(fi) == 1 {
+				return os.Remove(path)
+			}
+			return nil
+		},
+	)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// moveLegacyFile moves the file at `src` to `dst` unless `dst` already exists,
+// in which case `src` is removed. If `merge` is true, the contents of the `src`
+// directory (and its subdirectories) are merged into the `dst` directory
+// instead.
+func moveLegacyFile(src string, dst string, merge bool) error {
+	if _, err := os.Lstat(dst); os.IsNotExist(err) {
+		return os.Rename(src, dst)
+	} else if err != nil {
+		return err
+	}
+	if !merge {
+		return removeArtifact(src)
+	}
+
+	fileInfos, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fileInfos {
+		if err := moveLegacyFile(
+			filepath.Join(src, fi.Name()),
+			filepath.Join(dst, fi.Name()),
+			fi.IsDir(),
+		); err != nil {
+			return err
+		}
+	}
+	return os.Remove(src)
+}
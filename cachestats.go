@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// cacheStats summarizes the disk usage of a `FileSystemCache`.
+type cacheStats struct {
+	// Entries is the number of entries (snapshots and build outputs) in the
+	// cache and Blobs is the number of blobs in the blob store.
+	Entries int
+	Blobs   int
+
+	// LogicalSize is the total size of the files in the cache's entries, as
+	// if every entry were a full copy. PhysicalSize is the space that the
+	// cache's files actually occupy, counting each hard-linked file once.
+	LogicalSize  int64
+	PhysicalSize int64
+}
+
+// Stats walks the cache and computes its disk usage. Files which aren't cache
+// entries (the temporary directory, the file hash cache and derivation
+// records) are skipped.
+func (fsc *FileSystemCache) Stats() (cacheStats, error) {
+	var stats cacheStats
+	seen := map[uint64]struct{}{}
+	countPhysical := func(fi os.FileInfo) {
+		if inode := fileInode(fi); inode != 0 {
+			if _, found := seen[inode]; found {
+				return
+			}
+			seen[inode] = struct{}{}
+		}
+		stats.PhysicalSize += fi.Size()
+	}
+
+	fileInfos, err := ioutil.ReadDir(fsc.root)
+	if err != nil {
+		return stats, err
+	}
+	for _, entry := range fileInfos {
+		name := entry.Name()
+		if name == cacheTmpDirName ||
+			name == fileHashCacheName ||
+			isDerivationRecord(name) {
+			continue
+		}
+		isBlobs := name == cacheBlobDirName
+		if !isBlobs {
+			stats.Entries++
+		}
+		if err := filepath.Walk(
+			filepath.Join(fsc.root, name),
+			func(path string, fi os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if !fi.Mode().IsRegular() {
+					return nil
+				}
+				if isBlobs {
+					stats.Blobs++
+				} else {
+					stats.LogicalSize += fi.Size()
+				}
+				countPhysical(fi)
+				return nil
+			},
+		); err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+// write prints the stats in a human-readable form.
+func (stats cacheStats) write(w io.Writer) error {
+	saved := 0.0
+	if stats.LogicalSize > 0 {
+		saved = 100 * (1 - float64(stats.PhysicalSize)/
+			float64(stats.LogicalSize))
+	}
+	_, err := fmt.Fprintf(
+		w,
+		"Entries:        %d\n"+
+			"Blobs:          %d\n"+
+			"Logical size:   %s\n"+
+			"Physical size:  %s\n"+
+			"Saved:          %.1f%%\n",
+		stats.Entries,
+		stats.Blobs,
+		formatSize(stats.LogicalSize),
+		formatSize(stats.PhysicalSize),
+		saved,
+	)
+	return err
+}
+
+// formatSize formats a size in bytes with binary units.
+func formatSize(size int64) string {
+	const units = "KMGTPE"
+	if size < 1024 {
+		return fmt.Sprintf("%d B", size)
+	}
+	value, unit := float64(size)/1024, 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f %ciB (%d bytes)", value, units[unit], size)
+}
@@ -1,14 +1,30 @@
 package main
 
-import "encoding/json"
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
 
 type Derivation struct {
-	ID           string
-	Hash         []byte
+	// ID identifies the derivation's output in the cache. It is the encoded
+	// prefix of the derivation's hash (see `encodeHash()`) followed by its
+	// name, and Hash is the full hash. The full hash is recorded next to the
+	// derivation's output in the cache (see `derivationRecord`).
+	ID   string
+	Hash []byte
+
+	// HashAlgorithm is the name of the hash algorithm which computed the
+	// derivation's ID.
+	HashAlgorithm string
+
 	Dependencies []*Derivation
 	Builder      string
 	Args         []string
 	Env          []string
+	OutputHash   string `json:",omitempty"`
 }
 
 func (d *Derivation) String() string {
@@ -22,3 +38,48 @@ func (d *Derivation) String() string {
 	)
 	return string(data)
 }
+
+// derivationRecordExt is the extension of derivation records in the cache.
+const derivationRecordExt = ".drv"
+
+// derivationRecord is written to `<id>.drv` next to a derivation's output
+// when the output is committed to the cache. Derivation IDs only hold a
+// prefix of the derivation's hash, so the record keeps the full hash (and
+// the hash that a fixed-output derivation's output was verified against)
+// for `g8r resolve`.
+type derivationRecord struct {
+	Hash          string
+	HashAlgorithm string
+	OutputHash    string `json:",omitempty"`
+}
+
+func newDerivationRecord(d *Derivation) derivationRecord {
+	return derivationRecord{
+		Hash:          hex.EncodeToString(d.Hash),
+		HashAlgorithm: d.HashAlgorithm,
+		OutputHash:    d.OutputHash,
+	}
+}
+
+// isDerivationRecord returns true if `name` is the name of a derivation
+// record in the cache.
+func isDerivationRecord(name string) bool {
+	return strings.HasSuffix(name, derivationRecordExt)
+}
+
+// write prints the record in a human-readable form.
+func (record derivationRecord) write(w io.Writer) error {
+	if _, err := fmt.Fprintf(
+		w,
+		"Hash:           %s:%s\n",
+		record.HashAlgorithm,
+		record.Hash,
+	); err != nil {
+		return err
+	}
+	if record.OutputHash != "" {
+		_, err := fmt.Fprintf(w, "Output hash:    %s\n", record.OutputHash)
+		return err
+	}
+	return nil
+}
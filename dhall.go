@@ -0,0 +1,433 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/philandstuff/dhall-golang/v4/core"
+	"github.com/philandstuff/dhall-golang/v4/imports"
+	"github.com/philandstuff/dhall-golang/v4/parser"
+	"github.com/philandstuff/dhall-golang/v4/term"
+	"github.com/pkg/errors"
+	"go.starlark.net/starlark"
+)
+
+// Dhall modules are an alternative to Starlark modules for declaring targets.
+// A Dhall module must evaluate to a record whose fields are targets:
+//
+//     let Arg = < String : Text | Path : Text | Glob : List Text | Target : Text
+//               | Sub : { format : Text
+//                       , substitutions : List { mapKey : Text, mapValue : Arg }
+//                       } >
+//     let Target = { name : Text, builder : Text, args : List Arg, env : List Text }
+//
+// (Dhall has no recursive types, so in practice the `mapValue` type is a
+// union of the non-`Sub` alternatives.) Only the alternative names matter to
+// g8r, so each module is free to declare its own union types. A `Target`
+// alternative refers to another target by label: either the name of another
+// field in the same Dhall module or `<module address>:<global>`, where the
+// module address is anything that can be passed to Starlark's `load()`
+// (e.g., `modules/go:GOTOOL` or `std:modules/go:GOTOOL`). Since Dhall
+// modules are loaded through the same loader as Starlark modules, Starlark
+// modules can also `load()` targets from Dhall modules. Dhall modules may
+// only import other files in their package; absolute, parent-relative,
+// environment and remote imports are rejected.
+
+// dhallModuleSuffix is the file extension that identifies Dhall modules.
+const dhallModuleSuffix = ".dhall"
+
+// execDhallModule evaluates the Dhall module at `filePath` and converts each
+// field of the resulting record into a `*Target`.
+func execDhallModule(
+	th *starlark.Thread,
+	filePath string,
+	data []byte,
+) (starlark.StringDict, error) {
+	parsed, err := parser.Parse(filePath, data)
+	if err != nil {
+		return nil, errors.Wrap(err, "Parsing Dhall module")
+	}
+	root, ok := th.Local(packageRootLocal).(string)
+	if !ok {
+		return nil, errors.Errorf("Not called from within a package module")
+	}
+	if err := checkDhallImports(
+		root,
+		filePath,
+		parsed,
+		map[string]struct{}{},
+	); err != nil {
+		return nil, err
+	}
+	resolved, err := imports.Load(parsed, term.LocalFile(filePath))
+	if err != nil {
+		return nil, errors.Wrap(err, "Resolving Dhall imports")
+	}
+	if _, err := core.TypeOf(resolved); err != nil {
+		return nil, errors.Wrap(err, "Type-checking Dhall module")
+	}
+
+	record, ok := core.Quote(core.Eval(resolved)).(term.RecordLit)
+	if !ok {
+		return nil, errors.Errorf(
+			"Dhall module must evaluate to a record of targets",
+		)
+	}
+
+	dm := dhallModule{
+		thread:  th,
+		fields:  record,
+		targets: map[string]*Target{},
+		pending: map[string]struct{}{},
+	}
+	globals := make(starlark.StringDict, len(record))
+	for _, field := range sortedDhallFields(record) {
+		t, err := dm.target(field)
+		if err != nil {
+			return nil, err
+		}
+		globals[field] = t
+	}
+	return globals, nil
+}
+
+// checkDhallImports makes sure that `t`, and every file that it transitively
+// imports, only imports files in the package at `root`. This applies the same
+// protections against escaping the package root as `resolveModule` and keeps
+// Dhall modules from depending on the environment or the network. `visited`
+// holds the files which have already been checked.
+func checkDhallImports(
+	root string,
+	filePath string,
+	t term.Term,
+	visited map[string]struct{},
+) error {
+	visited[filePath] = struct{}{}
+	for _, imp := range dhallImports(t) {
+		local, ok := imp.Fetchable.(term.LocalFile)
+		if !ok || local.IsAbs() || local.IsRelativeToHome() ||
+			strings.Contains(string(local), "..") {
+			return errors.Errorf(
+				"Dhall import '%s' in '%s' must be a file in the package",
+				imp.Fetchable,
+				filePath,
+			)
+		}
+		path := filepath.Join(filepath.Dir(filePath), string(local))
+		if rel, err := filepath.Rel(root, path); err != nil ||
+			strings.HasPrefix(rel, "..") {
+			return errors.Errorf(
+				"Dhall import '%s' in '%s' must be a file in the package",
+				imp.Fetchable,
+				filePath,
+			)
+		}
+
+		// Only code imports can import other files.
+		if imp.ImportMode != term.Code {
+			continue
+		}
+		if _, found := visited[path]; found {
+			continue
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return errors.Wrapf(err, "Dhall import '%s'", imp.Fetchable)
+		}
+		parsed, err := parser.Parse(path, data)
+		if err != nil {
+			return errors.Wrapf(err, "Parsing Dhall import '%s'", path)
+		}
+		if err := checkDhallImports(root, path, parsed, visited); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dhallImports returns the imports in a parsed Dhall term. There are many
+// kinds of terms, so they are walked reflectively rather than with a type
+// switch that could silently miss one.
+func dhallImports(t term.Term) []term.Import {
+	importType := reflect.TypeOf(term.Import{})
+	var imports []term.Import
+	var walk func(v reflect.Value)
+	walk = func(v reflect.Value) {
+		switch v.Kind() {
+		case reflect.Interface, reflect.Ptr:
+			if !v.IsNil() {
+				walk(v.Elem())
+			}
+		case reflect.Struct:
+			if v.Type() == importType {
+				imports = append(imports, v.Interface().(term.Import))
+				return
+			}
+			for i := 0; i < v.NumField(); i++ {
+				walk(v.Field(i))
+			}
+		case reflect.Slice, reflect.Array:
+			for i := 0; i < v.Len(); i++ {
+				walk(v.Index(i))
+			}
+		case reflect.Map:
+			// Walk the fields in a stable order so that errors are reported
+			// deterministically.
+			keys := v.MapKeys()
+			sort.Slice(keys, func(i, j int) bool {
+				return keys[i].String() < keys[j].String()
+			})
+			for _, key := range keys {
+				walk(v.MapIndex(key))
+			}
+		}
+	}
+	walk(reflect.ValueOf(t))
+	return imports
+}
+
+// dhallModule holds the state for converting a Dhall module's fields into
+// targets. Since fields may refer to each other by label, they are converted
+// on demand and memoized.
+type dhallModule struct {
+	thread  *starlark.Thread
+	fields  term.RecordLit
+	targets map[string]*Target
+	pending map[string]struct{}
+}
+
+func (dm *dhallModule) target(field string) (*Target, error) {
+	if t, found := dm.targets[field]; found {
+		return t, nil
+	}
+	if _, found := dm.pending[field]; found {
+		return nil, errors.Errorf("Cycle in Dhall targets at '%s'", field)
+	}
+	dm.pending[field] = struct{}{}
+	defer delete(dm.pending, field)
+
+	value, found := dm.fields[field]
+	if !found {
+		return nil, errors.Errorf("Dhall module has no field '%s'", field)
+	}
+	t, err := dm.decodeTarget(value)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Dhall field '%s'", field)
+	}
+	if label, ok := dm.thread.Local(moduleLabelLocal).(moduleLabel); ok {
+		t.Module = &label
+	}
+	t.Inputs, _ = dm.thread.Local(moduleInputsLocal).(moduleInputs)
+	dm.targets[field] = t
+	return t, nil
+}
+
+func (dm *dhallModule) decodeTarget(value term.Term) (*Target, error) {
+	record, ok := value.(term.RecordLit)
+	if !ok {
+		return nil, errors.Errorf("Expected a target record")
+	}
+
+	var t Target
+	for _, field := range sortedDhallFields(record) {
+		var err error
+		switch field {
+		case "name":
+			t.Name, err = decodeDhallText(record[field])
+		case "builder":
+			t.Builder, err = decodeDhallText(record[field])
+		case "env":
+			t.Env, err = decodeDhallTextList(record[field])
+		case "args":
+			var args []term.Term
+			if args, err = decodeDhallList(record[field]); err != nil {
+				break
+			}
+			t.Args = make([]Arg, len(args))
+			for i, arg := range args {
+				if t.Args[i], err = dm.decodeArg(arg); err != nil {
+					err = errors.Wrapf(err, "Argument 'args[%d]'", i)
+					break
+				}
+			}
+		default:
+			err = errors.Errorf("Unexpected target field '%s'", field)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "Target field '%s'", field)
+		}
+	}
+	if t.Name == "" || t.Builder == "" {
+		return nil, errors.Errorf("Targets require a 'name' and 'builder'")
+	}
+	return &t, nil
+}
+
+// decodeArg converts a union value into an `Arg` based on the name of its
+// alternative.
+func (dm *dhallModule) decodeArg(value term.Term) (Arg, error) {
+	app, ok := value.(term.App)
+	if !ok {
+		return nil, errors.Errorf("Expected an Arg union value")
+	}
+	alternative, ok := app.Fn.(term.Field)
+	if !ok {
+		return nil, errors.Errorf("Expected an Arg union value")
+	}
+
+	switch alternative.FieldName {
+	case "String":
+		s, err := decodeDhallText(app.Arg)
+		return String(s), err
+	case "Path":
+		s, err := decodeDhallText(app.Arg)
+		return Path(s), err
+	case "Glob":
+		patterns, err := decodeDhallTextList(app.Arg)
+		return GlobGroup{Patterns: patterns}, err
+	case "Target":
+		label, err := decodeDhallText(app.Arg)
+		if err != nil {
+			return nil, err
+		}
+		return dm.resolveLabel(label)
+	case "Sub":
+		return dm.decodeSub(app.Arg)
+	default:
+		return nil, errors.Errorf(
+			"Unknown Arg alternative '%s'",
+			alternative.FieldName,
+		)
+	}
+}
+
+func (dm *dhallModule) decodeSub(value term.Term) (*Sub, error) {
+	record, ok := value.(term.RecordLit)
+	if !ok {
+		return nil, errors.Errorf("Expected a Sub record")
+	}
+	format, err := decodeDhallText(record["format"])
+	if err != nil {
+		return nil, errors.Wrap(err, "Sub field 'format'")
+	}
+	entries, err := decodeDhallList(record["substitutions"])
+	if err != nil {
+		return nil, errors.Wrap(err, "Sub field 'substitutions'")
+	}
+
+	substitutions := make([]Substitution, len(entries))
+	for i, entry := range entries {
+		entry, ok := entry.(term.RecordLit)
+		if !ok {
+			return nil, errors.Errorf("Expected a mapKey/mapValue record")
+		}
+		key, err := decodeDhallText(entry["mapKey"])
+		if err != nil {
+			return nil, errors.Wrap(err, "Substitution key")
+		}
+		value, err := dm.decodeArg(entry["mapValue"])
+		if err != nil {
+			return nil, errors.Wrapf(err, "Substitution '%s'", key)
+		}
+		substitutions[i] = Substitution{Key: key, Value: value}
+	}
+	return &Sub{Format: format, Substitutions: substitutions}, nil
+}
+
+// resolveLabel looks up the target for a label. Labels without a module
+// address refer to fields in the current Dhall module.
+func (dm *dhallModule) resolveLabel(label string) (*Target, error) {
+	addr, name := parseLabel(label)
+	if addr == "" {
+		return dm.target(name)
+	}
+
+	globals, err := dm.thread.Load(dm.thread, addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Loading label '%s'", label)
+	}
+	value, found := globals[name]
+	if !found {
+		return nil, errors.Errorf(
+			"Label '%s': module '%s' has no global '%s'",
+			label,
+			addr,
+			name,
+		)
+	}
+	t, ok := value.(*Target)
+	if !ok {
+		return nil, errors.Errorf(
+			"Label '%s': expected a Target; found %s",
+			label,
+			value.Type(),
+		)
+	}
+	return t, nil
+}
+
+// parseLabel splits a label into a module address and a global name. The
+// global name follows the last ':' since the module address may itself
+// contain a package prefix (e.g., `std:modules/go:GOTOOL`).
+func parseLabel(label string) (addr, name string) {
+	i := strings.LastIndex(label, ":")
+	if i < 0 {
+		return "", label
+	}
+	return label[:i], label[i+1:]
+}
+
+func decodeDhallText(value term.Term) (string, error) {
+	switch x := value.(type) {
+	case term.TextLit:
+		if len(x.Chunks) > 0 {
+			return "", errors.Errorf("Expected fully-evaluated Text")
+		}
+		return x.Suffix, nil
+	case nil:
+		return "", errors.Errorf("Missing Text value")
+	default:
+		return "", errors.Errorf("Expected Text")
+	}
+}
+
+func decodeDhallList(value term.Term) ([]term.Term, error) {
+	switch x := value.(type) {
+	case term.EmptyList:
+		return nil, nil
+	case term.NonEmptyList:
+		return x, nil
+	case nil:
+		return nil, errors.Errorf("Missing List value")
+	default:
+		return nil, errors.Errorf("Expected a List")
+	}
+}
+
+func decodeDhallTextList(value term.Term) ([]string, error) {
+	items, err := decodeDhallList(value)
+	if err != nil {
+		return nil, err
+	}
+	ss := make([]string, len(items))
+	for i, item := range items {
+		if ss[i], err = decodeDhallText(item); err != nil {
+			return nil, errors.Wrapf(err, "Element %d", i)
+		}
+	}
+	return ss, nil
+}
+
+// sortedDhallFields returns a record's field names in a stable order so that
+// errors are reported deterministically.
+func sortedDhallFields(record term.RecordLit) []string {
+	fields := make([]string, 0, len(record))
+	for field := range record {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fields
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestExecDhallModule(t *testing.T) {
+	files := map[string]string{
+		"modules/tools/default.star": `
+tool = target(name="tool", builder="bash", args=["-c", "touch $out"], env=[])
+`,
+		"targets.dhall": `
+let Leaf = < String : Text | Path : Text | Glob : List Text | Target : Text >
+let Arg =
+      < String : Text
+      | Path : Text
+      | Glob : List Text
+      | Target : Text
+      | Sub :
+          { format : Text
+          , substitutions : List { mapKey : Text, mapValue : Leaf }
+          }
+      >
+in  { lib =
+        { name = "lib"
+        , builder = "bash"
+        , args = [ Arg.String "-c", Arg.Path "lib.c" ]
+        , env = [] : List Text
+        }
+    , app =
+        { name = "app"
+        , builder = "bash"
+        , args =
+          [ Arg.String "-c"
+          , Arg.Sub
+              { format = "\${Tool} \${Lib} \${Srcs}"
+              , substitutions =
+                [ { mapKey = "Tool", mapValue = Leaf.Target "modules/tools:tool" }
+                , { mapKey = "Lib", mapValue = Leaf.Target "lib" }
+                , { mapKey = "Srcs", mapValue = Leaf.Glob [ "*.c" ] }
+                ]
+              }
+          ]
+        , env = [ "A=b" ]
+        }
+    }
+`,
+		"default.star": `
+load("targets.dhall", "app")
+deps = [s.name for s in app.args[1].substitutions.values()[:2]]
+`,
+	}
+
+	if err := withTempDir(func(root string) error {
+		for relPath, contents := range files {
+			filePath := filepath.Join(root, relPath)
+			if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(
+				filePath,
+				[]byte(contents),
+				0644,
+			); err != nil {
+				return err
+			}
+		}
+
+		globals, err := execModule("", makeLoader(root, nil))
+		if err != nil {
+			return err
+		}
+
+		if wanted, got := `["tool", "lib"]`, globals["deps"].String(); got != wanted {
+			return errors.Errorf("Wanted deps %s; got %s", wanted, got)
+		}
+
+		globals, err = execModule("targets.dhall", makeLoader(root, nil))
+		if err != nil {
+			return err
+		}
+		app, ok := globals["app"].(*Target)
+		if !ok {
+			return errors.Errorf("Wanted app Target; got %v", globals["app"])
+		}
+		if app.Name != "app" || app.Builder != "bash" {
+			return errors.Errorf("Unexpected app target: %s", app)
+		}
+		if len(app.Env) != 1 || app.Env[0] != "A=b" {
+			return errors.Errorf("Wanted env [A=b]; got %v", app.Env)
+		}
+		sub, ok := app.Args[1].(*Sub)
+		if !ok {
+			return errors.Errorf("Wanted Sub argument; got %v", app.Args[1])
+		}
+		if sub.Format != "${Tool} ${Lib} ${Srcs}" {
+			return errors.Errorf("Unexpected format '%s'", sub.Format)
+		}
+		if sub.Substitutions[1].Value != Arg(globals["lib"].(*Target)) {
+			return errors.Errorf("Wanted the 'lib' field's target")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExecDhallModule_cycle(t *testing.T) {
+	if err := withTempDir(func(root string) error {
+		if err := ioutil.WriteFile(
+			filepath.Join(root, "cycle.dhall"),
+			[]byte(`
+let Arg = < String : Text | Target : Text >
+in  { a = { name = "a", builder = "bash", args = [ Arg.Target "b" ], env = [] : List Text }
+    , b = { name = "b", builder = "bash", args = [ Arg.Target "a" ], env = [] : List Text }
+    }
+`),
+			0644,
+		); err != nil {
+			return err
+		}
+
+		if _, err := execModule(
+			"cycle.dhall",
+			makeLoader(root, nil),
+		); err == nil {
+			return errors.Errorf("Wanted a cycle error; got nil")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExecDhallModule_imports(t *testing.T) {
+	const record = `{ a = { name = "a", builder = "bash", args = [] : List Text, env = [] : List Text } }`
+	for _, testCase := range []struct {
+		name    string
+		module  string
+		wantErr bool
+	}{
+		{name: "local", module: "./record.dhall"},
+		{name: "subdirectory", module: "./sub/record.dhall"},
+		{name: "absolute", module: "/etc/hostname as Text", wantErr: true},
+		{name: "parent", module: "../record.dhall", wantErr: true},
+		{name: "env", module: "env:HOME as Text", wantErr: true},
+		{
+			name:    "remote",
+			module:  "https://example.com/record.dhall",
+			wantErr: true,
+		},
+		{
+			// Imports are checked transitively.
+			name:    "transitive",
+			module:  "./sub/env.dhall",
+			wantErr: true,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			if err := withTempDir(func(tmpDir string) error {
+				root := filepath.Join(tmpDir, "pkg")
+				if err := os.MkdirAll(filepath.Join(root, "sub"), 0755); err != nil {
+					return err
+				}
+				for relPath, contents := range map[string]string{
+					"../record.dhall":  record,
+					"record.dhall":     record,
+					"sub/record.dhall": record,
+					"sub/env.dhall":    "let home = env:HOME as Text in " + record,
+					"targets.dhall":    testCase.module,
+				} {
+					if err := ioutil.WriteFile(
+						filepath.Join(root, relPath),
+						[]byte(contents),
+						0644,
+					); err != nil {
+						return err
+					}
+				}
+
+				_, err := execModule("targets.dhall", makeLoader(root, nil))
+				if testCase.wantErr {
+					if err == nil || !strings.Contains(
+						err.Error(),
+						"must be a file in the package",
+					) {
+						return errors.Errorf(
+							"Wanted an import error; got %v",
+							err,
+						)
+					}
+					return nil
+				}
+				return err
+			}); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
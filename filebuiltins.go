@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.starlark.net/starlark"
+)
+
+// The builtins in this file let Starlark modules inspect the files in their
+// package while they are being evaluated (e.g., to parse a go.mod file into
+// per-dependency targets). They are restricted to the package root of the
+// module being evaluated, and everything they read is recorded as an input
+// of the module.
+
+const (
+	packageRootLocal  = "packageRoot"
+	moduleInputsLocal = "moduleInputs"
+)
+
+// moduleInputs records what a module's evaluation read, including the inputs
+// of any modules it loaded. It maps each file's path to a `moduleInput`.
+// Targets carry the inputs of the module whose evaluation created them, and
+// the inputs are part of the targets' derivation hashes, so changing a file
+// that a module read rebuilds its targets even if their args are unchanged.
+type moduleInputs map[string]moduleInput
+
+// moduleInput is a file's path relative to its package root and the hash of
+// what was read (its contents, its directory listing or whether it exists).
+type moduleInput struct {
+	relPath string
+	hash    [sha256.Size]byte
+}
+
+// merge adds the inputs in `other`.
+func (mi moduleInputs) merge(other moduleInputs) {
+	for path, input := range other {
+		mi[path] = input
+	}
+}
+
+// writeHash writes the inputs to `hasher` in a stable order that doesn't
+// depend on where the packages are checked out.
+func (mi moduleInputs) writeHash(hasher hash.Hash) {
+	inputs := make([]moduleInput, 0, len(mi))
+	for _, input := range mi {
+		inputs = append(inputs, input)
+	}
+	sort.Slice(inputs, func(i, j int) bool {
+		if inputs[i].relPath != inputs[j].relPath {
+			return inputs[i].relPath < inputs[j].relPath
+		}
+		return bytes.Compare(inputs[i].hash[:], inputs[j].hash[:]) < 0
+	})
+	for _, input := range inputs {
+		writeLengthPrefixed(hasher, []byte(input.relPath))
+		hasher.Write(input.hash[:])
+	}
+}
+
+// recordInput records that the module being evaluated by the thread read
+// `data` from the file at `path`.
+func recordInput(th *starlark.Thread, path string, data []byte) {
+	mi, ok := th.Local(moduleInputsLocal).(moduleInputs)
+	if !ok {
+		return
+	}
+	root, _ := th.Local(packageRootLocal).(string)
+	relPath, err := filepath.Rel(root, path)
+	if err != nil {
+		relPath = path
+	}
+	mi[path] = moduleInput{
+		relPath: filepath.ToSlash(relPath),
+		hash:    sha256.Sum256(data),
+	}
+}
+
+// writeLengthPrefixed writes the length of `data` followed by `data` so that
+// consecutive variable-length fields can't run into each other.
+func writeLengthPrefixed(hasher hash.Hash, data []byte) {
+	var length [8]byte
+	binary.BigEndian.PutUint64(length[:], uint64(len(data)))
+	hasher.Write(length[:])
+	hasher.Write(data)
+}
+
+// threadBuiltinWrapper is like `builtinWrapper` except the wrapped function
+// also receives the calling thread.
+func threadBuiltinWrapper(
+	name string,
+	f func(
+		*starlark.Thread,
+		starlark.Tuple,
+		[]starlark.Tuple,
+	) (starlark.Value, error),
+) *starlark.Builtin {
+	return starlark.NewBuiltin(
+		name,
+		func(
+			th *starlark.Thread,
+			builtin *starlark.Builtin,
+			args starlark.Tuple,
+			kwargs []starlark.Tuple,
+		) (starlark.Value, error) {
+			v, err := f(th, args, kwargs)
+			if err != nil {
+				return nil, errors.Wrapf(err, "%s()", builtin.Name())
+			}
+			return v, nil
+		},
+	)
+}
+
+// resolvePackagePath resolves a package-relative path from Starlark into a
+// file system path, applying the same protections against escaping the
+// package root as `resolveModule`.
+func resolvePackagePath(th *starlark.Thread, relPath string) (string, error) {
+	root, ok := th.Local(packageRootLocal).(string)
+	if !ok {
+		return "", errors.Errorf("Not called from within a package module")
+	}
+	if filepath.IsAbs(relPath) || strings.Contains(relPath, "..") {
+		return "", errors.Errorf(
+			"Path '%s' must be relative to the package root",
+			relPath,
+		)
+	}
+	return filepath.Join(root, relPath), nil
+}
+
+// unpackPathArg unpacks the single `path` argument that all of the file
+// builtins accept.
+func unpackPathArg(
+	th *starlark.Thread,
+	name string,
+	args starlark.Tuple,
+	kwargs []starlark.Tuple,
+	defaultPath string,
+) (string, error) {
+	relPath := defaultPath
+	if err := starlark.UnpackArgs(
+		name,
+		args,
+		kwargs,
+		"path?",
+		&relPath,
+	); err != nil {
+		return "", err
+	}
+	return resolvePackagePath(th, relPath)
+}
+
+// starlarkReadFile implements the `read_file(path)` builtin, which returns
+// the contents of a file in the package as a string.
+func starlarkReadFile(
+	th *starlark.Thread,
+	args starlark.Tuple,
+	kwargs []starlark.Tuple,
+) (starlark.Value, error) {
+	path, err := unpackPathArg(th, "read_file", args, kwargs, "")
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	recordInput(th, path, data)
+	return starlark.String(data), nil
+}
+
+// starlarkListDir implements the `list_dir(path=".")` builtin, which returns
+// the sorted names of the entries in a package directory. Directory names
+// have a trailing slash.
+func starlarkListDir(
+	th *starlark.Thread,
+	args starlark.Tuple,
+	kwargs []starlark.Tuple,
+) (starlark.Value, error) {
+	path, err := unpackPathArg(th, "list_dir", args, kwargs, ".")
+	if err != nil {
+		return nil, err
+	}
+	fileInfos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]starlark.Value, len(fileInfos))
+	var listing bytes.Buffer
+	for i, fi := range fileInfos {
+		name := fi.Name()
+		if fi.IsDir() {
+			name += "/"
+		}
+		names[i] = starlark.String(name)
+		listing.WriteString(name)
+		listing.WriteByte(0)
+	}
+	recordInput(th, path, listing.Bytes())
+	return starlark.NewList(names), nil
+}
+
+// starlarkExists implements the `exists(path)` builtin.
+func starlarkExists(
+	th *starlark.Thread,
+	args starlark.Tuple,
+	kwargs []starlark.Tuple,
+) (starlark.Value, error) {
+	path, err := unpackPathArg(th, "exists", args, kwargs, "")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			recordInput(th, path, []byte("missing"))
+			return starlark.False, nil
+		}
+		return nil, err
+	}
+	recordInput(th, path, []byte("exists"))
+	return starlark.True, nil
+}
@@ -1,29 +1,66 @@
 package main
 
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 
 	"github.com/pkg/errors"
 )
 
-func FileSystemCacheFromTempDir(root string) (*FileSystemCache, error) {
-	tmpDir, err := ioutil.TempDir("", "")
+// FileSystemCache stores cache entries in a directory. The contents of the
+// files in directory and file entries are stored once per distinct content
+// (and permissions) in a blob store, `blobs/<hash[:2]>/<hash>-<perm>`, where
+// `hash` is the hex-encoded hash of the contents computed by `newHasher()`.
+// The entries' files are hard links to their blobs (or copies of them, if a
+// blob can't be linked). Temporary artifacts are built in `tmp/` so that they
+// are on the same file system as the blobs and the entries.
+//
+// Since an entry's files share their blobs with every other entry that has a
+// file with the same contents, blobs are read-only so that builders can't
+// modify their inputs.
+func FileSystemCacheFromTempDir(
+	root string,
+	newHasher func() hash.Hash,
+) (*FileSystemCache, error) {
+	tmpBase := filepath.Join(root, cacheTmpDirName)
+	if err := os.MkdirAll(tmpBase, 0755); err != nil {
+		return nil, err
+	}
+	tmpDir, err := ioutil.TempDir(tmpBase, "")
 	return &FileSystemCache{
-		root:   root,
-		tmpDir: tmpDir,
+		root:      root,
+		tmpDir:    tmpDir,
+		newHasher: newHasher,
 	}, err
 }
 
+const (
+	cacheBlobDirName = "blobs"
+	cacheTmpDirName  = "tmp"
+)
+
 type FileSystemCache struct {
-	root   string
-	tmpDir string
+	root      string
+	tmpDir    string
+	newHasher func() hash.Hash
+}
+
+// Close removes the cache's temporary directory.
+func (fsc *FileSystemCache) Close() error {
+	return os.RemoveAll(fsc.tmpDir)
 }
 
 func (fsc *FileSystemCache) NewDirEntry(
@@ -35,60 +72,107 @@ func (fsc *FileSystemCache) NewDirEntry(
 			if err := os.MkdirAll(tmpDirPath, 0744); err != nil {
 				return err
 			}
-			return cacheDirCallback(
-				func(relpath string, callback CacheFileCallback) error {
-					filePath := filepath.Join(tmpDirPath, relpath)
-					if err := os.MkdirAll(
-						filepath.Dir(filePath),
-						0744,
-					); err != nil {
-						return err
-					}
-					file, err := os.Create(filePath)
-					if err != nil {
-						return err
-					}
-					defer properClose(file)
-					mode, err := callback(file)
-					if err != nil {
-						return err
-					}
-					return errors.Wrapf(
-						file.Chmod(mode),
-						"chmod-ing file '%s' with permissions %s",
-						filePath,
-						mode.String(),
-					)
-				},
-			)
+			dir := fsCacheDir{
+				fsc:   fsc,
+				root:  tmpDirPath,
+				modes: map[string]os.FileMode{},
+			}
+			if err := cacheDirCallback(&dir); err != nil {
+				return err
+			}
+			return dir.applyModes()
 		},
 		nameCallback,
 	)
 }
 
+// fsCacheDir implements `CacheDir` for a temporary directory artifact.
+type fsCacheDir struct {
+	fsc  *FileSystemCache
+	root string
+
+	// modes holds the permissions of the directories added with `Dir()`.
+	// They're applied once the directory is complete since a read-only
+	// directory can't be populated.
+	lock  sync.Mutex
+	modes map[string]os.FileMode
+}
+
+// path returns the path of `relpath` in the directory, creating its parent
+// directories if necessary.
+func (dir *fsCacheDir) path(relpath string) (string, error) {
+	path := filepath.Join(dir.root, relpath)
+	return path, os.MkdirAll(filepath.Dir(path), 0744)
+}
+
+// File implements the CacheDir.File() method.
+func (dir *fsCacheDir) File(
+	relpath string,
+	hash []byte,
+	callback CacheFileCallback,
+) error {
+	path, err := dir.path(relpath)
+	if err != nil {
+		return err
+	}
+	blobPath, err := dir.fsc.writeBlob(hash, callback)
+	if err != nil {
+		return err
+	}
+	return linkBlob(blobPath, path)
+}
+
+// Symlink implements the CacheDir.Symlink() method.
+func (dir *fsCacheDir) Symlink(relpath string, target string) error {
+	path, err := dir.path(relpath)
+	if err != nil {
+		return err
+	}
+	return os.Symlink(target, path)
+}
+
+// Dir implements the CacheDir.Dir() method.
+func (dir *fsCacheDir) Dir(relpath string, mode os.FileMode) error {
+	path, err := dir.path(relpath)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path, 0744); err != nil {
+		return err
+	}
+	dir.lock.Lock()
+	defer dir.lock.Unlock()
+	dir.modes[path] = mode.Perm()
+	return nil
+}
+
+// applyModes sets the permissions of the directories added with `Dir()`,
+// children before their parents.
+func (dir *fsCacheDir) applyModes() error {
+	paths := make([]string, 0, len(dir.modes))
+	for path := range dir.modes {
+		paths = append(paths, path)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(paths)))
+	for _, path := range paths {
+		if err := os.Chmod(path, dir.modes[path]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (fsc *FileSystemCache) NewFileEntry(
 	cacheFileCallback CacheFileCallback,
 	nameCallback NameCallback,
 ) error {
 	return fsc.withTmpArtifact(
 		func(tmpPath string) error {
-			file, err := os.Create(tmpPath)
-			if err != nil {
-				return err
-			}
-			defer properClose(file)
-
-			mode, err := cacheFileCallback(file)
+			blobPath, err := fsc.writeBlob(nil, cacheFileCallback)
 			if err != nil {
 				return err
 			}
-
-			return errors.Wrapf(
-				file.Chmod(mode),
-				"chmod-ing file '%s' with permissions %s",
-				tmpPath,
-				mode.String(),
-			)
+			return linkBlob(blobPath, tmpPath)
 		},
 		nameCallback,
 	)
@@ -171,13 +255,89 @@ func (fsc *FileSystemCache) Exists(cachePath string) (bool, error) {
 
 func (fsc *FileSystemCache) Root() string { return fsc.root }
 
+// WriteDerivationRecord writes the record of `d` (see `derivationRecord`) next
+// to its output unless the cache already has one. The record is written to a
+// temporary file and renamed into place so that it's never partially written.
+func (fsc *FileSystemCache) WriteDerivationRecord(d *Derivation) error {
+	path := filepath.Join(fsc.root, d.ID+derivationRecordExt)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	data, err := json.MarshalIndent(newDerivationRecord(d), "", "    ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(fsc.tmpDir, "drv-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		properClose(tmp)
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// DerivationRecord reads the record of the derivation whose ID is `id`. It
+// returns nil if the cache has no record of the derivation (e.g., because
+// `id` names a source snapshot).
+func (fsc *FileSystemCache) DerivationRecord(
+	id string,
+) (*derivationRecord, error) {
+	path := filepath.Join(fsc.root, id+derivationRecordExt)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var record derivationRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, errors.Wrapf(err, "Parsing the record of '%s'", id)
+	}
+	return &record, nil
+}
+
+// Resolve returns the names of the entries whose names start with `prefix`,
+// in order. Derivations can thus be looked up by a prefix of their IDs.
+func (fsc *FileSystemCache) Resolve(prefix string) ([]string, error) {
+	fileInfos, err := ioutil.ReadDir(fsc.root)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, fi := range fileInfos {
+		name := fi.Name()
+		if cacheBookkeeping(name) || isDerivationRecord(name) {
+			continue
+		}
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
 func (fsc *FileSystemCache) withTmpArtifact(
 	artifactCallback func(string) error,
 	nameCallback NameCallback,
 ) error {
 	tmpPath := filepath.Join(fsc.tmpDir, randString())
 	if err := artifactCallback(tmpPath); err != nil {
-		if err := os.RemoveAll(tmpPath); err != nil {
+		if err := removeArtifact(tmpPath); err != nil {
 			log.Printf(
 				"WARN failed to remove temporary artifact '%s': %v",
 				tmpPath,
@@ -187,25 +347,167 @@ func (fsc *FileSystemCache) withTmpArtifact(
 		return err
 	}
 
-	// commit artifact to cache
-	cachePath := filepath.Join(fsc.root, nameCallback())
-	parentDir := filepath.Dir(cachePath)
-	if err := os.MkdirAll(parentDir, 0744); err != nil {
-		return errors.Wrapf(err, "Creating parent directory %s", parentDir)
+	// Commit the artifact to the cache. Entries are content-addressed, so if
+	// the entry already exists (e.g., because another build committed it
+	// first), it already has the artifact's contents; discard the temporary
+	// artifact rather than replacing an entry that may be in use.
+	name := nameCallback()
+	cachePath := filepath.Join(fsc.root, name)
+	exists, err := fsc.Exists(name)
+	if err != nil {
+		return err
 	}
-	if err := os.Rename(tmpPath, cachePath); err != nil {
-		if os.IsExist(err) {
-			if err := os.RemoveAll(cachePath); err != nil {
+	if !exists {
+		parentDir := filepath.Dir(cachePath)
+		if err := os.MkdirAll(parentDir, 0744); err != nil {
+			return errors.Wrapf(err, "Creating parent directory %s", parentDir)
+		}
+		err := os.Rename(tmpPath, cachePath)
+		if err == nil {
+			return nil
+		}
+
+		// Renaming a directory onto an existing one fails, in which case
+		// another build won the race to commit the entry.
+		if exists, _ = fsc.Exists(name); !exists {
+			return err
+		}
+	}
+	return errors.Wrapf(
+		removeArtifact(tmpPath),
+		"Removing temporary artifact '%s'",
+		tmpPath,
+	)
+}
+
+// removeArtifact removes a temporary artifact. Snapshots can contain
+// read-only directories, whose contents can't be removed until they're made
+// writable.
+func removeArtifact(path string) error {
+	if err := filepath.Walk(
+		path,
+		func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
 				return err
 			}
-			if err := os.Rename(tmpPath, cachePath); err != nil {
-				return err
+			if fi.IsDir() && fi.Mode().Perm()&0200 == 0 {
+				return os.Chmod(path, fi.Mode().Perm()|0700)
 			}
-		} else {
-			return err
+			return nil
+		},
+	); err != nil {
+		return err
+	}
+	return os.RemoveAll(path)
+}
+
+// writeBlob writes a file's contents to the blob store and returns the path
+// of its blob. If the store already has a blob with the same contents and
+// permissions, the new copy is discarded. If `wanted` isn't nil, contents
+// whose hash isn't `wanted` are rejected with a `contentHashMismatchErr`.
+func (fsc *FileSystemCache) writeBlob(
+	wanted []byte,
+	callback CacheFileCallback,
+) (string, error) {
+	tmp, err := ioutil.TempFile(fsc.tmpDir, "blob-")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := os.Remove(tmp.Name()); err != nil && !os.IsNotExist(err) {
+			log.Printf(
+				"WARN failed to remove temporary blob '%s': %v",
+				tmp.Name(),
+				err,
+			)
 		}
+	}()
+
+	hasher := fsc.newHasher()
+	mode, err := callback(io.MultiWriter(tmp, hasher))
+	if err != nil {
+		properClose(tmp)
+		return "", err
 	}
-	return nil
+
+	// Blobs are shared by every entry with the same file, so they're made
+	// read-only: a builder which tries to modify an input fails instead of
+	// corrupting other entries.
+	mode &^= 0222
+	if err := tmp.Chmod(mode); err != nil {
+		properClose(tmp)
+		return "", errors.Wrapf(
+			err,
+			"chmod-ing file '%s' with permissions %s",
+			tmp.Name(),
+			mode.String(),
+		)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+
+	hash := hasher.Sum(nil)
+	if wanted != nil && !bytes.Equal(hash, wanted) {
+		return "", contentHashMismatchErr{wanted: wanted, got: hash}
+	}
+	sum := hex.EncodeToString(hash)
+	blobPath := filepath.Join(
+		fsc.root,
+		cacheBlobDirName,
+		sum[:2],
+		fmt.Sprintf("%s-%04o", sum, mode.Perm()),
+	)
+	if err := os.MkdirAll(filepath.Dir(blobPath), 0755); err != nil {
+		return "", err
+	}
+
+	// Linking (unlike renaming) never replaces an existing blob, which may
+	// already be linked into other entries.
+	if err := os.Link(tmp.Name(), blobPath); err != nil {
+		if _, statErr := os.Stat(blobPath); statErr != nil {
+			return "", errors.Wrapf(err, "Storing blob '%s'", blobPath)
+		}
+	}
+	return blobPath, nil
+}
+
+// linkBlob materializes a blob at `path` as a hard link. If the blob can't be
+// linked (e.g., because it has too many links already), it is copied.
+func linkBlob(blobPath string, path string) error {
+	if err := os.Link(blobPath, path); err == nil {
+		return nil
+	}
+
+	src, err := os.Open(blobPath)
+	if err != nil {
+		return err
+	}
+	defer properClose(src)
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	dst, err := os.OpenFile(
+		path,
+		os.O_WRONLY|os.O_CREATE|os.O_EXCL,
+		fi.Mode().Perm(),
+	)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		properClose(dst)
+		return errors.Wrapf(err, "Copying blob '%s'", blobPath)
+	}
+	if err := dst.Chmod(fi.Mode()); err != nil {
+		properClose(dst)
+		return err
+	}
+	return dst.Close()
 }
 
 func randString() string {
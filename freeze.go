@@ -1,36 +1,79 @@
 package main
 
 import (
-	"encoding/hex"
+	"bytes"
+	"encoding/base32"
 	"fmt"
 	"hash"
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strings"
+	"sync"
 
 	"github.com/bmatcuk/doublestar"
 	"github.com/pkg/errors"
 )
 
+// FreezeTarget freezes a target into a derivation whose ID is a hash computed
+// with `algorithm`. `fileHashes` caches the hashes of source files between
+// builds (it may be nil). `toolchains` maps
+// toolchain types to the toolchains that `toolchain()` references resolve to
+// and `settings` holds the build settings that `setting()` and `select()`
+// values resolve against.
 func FreezeTarget(
 	packageRoot string,
-	newHasher func() hash.Hash,
+	algorithm hashAlgorithm,
 	cache Cache,
+	fileHashes *fileHashCache,
+	toolchains map[string]Arg,
+	settings map[string]string,
 	t *Target,
 ) (*Derivation, error) {
-	d, _, err := freezeTarget(&freezer{packageRoot, newHasher, cache}, t)
+	d, _, err := freezeTarget(
+		&freezer{
+			packageRoot: packageRoot,
+			algorithm:   algorithm.Name,
+			newHasher:   algorithm.New,
+			cache:       cache,
+			fileHashes:  fileHashes,
+			toolchains:  toolchains,
+			settings:    settings,
+		},
+		t,
+	)
 	return d, err
 }
 
 type freezer struct {
 	packageRoot string
+	algorithm   string
 	newHasher   func() hash.Hash
 	cache       Cache
+	fileHashes  *fileHashCache
+	toolchains  map[string]Arg
+	settings    map[string]string
+
+	// consumer is the target whose args are being frozen. Its dependencies
+	// must be visible to it.
+	consumer *Target
+
+	// hostTools memoizes frozen host tools so that each tool is only hashed
+	// and probed once per freeze.
+	hostTools map[string]ArgValue
 }
 
 func freezeTarget(f *freezer, t *Target) (*Derivation, []byte, error) {
+	// Targets created by Go code (which have no module) are frozen on behalf
+	// of the target that contains them.
+	if t.Module != nil {
+		consumer := f.consumer
+		f.consumer = t
+		defer func() { f.consumer = consumer }()
+	}
+
 	hasher := f.newHasher()
 	hasher.Write([]byte(t.Name))
 	hasher.Write([]byte(t.Builder))
@@ -38,6 +81,7 @@ func freezeTarget(f *freezer, t *Target) (*Derivation, []byte, error) {
 	for _, envVar := range t.Env {
 		hasher.Write([]byte(envVar))
 	}
+	t.Inputs.writeHash(hasher)
 
 	var dependencies []*Derivation
 	frozenArgs := make([]string, len(t.Args))
@@ -58,16 +102,58 @@ func freezeTarget(f *freezer, t *Target) (*Derivation, []byte, error) {
 	}
 
 	hash := hasher.Sum(nil)
+
+	// A fixed-output target's identity is its output, so its hash depends
+	// only on its name and the expected output hash. The args are still
+	// frozen above so that the target's dependencies are built first.
+	if t.OutputHash != "" {
+		hasher = f.newHasher()
+		hasher.Write([]byte(t.Name))
+		hasher.Write([]byte(t.OutputHash))
+		hash = hasher.Sum(nil)
+	}
+
 	return &Derivation{
-		ID:           fmt.Sprintf("%s-%s", hex.EncodeToString(hash), t.Name),
-		Dependencies: dependencies,
-		Builder:      t.Builder,
-		Args:         frozenArgs,
-		Env:          t.Env,
+		ID:            derivationID(hash, t.Name),
+		Hash:          hash,
+		HashAlgorithm: f.algorithm,
+		Dependencies:  dependencies,
+		Builder:       t.Builder,
+		Args:          frozenArgs,
+		Env:           t.Env,
+		OutputHash:    t.OutputHash,
 	}, hash, nil
 }
 
+// derivationID returns the ID of the derivation with the given hash and name.
+func derivationID(hash []byte, name string) string {
+	return fmt.Sprintf("%s-%s", encodeHash(hash), name)
+}
+
+// idHashSize is the number of bytes of a hash which identify a derivation or
+// a source snapshot in the cache. 160 bits are plenty to avoid collisions and
+// encode to 32 characters.
+const idHashSize = 20
+
+// idEncoding is the base32 alphabet of encoded hashes. Like Nix's, it omits
+// 'e', 'o', 't' and 'u' so that IDs are unlikely to contain words.
+var idEncoding = base32.NewEncoding(
+	"0123456789abcdfghijklmnpqrsvwxyz",
+).WithPadding(base32.NoPadding)
+
+// encodeHash encodes the first `idHashSize` bytes of a hash for use in cache
+// paths. The full hash is kept in the derivation's `Hash`.
+func encodeHash(hash []byte) string {
+	if len(hash) > idHashSize {
+		hash = hash[:idHashSize]
+	}
+	return idEncoding.EncodeToString(hash)
+}
+
 func (t *Target) freezeArg(f *freezer) (ArgValue, error) {
+	if err := checkVisibility(f.consumer, t); err != nil {
+		return ArgValue{}, err
+	}
 	d, hash, err := freezeTarget(f, t)
 	if err != nil {
 		return ArgValue{}, err
@@ -86,21 +172,50 @@ func (s String) freezeArg(f *freezer) (ArgValue, error) {
 }
 
 func (p Path) freezeArg(f *freezer) (ArgValue, error) {
+	// Like the files in glob groups, the file's contents are only read if
+	// the file hash cache doesn't have an up-to-date hash for them.
+	path := filepath.Join(f.packageRoot, string(p))
+	fi, err := os.Stat(path)
+	if err != nil {
+		return ArgValue{}, err
+	}
+	contentHash, err := f.fileHashes.hashFileContents(path, fi, f.newHasher)
+	if err != nil {
+		return ArgValue{}, err
+	}
+
+	// The path's hash covers its path, permission bits and content hash.
 	hasher := f.newHasher()
-	cachePath := func() string {
-		return filepath.Join(hex.EncodeToString(hasher.Sum(nil)), string(p))
+	hasher.Write([]byte(p))
+	hasher.Write(permissionBits(fi.Mode()))
+	hasher.Write(contentHash)
+	hash := hasher.Sum(nil)
+	name := filepath.Join(encodeHash(hash), string(p))
+
+	// If the cache already has a snapshot of the file, there's nothing to
+	// copy.
+	exists, err := f.cache.Exists(name)
+	if err != nil {
+		return ArgValue{}, errors.Wrapf(err, "Checking cache for '%s'", name)
+	}
+	if exists {
+		return ArgValue{Value: name, Hash: hash}, nil
 	}
 	if err := f.cache.NewFileEntry(
-		hashFile(f.packageRoot, string(p), hasher),
-		cachePath,
+		copyHashedFile(path, fi.Mode(), contentHash, f.newHasher),
+		func() string { return name },
 	); err != nil {
+		if _, ok := errors.Cause(err).(contentHashMismatchErr); ok {
+			f.fileHashes.forget(path)
+			return ArgValue{}, errors.Wrapf(
+				err,
+				"File '%s' changed while it was being snapshotted",
+				p,
+			)
+		}
 		return ArgValue{}, err
 	}
-	return ArgValue{
-		Value:       cachePath(),
-		Hash:        hasher.Sum(nil),
-		Derivations: nil,
-	}, nil
+	return ArgValue{Value: name, Hash: hash, Derivations: nil}, nil
 }
 
 func (gg GlobGroup) freezeArg(f *freezer) (ArgValue, error) {
@@ -110,51 +225,264 @@ func (gg GlobGroup) freezeArg(f *freezer) (ArgValue, error) {
 		return ArgValue{}, err
 	}
 
-	// Hash the paths
+	// Hash the files concurrently. Regular files whose hashes are in the file
+	// hash cache aren't read at all.
+	files := make([]sourceFile, len(paths))
+	if err := parallelDo(len(paths), func(i int) error {
+		file, err := hashSourceFile(f, paths[i])
+		files[i] = file
+		return err
+	}); err != nil {
+		return ArgValue{}, err
+	}
+
+	// The group's hash covers each file's type, path, permission bits and
+	// content hash or link target (in path order).
 	hasher := f.newHasher()
-	if err := f.cache.NewDirEntry(
-		func(registerFile CacheDir) error {
-			for _, path := range paths {
-				relPath, err := filepath.Rel(f.packageRoot, path)
-				if err != nil {
-					return err
-				}
+	for _, file := range files {
+		file.writeHash(hasher)
+	}
+	hash := hasher.Sum(nil)
+	name := encodeHash(hash)
 
-				if err := registerFile(
-					relPath,
-					hashFile(f.packageRoot, relPath, hasher),
-				); err != nil {
-					return err
-				}
-			}
-			return nil
+	// If the cache already has a snapshot of the files, there's nothing to
+	// copy. Otherwise, copy the files into the cache concurrently.
+	exists, err := f.cache.Exists(name)
+	if err != nil {
+		return ArgValue{}, errors.Wrapf(err, "Checking cache for '%s'", name)
+	}
+	if exists {
+		return ArgValue{Value: name, Hash: hash}, nil
+	}
+	if err := f.cache.NewDirEntry(
+		func(dir CacheDir) error {
+			return parallelDo(len(files), func(i int) error {
+				return files[i].copy(f, dir)
+			})
 		},
-		func() string { return hex.EncodeToString(hasher.Sum(nil)) },
+		func() string { return name },
 	); err != nil {
 		return ArgValue{}, err
 	}
-	return ArgValue{
-		Value:       hex.EncodeToString(hasher.Sum(nil)),
-		Hash:        hasher.Sum(nil),
-		Derivations: nil,
-	}, nil
+	return ArgValue{Value: name, Hash: hash, Derivations: nil}, nil
+}
+
+// sourceFile is a file in a glob group. Snapshots reproduce the files that
+// they match: regular files are copied, symlinks are preserved as links (and
+// never followed, so links may dangle or point outside of the package) and
+// directories are preserved, even if they're empty. Other types of files
+// (devices, pipes and sockets) aren't supported.
+type sourceFile struct {
+	relPath string
+	mode    os.FileMode
+
+	// hash is the hash of a regular file's contents.
+	hash []byte
+
+	// target is a symlink's target.
+	target string
+}
+
+// hashSourceFile hashes the contents of the regular file or reads the
+// symlink at `path` (consulting the file hash cache).
+func hashSourceFile(f *freezer, path string) (sourceFile, error) {
+	relPath, err := filepath.Rel(f.packageRoot, path)
+	if err != nil {
+		return sourceFile{}, err
+	}
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return sourceFile{}, err
+	}
+	file := sourceFile{relPath: relPath, mode: fi.Mode()}
+	switch {
+	case fi.Mode().IsRegular():
+		file.hash, err = f.fileHashes.hashFileContents(path, fi, f.newHasher)
+	case fi.Mode()&os.ModeSymlink != 0:
+		file.target, err = os.Readlink(path)
+	case fi.IsDir():
+	default:
+		err = errors.Errorf(
+			"Unsupported file type '%s' (only regular files, directories "+
+				"and symlinks can be snapshotted)",
+			fi.Mode()&os.ModeType,
+		)
+	}
+	return file, errors.Wrapf(err, "File '%s'", relPath)
+}
+
+// writeHash writes the file's type, path, permission bits and content hash or
+// link target to `hasher`. The type tag keeps (e.g.) a symlink from hashing
+// the same as a file whose contents are the link's target, and the path and
+// target are length-prefixed so that one file's fields can't run into the
+// next file's.
+func (file sourceFile) writeHash(hasher hash.Hash) {
+	switch {
+	case file.mode.IsRegular():
+		hasher.Write([]byte{'f'})
+	case file.mode&os.ModeSymlink != 0:
+		hasher.Write([]byte{'l'})
+	default:
+		hasher.Write([]byte{'d'})
+	}
+	writeLengthPrefixed(hasher, []byte(file.relPath))
+	hasher.Write(permissionBits(file.mode))
+	hasher.Write(file.hash)
+	writeLengthPrefixed(hasher, []byte(file.target))
+}
+
+// copy adds the file to a cache directory entry. A regular file must still
+// have the contents that it was hashed with so that the snapshot matches its
+// name.
+func (file sourceFile) copy(f *freezer, dir CacheDir) error {
+	switch {
+	case file.mode.IsRegular():
+		err := dir.File(
+			file.relPath,
+			file.hash,
+			copySourceFile(f.packageRoot, file.relPath),
+		)
+		if _, ok := errors.Cause(err).(contentHashMismatchErr); ok {
+			// The file changed after it was hashed, or its cached hash was
+			// stale. Either way, it must be hashed again next time.
+			f.fileHashes.forget(filepath.Join(f.packageRoot, file.relPath))
+			return errors.Wrapf(
+				err,
+				"File '%s' changed while it was being snapshotted",
+				file.relPath,
+			)
+		}
+		return err
+	case file.mode&os.ModeSymlink != 0:
+		return dir.Symlink(file.relPath, file.target)
+	default:
+		return dir.Dir(file.relPath, file.mode)
+	}
+}
+
+// permissionBits encodes the owner, group and other permission bits of a
+// file mode for hashing.
+func permissionBits(mode os.FileMode) []byte {
+	return []byte{
+		byte(mode >> 6 & 0o007),
+		byte(mode >> 3 & 0o007),
+		byte(mode & 0o007),
+	}
+}
+
+// copySourceFile copies a file into the cache without hashing it.
+func copySourceFile(root, relPath string) CacheFileCallback {
+	return func(w io.Writer) (os.FileMode, error) {
+		f, err := os.Open(filepath.Join(root, relPath))
+		if err != nil {
+			return 0, err
+		}
+		defer properClose(f)
+
+		fi, err := f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		_, err = io.Copy(w, f)
+		return fi.Mode(), err
+	}
+}
+
+// parallelDo calls `f` for each index in `[0, n)` on up to one goroutine per
+// CPU. If any calls fail, it returns the error for the lowest index.
+func parallelDo(n int, f func(int) error) error {
+	workers := runtime.NumCPU()
+	if workers > n {
+		workers = n
+	}
+	errs := make([]error, n)
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				errs[i] = f(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (gg GlobGroup) matches(packageRoot string) ([]string, error) {
+	var ignore *ignoreMatcher
+	if gg.IgnoreFiles {
+		ignore = newIgnoreMatcher(packageRoot)
+	}
+
 	// Create a set of globs so we know we aren't looking up any glob multiple
-	// times in the event that there are duplicate globs.
-	seen := map[string]struct{}{}
+	// times in the event that there are duplicate globs, and a set of paths so
+	// that files matched by more than one glob are only included once.
+	seenGlobs := map[string]struct{}{}
+	seenPaths := map[string]struct{}{}
 	paths := make([]string, 0, 64)
-	for _, glob := range gg {
-		if _, found := seen[glob]; found {
+	for _, glob := range gg.Patterns {
+		if _, found := seenGlobs[glob]; found {
 			continue
 		}
-		matches, err := doublestar.Glob(filepath.Join(packageRoot, glob))
+		seenGlobs[glob] = struct{}{}
+
+		matches, err := doublestar.GlobOS(
+			noFollowOS{root: packageRoot},
+			filepath.Join(packageRoot, glob),
+		)
 		if err != nil {
 			return nil, errors.Wrapf(err, "Matching pattern '%s'", glob)
 		}
-		paths = append(paths, matches...)
-		seen[glob] = struct{}{}
+		if len(matches) < 1 {
+			return nil, errors.Errorf("Pattern '%s' matched no files", glob)
+		}
+
+		included := 0
+		for _, match := range matches {
+			relPath, err := filepath.Rel(packageRoot, match)
+			if err != nil {
+				return nil, err
+			}
+
+			excluded, err := gg.excluded(relPath)
+			if err != nil {
+				return nil, err
+			}
+			if !excluded && ignore != nil {
+				if excluded, err = ignore.ignored(relPath); err != nil {
+					return nil, err
+				}
+			}
+			if excluded {
+				continue
+			}
+
+			included++
+			if _, found := seenPaths[match]; found {
+				continue
+			}
+			seenPaths[match] = struct{}{}
+			paths = append(paths, match)
+		}
+		if included < 1 {
+			return nil, errors.Errorf(
+				"Pattern '%s' matched no files after exclusions",
+				glob,
+			)
+		}
 	}
 
 	// Sort the paths so they're always in the same order for stable hashing.
@@ -163,29 +491,79 @@ func (gg GlobGroup) matches(packageRoot string) ([]string, error) {
 	return paths, nil
 }
 
-func hashFile(root, relPath string, hasher hash.Hash) CacheFileCallback {
+// noFollowOS is a `doublestar.OS` which doesn't follow symlinks inside of
+// the package root (so patterns match symlinks, even dangling ones, rather
+// than their targets). Snapshots preserve symlinks rather than following them.
+type noFollowOS struct {
+	root string
+}
+
+func (nfo noFollowOS) Lstat(name string) (os.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+func (nfo noFollowOS) Open(name string) (*os.File, error) {
+	return os.Open(name)
+}
+
+func (nfo noFollowOS) PathSeparator() rune { return os.PathSeparator }
+
+func (nfo noFollowOS) Stat(name string) (os.FileInfo, error) {
+	if rel, err := filepath.Rel(nfo.root, name); err == nil &&
+		rel != "." &&
+		rel != ".." &&
+		!strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return os.Lstat(name)
+	}
+	return os.Stat(name)
+}
+
+// excluded returns true if `relPath` or any of its parent directories match
+// one of the glob group's exclude patterns.
+func (gg GlobGroup) excluded(relPath string) (bool, error) {
+	for _, pattern := range gg.Exclude {
+		for p := relPath; p != "." && p != "/"; p = filepath.Dir(p) {
+			matched, err := doublestar.Match(pattern, p)
+			if err != nil {
+				return false, errors.Wrapf(
+					err,
+					"Matching exclude pattern '%s'",
+					pattern,
+				)
+			}
+			if matched {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// copyHashedFile copies the file at `path` into the cache with the
+// permissions `mode` that it was hashed with. It fails with a
+// `contentHashMismatchErr` if the file's contents no longer have the hash
+// `wanted`, since the snapshot's name is derived from it.
+func copyHashedFile(
+	path string,
+	mode os.FileMode,
+	wanted []byte,
+	newHasher func() hash.Hash,
+) CacheFileCallback {
 	return func(w io.Writer) (os.FileMode, error) {
-		f, err := os.Open(filepath.Join(root, relPath))
+		f, err := os.Open(path)
 		if err != nil {
 			return 0, err
 		}
 		defer properClose(f)
 
-		fi, err := f.Stat()
-		if err != nil {
+		hasher := newHasher()
+		if _, err := io.Copy(io.MultiWriter(w, hasher), f); err != nil {
 			return 0, err
 		}
-		mode := fi.Mode()
-
-		hasher.Write([]byte(relPath))
-		hasher.Write([]byte{
-			byte(mode >> 6 & 0o007),
-			byte(mode >> 3 & 0o007),
-			byte(mode & 0o007),
-		})
-
-		_, err = io.Copy(w, &HashingReader{Reader: f, Hasher: hasher})
-		return fi.Mode(), err
+		if got := hasher.Sum(nil); !bytes.Equal(got, wanted) {
+			return 0, contentHashMismatchErr{wanted: wanted, got: got}
+		}
+		return mode, nil
 	}
 }
 
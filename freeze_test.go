@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"hash"
@@ -9,9 +10,12 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/pkg/errors"
+	"go.starlark.net/starlark"
 )
 
 type testHash struct {
@@ -56,21 +60,52 @@ func (tc *testCache) NewDirEntry(
 	cacheDirCallback CacheDirCallback,
 	nameCallback NameCallback,
 ) error {
-	files := map[string]*fileEntry{}
-	if err := cacheDirCallback(
-		func(relpath string, callback CacheFileCallback) error {
-			var buf bytes.Buffer
-			mode, err := callback(&buf)
-			if err != nil {
-				return err
-			}
-			files[relpath] = &fileEntry{mode: mode, buf: buf}
-			return nil
-		},
-	); err != nil {
+	dir := testCacheDir{files: map[string]*fileEntry{}}
+	if err := cacheDirCallback(&dir); err != nil {
 		return err
 	}
-	tc.entries[nameCallback()] = &dirEntry{files: files}
+	tc.entries[nameCallback()] = &dirEntry{files: dir.files}
+	return nil
+}
+
+// testCacheDir records a directory entry's files by path. Symlinks are
+// recorded with their targets as their contents and directories without
+// contents.
+type testCacheDir struct {
+	lock  sync.Mutex
+	files map[string]*fileEntry
+}
+
+func (dir *testCacheDir) add(relpath string, fe *fileEntry) {
+	dir.lock.Lock()
+	defer dir.lock.Unlock()
+	dir.files[relpath] = fe
+}
+
+func (dir *testCacheDir) File(
+	relpath string,
+	_ []byte,
+	callback CacheFileCallback,
+) error {
+	var fe fileEntry
+	mode, err := callback(&fe.buf)
+	if err != nil {
+		return err
+	}
+	fe.mode = mode
+	dir.add(relpath, &fe)
+	return nil
+}
+
+func (dir *testCacheDir) Symlink(relpath string, target string) error {
+	fe := fileEntry{mode: os.ModeSymlink | 0777}
+	fe.buf.WriteString(target)
+	dir.add(relpath, &fe)
+	return nil
+}
+
+func (dir *testCacheDir) Dir(relpath string, mode os.FileMode) error {
+	dir.add(relpath, &fileEntry{mode: os.ModeDir | mode.Perm()})
 	return nil
 }
 
@@ -87,8 +122,15 @@ func (tc *testCache) NewFileEntry(
 	return nil
 }
 
-func derivationID(hash, targetName string) string {
-	return fmt.Sprintf("%s-%s", hex.EncodeToString([]byte(hash)), targetName)
+func (tc *testCache) Exists(name string) (bool, error) {
+	_, found := tc.entries[name]
+	return found, nil
+}
+
+// testAlgorithm returns a hash algorithm whose hashers are made by
+// `newHasher`.
+func testAlgorithm(newHasher func() hash.Hash) hashAlgorithm {
+	return hashAlgorithm{Name: "test", New: newHasher}
 }
 
 func fmtList(ss []string) string {
@@ -197,7 +239,7 @@ func withTempDir(f func(string) error) error {
 }
 
 func cachePath(hash string, relpath string) string {
-	return filepath.Join(hex.EncodeToString([]byte(hash)), relpath)
+	return filepath.Join(encodeHash([]byte(hash)), relpath)
 }
 
 func TestFreezeTarget(t *testing.T) {
@@ -205,8 +247,11 @@ func TestFreezeTarget(t *testing.T) {
 
 	d, err := FreezeTarget(
 		"package-root",
-		func() hash.Hash { return &hasher },
+		testAlgorithm(func() hash.Hash { return &hasher }),
 		newTestCache(),
+		nil,
+		nil,
+		nil,
 		&Target{
 			Name:    "toplevel-target",
 			Builder: "toplevel-builder",
@@ -220,7 +265,7 @@ func TestFreezeTarget(t *testing.T) {
 
 	if err := expectDerivation(
 		&Derivation{
-			ID:           derivationID("hash", "toplevel-target"),
+			ID:           derivationID([]byte("hash"), "toplevel-target"),
 			Dependencies: nil,
 			Builder:      "toplevel-builder",
 			Args:         []string{"arg1", "arg2"},
@@ -251,12 +296,15 @@ func TestFreezeTarget_withDependencyArg(t *testing.T) {
 	h := &hasher
 	d, err := FreezeTarget(
 		"package-root",
-		func() hash.Hash {
+		testAlgorithm(func() hash.Hash {
 			tmp := h
 			h = &nestedHasher
 			return tmp
-		},
+		}),
 		newTestCache(),
+		nil,
+		nil,
+		nil,
 		&Target{
 			Name:    "toplevel-target",
 			Builder: "toplevel-builder",
@@ -274,12 +322,17 @@ func TestFreezeTarget_withDependencyArg(t *testing.T) {
 
 	if err := expectDerivation(
 		&Derivation{
-			ID:      derivationID("toplevel-hash", "toplevel-target"),
+			ID:      derivationID([]byte("toplevel-hash"), "toplevel-target"),
 			Builder: "toplevel-builder",
-			Args:    []string{derivationID("nested-hash", "nested-target")},
-			Env:     nil,
+			Args: []string{
+				derivationID([]byte("nested-hash"), "nested-target"),
+			},
+			Env: nil,
 			Dependencies: []*Derivation{{
-				ID:           derivationID("nested-hash", "nested-target"),
+				ID: derivationID(
+					[]byte("nested-hash"),
+					"nested-target",
+				),
 				Builder:      "nested-builder",
 				Args:         nil,
 				Env:          nil,
@@ -327,12 +380,15 @@ func TestFreezeTarget_withPathArg(t *testing.T) {
 
 		d, err := FreezeTarget(
 			packageRoot,
-			func() hash.Hash {
+			testAlgorithm(func() hash.Hash {
 				tmp := h
 				h = &argHasher
 				return tmp
-			},
+			}),
 			cache,
+			nil,
+			nil,
+			nil,
 			&Target{
 				Name:    "toplevel-target",
 				Builder: "toplevel-builder",
@@ -347,7 +403,7 @@ func TestFreezeTarget_withPathArg(t *testing.T) {
 
 	if err := expectDerivation(
 		&Derivation{
-			ID:      derivationID("toplevel-hash", "toplevel-target"),
+			ID:      derivationID([]byte("toplevel-hash"), "toplevel-target"),
 			Builder: "toplevel-builder",
 			Args:    []string{cachePath("arg-hash", "foo.yml")},
 			Env:     nil,
@@ -407,12 +463,15 @@ func TestFreezeTarget_OneDependency(t *testing.T) {
 	if err := withTempDir(func(packageRoot string) error {
 		d, err := FreezeTarget(
 			packageRoot,
-			func() hash.Hash {
+			testAlgorithm(func() hash.Hash {
 				tmp := h
 				h = &dependencyHasher
 				return tmp
-			},
+			}),
 			cache,
+			nil,
+			nil,
+			nil,
 			&toplevel,
 		)
 		got = d
@@ -423,11 +482,11 @@ func TestFreezeTarget_OneDependency(t *testing.T) {
 
 	if err := expectDerivation(
 		&Derivation{
-			ID:   derivationID("hash<toplevel>", "target<toplevel>"),
+			ID:   derivationID([]byte("hash<toplevel>"), "target<toplevel>"),
 			Hash: []byte("hash<toplevel>"),
 			Dependencies: []*Derivation{{
 				ID: derivationID(
-					"hash<dependency>",
+					[]byte("hash<dependency>"),
 					"target<dependency>",
 				),
 				Hash:    []byte("hash<dependency>"),
@@ -438,7 +497,7 @@ func TestFreezeTarget_OneDependency(t *testing.T) {
 			Builder: "builder<toplevel>",
 			Args: []string{fmt.Sprintf(
 				"Dependency %s",
-				derivationID("hash<dependency>", "target<dependency>"),
+				derivationID([]byte("hash<dependency>"), "target<dependency>"),
 			)},
 			Env: []string{"env<toplevel>-1", "env<toplevel>-2"},
 		},
@@ -448,6 +507,199 @@ func TestFreezeTarget_OneDependency(t *testing.T) {
 	}
 }
 
+func TestFreezeTarget_fixedOutput(t *testing.T) {
+	const outputHash = "h1:FEBLx1zS214owpjy7qsBeixbURkuhQAwrK5UwLGTwt4="
+	fetcher := &Target{Name: "fetcher", Builder: "fetcher-builder"}
+	freeze := func(builder string) (*Derivation, error) {
+		return FreezeTarget(
+			"",
+			hashAlgorithms["sha256"],
+			newTestCache(),
+			nil,
+			nil,
+			nil,
+			&Target{
+				Name:       "errors",
+				Builder:    builder,
+				Args:       []Arg{fetcher, String("github.com/pkg/errors")},
+				Env:        []string{},
+				OutputHash: outputHash,
+			},
+		)
+	}
+
+	// Fixed-output targets are identified by their output hash, so changing
+	// the recipe must not change the derivation ID.
+	d1, err := freeze("curl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d2, err := freeze("wget")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d1.ID != d2.ID {
+		t.Fatalf("Wanted matching IDs; got '%s' and '%s'", d1.ID, d2.ID)
+	}
+	if d1.OutputHash != outputHash {
+		t.Fatalf("Wanted output hash '%s'; got '%s'", outputHash, d1.OutputHash)
+	}
+
+	// The recipe's dependencies must still be built first.
+	if len(d1.Dependencies) != 1 ||
+		!strings.HasSuffix(d1.Dependencies[0].ID, "-fetcher") {
+		t.Fatalf("Wanted a single 'fetcher' dependency; got %s", d1.Dependencies)
+	}
+}
+
+func TestFreezeTarget_hashAlgorithms(t *testing.T) {
+	target := &Target{
+		Name:    "target",
+		Builder: "builder",
+		Args:    []Arg{String("arg")},
+		Env:     []string{},
+	}
+	ids := map[string]string{}
+	for name, algorithm := range hashAlgorithms {
+		d, err := FreezeTarget(
+			"",
+			algorithm,
+			newTestCache(),
+			nil,
+			nil,
+			nil,
+			target,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.HashAlgorithm != name {
+			t.Fatalf(
+				"Wanted hash algorithm '%s'; got '%s'",
+				name,
+				d.HashAlgorithm,
+			)
+		}
+		// IDs are the hash's 160-bit prefix in base32, followed by the
+		// name, and the derivation keeps the full hash.
+		if wanted := encodeHash(d.Hash) + "-target"; d.ID != wanted ||
+			len(wanted) != 32+len("-target") {
+			t.Fatalf("Wanted ID '%s'; got '%s'", wanted, d.ID)
+		}
+		if len(d.Hash) != algorithm.New().Size() {
+			t.Fatalf(
+				"Wanted a %d-byte hash; got %d bytes",
+				algorithm.New().Size(),
+				len(d.Hash),
+			)
+		}
+		for other, id := range ids {
+			if id == d.ID {
+				t.Fatalf(
+					"Wanted %s and %s IDs to differ; got '%s'",
+					other,
+					name,
+					id,
+				)
+			}
+		}
+		ids[name] = d.ID
+	}
+}
+
+func TestHostToolFreezeArg(t *testing.T) {
+	if err := withTempDir(func(dir string) error {
+		tool := filepath.Join(dir, "tool")
+		writeTool := func(version string) error {
+			return ioutil.WriteFile(
+				tool,
+				[]byte("#!/bin/sh\necho tool "+version+"\n"),
+				0755,
+			)
+		}
+		freeze := func() (ArgValue, error) {
+			return (&HostTool{
+				Name:  "tool",
+				Probe: []string{"tool", "--version"},
+				Paths: []string{dir},
+			}).freezeArg(&freezer{newHasher: sha256.New})
+		}
+
+		if err := writeTool("1.0"); err != nil {
+			return err
+		}
+		v1, err := freeze()
+		if err != nil {
+			return err
+		}
+		if len(v1.Derivations) != 1 {
+			return errors.Errorf(
+				"Wanted exactly 1 derivation; got %d",
+				len(v1.Derivations),
+			)
+		}
+		d := v1.Derivations[0]
+		wanted := fmtList([]string{tool, "tool 1.0\n"})
+		if got := fmtList(d.Args); got != wanted {
+			return errors.Errorf("Wanted args %s; got %s", wanted, got)
+		}
+		if d.ID != v1.Value || !strings.HasSuffix(d.ID, "-tool") {
+			return errors.Errorf("Unexpected derivation ID '%s'", d.ID)
+		}
+
+		// Upgrading the tool must change its hash.
+		if err := writeTool("2.0"); err != nil {
+			return err
+		}
+		v2, err := freeze()
+		if err != nil {
+			return err
+		}
+		if v1.Value == v2.Value {
+			return errors.Errorf("Wanted a new ID after upgrading the tool")
+		}
+
+		// The same binary at another path must have a different hash since
+		// the path is passed to the derivation's builder.
+		otherDir := filepath.Join(dir, "other")
+		if err := os.Mkdir(otherDir, 0755); err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(tool)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(
+			filepath.Join(otherDir, "tool"),
+			data,
+			0755,
+		); err != nil {
+			return err
+		}
+		moved, err := (&HostTool{
+			Name:  "tool",
+			Probe: []string{"tool", "--version"},
+			Paths: []string{otherDir},
+		}).freezeArg(&freezer{newHasher: sha256.New})
+		if err != nil {
+			return err
+		}
+		if moved.Value == v2.Value {
+			return errors.Errorf("Wanted a new ID for the tool at a new path")
+		}
+
+		_, err = (&HostTool{Name: "no-such-tool-g8r"}).freezeArg(
+			&freezer{newHasher: sha256.New},
+		)
+		if err == nil {
+			return errors.Errorf("Wanted an error for a missing tool")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestPathFreezeArg(t *testing.T) {
 	if err := withTempDir(func(dir string) error {
 		// Prepare test file
@@ -516,6 +768,73 @@ func TestPathFreezeArg(t *testing.T) {
 	}
 }
 
+func TestPathFreezeArg_cached(t *testing.T) {
+	if err := withTempDir(func(dir string) error {
+		path := filepath.Join(dir, "test")
+		if err := ioutil.WriteFile(path, []byte("hi!"), 0644); err != nil {
+			return err
+		}
+		// Recently modified files aren't cached, so backdate the file.
+		old := time.Now().Add(-time.Hour)
+		if err := os.Chtimes(path, old, old); err != nil {
+			return err
+		}
+
+		f := freezer{
+			packageRoot: dir,
+			newHasher:   sha256.New,
+			cache:       newTestCache(),
+			fileHashes:  loadFileHashCache(filepath.Join(dir, "hashes.json")),
+		}
+		before, err := Path("test").freezeArg(&f)
+		if err != nil {
+			return err
+		}
+
+		// Change the file without changing its size, modification time or
+		// inode. Its hash is still cached and its snapshot already exists,
+		// so the file mustn't be read (or copied) again.
+		file, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		if _, err := file.Write([]byte("ho!")); err != nil {
+			properClose(file)
+			return err
+		}
+		if err := file.Close(); err != nil {
+			return err
+		}
+		if err := os.Chtimes(path, old, old); err != nil {
+			return err
+		}
+
+		after, err := Path("test").freezeArg(&f)
+		if err != nil {
+			return err
+		}
+		if after.Value != before.Value {
+			return errors.Errorf(
+				"Wanted the cached snapshot '%s'; got '%s'",
+				before.Value,
+				after.Value,
+			)
+		}
+
+		// Without the snapshot, copying the file notices the stale hash.
+		f.cache = newTestCache()
+		if _, err := Path("test").freezeArg(&f); err == nil {
+			return errors.Errorf("Wanted an error for a stale hash")
+		}
+		if _, err := Path("test").freezeArg(&f); err != nil {
+			return errors.Wrap(err, "Wanted the stale hash to be forgotten")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestGlobGroupFreezeArg(t *testing.T) {
 	files := map[string][]byte{
 		"foo/bar": []byte("hello"),
@@ -546,13 +865,13 @@ func TestGlobGroupFreezeArg(t *testing.T) {
 			}
 		}
 
-		globGroup := GlobGroup{"foo/ba*"}
-		h := testHash{output: "hash"}
+		globGroup := GlobGroup{Patterns: []string{"foo/ba*"}}
 		cache := newTestCache()
 
+		// Files are hashed concurrently, so each needs its own hasher.
 		argValue, err := globGroup.freezeArg(&freezer{
 			packageRoot: dir,
-			newHasher:   func() hash.Hash { return &h },
+			newHasher:   func() hash.Hash { return &testHash{output: "hash"} },
 			cache:       cache,
 		})
 		if err != nil {
@@ -650,6 +969,314 @@ func TestGlobGroupFreezeArg(t *testing.T) {
 	}
 }
 
+func TestSourceFileWriteHash(t *testing.T) {
+	groupHash := func(files ...sourceFile) string {
+		hasher := sha256.New()
+		for _, file := range files {
+			file.writeHash(hasher)
+		}
+		return hex.EncodeToString(hasher.Sum(nil))
+	}
+
+	// Without framing, the second group's link target would spell out the
+	// rest of the first group.
+	dir := sourceFile{relPath: "c", mode: os.ModeDir | 0755}
+	target := "b" + "d" + dir.relPath + string(permissionBits(dir.mode))
+	split := groupHash(
+		sourceFile{relPath: "a", mode: os.ModeSymlink | 0777, target: "b"},
+		dir,
+	)
+	joined := groupHash(
+		sourceFile{relPath: "a", mode: os.ModeSymlink | 0777, target: target},
+	)
+	if split == joined {
+		t.Fatal("Wanted different hashes for different groups of files")
+	}
+}
+
+func TestGlobGroupFreezeArg_fileTypes(t *testing.T) {
+	if err := withTempDir(func(dir string) error {
+		if err := writeTestFiles(dir, map[string]string{"a/file": "a"}); err != nil {
+			return err
+		}
+		if err := os.Mkdir(filepath.Join(dir, "empty"), 0755); err != nil {
+			return err
+		}
+		for link, target := range map[string]string{
+			"link":     "a/file",
+			"dangling": "missing",
+			"linkdir":  "a",
+		} {
+			if err := os.Symlink(target, filepath.Join(dir, link)); err != nil {
+				return err
+			}
+		}
+
+		cache := newTestCache()
+		argValue, err := GlobGroup{Patterns: []string{"**"}}.freezeArg(
+			&freezer{packageRoot: dir, newHasher: sha256.New, cache: cache},
+		)
+		if err != nil {
+			return err
+		}
+		entry := cache.entries[argValue.Value].(*dirEntry)
+
+		// Symlinks are preserved rather than followed (so `linkdir/file`
+		// isn't included) and directories are included even if they're
+		// empty.
+		wanted := map[string]string{
+			"a":        "d",
+			"a/file":   "-a",
+			"dangling": "Lmissing",
+			"empty":    "d",
+			"link":     "La/file",
+			"linkdir":  "La",
+		}
+		got := map[string]string{}
+		for relPath, fe := range entry.files {
+			got[relPath] = fe.mode.String()[:1] + fe.buf.String()
+		}
+		if len(got) != len(wanted) {
+			return errors.Errorf("Wanted files %v; got %v", wanted, got)
+		}
+		for relPath, wantedFile := range wanted {
+			if got[relPath] != wantedFile {
+				return errors.Errorf("Wanted files %v; got %v", wanted, got)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A symlink doesn't hash the same as a file whose contents are the
+	// link's target.
+	var hashes []string
+	for _, makeFile := range []func(string) error{
+		func(path string) error {
+			return ioutil.WriteFile(path, []byte("target"), 0777)
+		},
+		func(path string) error { return os.Symlink("target", path) },
+	} {
+		if err := withTempDir(func(dir string) error {
+			if err := makeFile(filepath.Join(dir, "file")); err != nil {
+				return err
+			}
+			argValue, err := GlobGroup{Patterns: []string{"file"}}.freezeArg(
+				&freezer{
+					packageRoot: dir,
+					newHasher:   sha256.New,
+					cache:       newTestCache(),
+				},
+			)
+			hashes = append(hashes, argValue.Value)
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if hashes[0] == hashes[1] {
+		t.Fatal("Wanted different hashes for a file and a symlink")
+	}
+}
+
+func TestFileHashCache(t *testing.T) {
+	if err := withTempDir(func(dir string) error {
+		path := filepath.Join(dir, "file")
+		write := func(contents string) (os.FileInfo, error) {
+			err := ioutil.WriteFile(path, []byte(contents), 0644)
+			if err != nil {
+				return nil, err
+			}
+			// Recently modified files aren't cached, so backdate the file.
+			old := time.Now().Add(-time.Hour)
+			if err := os.Chtimes(path, old, old); err != nil {
+				return nil, err
+			}
+			return os.Stat(path)
+		}
+		hashOf := func(contents string) string {
+			sum := sha256.Sum256([]byte(contents))
+			return hex.EncodeToString(sum[:])
+		}
+
+		fi, err := write("hello")
+		if err != nil {
+			return err
+		}
+		cachePath := filepath.Join(dir, fileHashCacheName)
+		fhc := loadFileHashCache(cachePath)
+		if _, err := fhc.hashFileContents(path, fi, sha256.New); err != nil {
+			return err
+		}
+		if err := fhc.save(); err != nil {
+			return err
+		}
+
+		// Make the cached hash distinguishable from the file's actual hash so
+		// we can tell whether the file was read.
+		fhc = loadFileHashCache(cachePath)
+		entry, found := fhc.entries[path]
+		if !found {
+			return errors.Errorf("Wanted a cache entry for '%s'", path)
+		}
+		entry.Hash = []byte("cached")
+		fhc.entries[path] = entry
+		hash, err := fhc.hashFileContents(path, fi, sha256.New)
+		if err != nil {
+			return err
+		}
+		if string(hash) != "cached" {
+			return errors.Errorf("Wanted the cached hash; got %x", hash)
+		}
+
+		// Changing the file invalidates its cache entry.
+		if fi, err = write("goodbye"); err != nil {
+			return err
+		}
+		if hash, err = fhc.hashFileContents(
+			path,
+			fi,
+			sha256.New,
+		); err != nil {
+			return err
+		}
+		if got := hex.EncodeToString(hash); got != hashOf("goodbye") {
+			return errors.Errorf(
+				"Wanted hash %s; got %s",
+				hashOf("goodbye"),
+				got,
+			)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileHashCache_prune(t *testing.T) {
+	if err := withTempDir(func(dir string) error {
+		old := time.Now().Add(-time.Hour)
+		write := func(name string, contents string) (string, error) {
+			path := filepath.Join(dir, name)
+			err := ioutil.WriteFile(path, []byte(contents), 0644)
+			if err != nil {
+				return "", err
+			}
+			return path, os.Chtimes(path, old, old)
+		}
+
+		cachePath := filepath.Join(dir, fileHashCacheName)
+		fhc := loadFileHashCache(cachePath)
+		paths := map[string]string{}
+		for _, name := range []string{"deleted", "modified", "unchanged"} {
+			path, err := write(name, name)
+			if err != nil {
+				return err
+			}
+			fi, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+			if _, err := fhc.hashFileContents(
+				path,
+				fi,
+				sha256.New,
+			); err != nil {
+				return err
+			}
+			paths[name] = path
+		}
+		if err := fhc.save(); err != nil {
+			return err
+		}
+
+		// A later run which doesn't look up any of the files drops the
+		// entries of the files which have been deleted or modified.
+		if err := os.Remove(paths["deleted"]); err != nil {
+			return err
+		}
+		if _, err := write("modified", "modified again"); err != nil {
+			return err
+		}
+		if err := loadFileHashCache(cachePath).save(); err != nil {
+			return err
+		}
+
+		entries := loadFileHashCache(cachePath).entries
+		for name, wanted := range map[string]bool{
+			"deleted":   false,
+			"modified":  false,
+			"unchanged": true,
+		} {
+			if _, found := entries[paths[name]]; found != wanted {
+				return errors.Errorf(
+					"File '%s': wanted cached=%t; got cached=%t",
+					name,
+					wanted,
+					found,
+				)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGlobGroupFreezeArg_staleHash(t *testing.T) {
+	if err := withTempDir(func(dir string) error {
+		root := filepath.Join(dir, "package")
+		if err := os.Mkdir(root, 0755); err != nil {
+			return err
+		}
+		path := filepath.Join(root, "file")
+		if err := ioutil.WriteFile(path, []byte("hello"), 0644); err != nil {
+			return err
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		fsc, err := FileSystemCacheFromTempDir(
+			filepath.Join(dir, "cache"),
+			sha256.New,
+		)
+		if err != nil {
+			return err
+		}
+		defer fsc.Close()
+
+		// A cached hash which doesn't match the file's contents mustn't name
+		// a snapshot of them.
+		fhc := loadFileHashCache(filepath.Join(dir, fileHashCacheName))
+		stale := sha256.Sum256([]byte("goodbye"))
+		fhc.entries[path] = newFileHashEntry(fi, stale[:])
+		f := freezer{
+			packageRoot: root,
+			newHasher:   sha256.New,
+			cache:       fsc,
+			fileHashes:  fhc,
+		}
+		gg := GlobGroup{Patterns: []string{"file"}}
+		if _, err := gg.freezeArg(&f); err == nil || !strings.Contains(
+			err.Error(),
+			"changed while it was being snapshotted",
+		) {
+			return errors.Errorf("Wanted a content hash mismatch; got %v", err)
+		}
+
+		// The stale hash is dropped, so the next freeze succeeds.
+		if _, found := fhc.entries[path]; found {
+			return errors.Errorf("Wanted the stale hash to be dropped")
+		}
+		_, err = gg.freezeArg(&f)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
 // TODO: Find a better way to assert that things were hashed. Specifically, we
 // don't want tests to start failing if we change the order in which things are
 // hashed in the implementation. We also don't want to fail if we decide that
@@ -658,3 +1285,228 @@ func TestGlobGroupFreezeArg(t *testing.T) {
 // associated with string-contains checks (e.g., we actually hash foo/bar.yml
 // but the check passes because we're just expecting the hash input contains
 // bar.yml).
+
+func TestGlobGroupMatches(t *testing.T) {
+	files := map[string]string{
+		".gitignore":          "*.gen.go\n/build/\n",
+		".g8rignore":          "!keep.gen.go\n",
+		"main.go":             "",
+		"main.gen.go":         "",
+		"keep.gen.go":         "",
+		"build/out.go":        "",
+		".vendor/lib/lib.go":  "",
+		"testdata/fixture.go": "",
+		"pkg/.gitignore":      "fixture.go\n",
+		"pkg/pkg.go":          "",
+		"pkg/fixture.go":      "",
+	}
+
+	for _, testCase := range []struct {
+		name      string
+		globGroup GlobGroup
+		wanted    []string
+		wantedErr string
+	}{{
+		name:      "no exclusions",
+		globGroup: GlobGroup{Patterns: []string{"*.go"}},
+		wanted:    []string{"keep.gen.go", "main.gen.go", "main.go"},
+	}, {
+		name: "exclude patterns and directories",
+		globGroup: GlobGroup{
+			Patterns: []string{"**/*.go"},
+			Exclude:  []string{".vendor", "testdata/**", "*.gen.go"},
+		},
+		wanted: []string{
+			"build/out.go",
+			"pkg/fixture.go",
+			"pkg/pkg.go",
+			"main.go",
+		},
+	}, {
+		name: "ignore files",
+		globGroup: GlobGroup{
+			Patterns:    []string{"**/*.go"},
+			IgnoreFiles: true,
+		},
+		wanted: []string{
+			".vendor/lib/lib.go",
+			"keep.gen.go",
+			"main.go",
+			"pkg/pkg.go",
+			"testdata/fixture.go",
+		},
+	}, {
+		name:      "pattern matches nothing",
+		globGroup: GlobGroup{Patterns: []string{"*.go", "*.rs"}},
+		wantedErr: "Pattern '*.rs' matched no files",
+	}, {
+		name: "pattern matches nothing after exclusions",
+		globGroup: GlobGroup{
+			Patterns: []string{"build/*.go"},
+			Exclude:  []string{"build"},
+		},
+		wantedErr: "Pattern 'build/*.go' matched no files after exclusions",
+	}} {
+		t.Run(testCase.name, func(t *testing.T) {
+			if err := withTempDir(func(dir string) error {
+				for relPath, contents := range files {
+					filePath := filepath.Join(dir, relPath)
+					if err := os.MkdirAll(
+						filepath.Dir(filePath),
+						0700,
+					); err != nil {
+						return err
+					}
+					if err := ioutil.WriteFile(
+						filePath,
+						[]byte(contents),
+						0644,
+					); err != nil {
+						return err
+					}
+				}
+
+				paths, err := testCase.globGroup.matches(dir)
+				if testCase.wantedErr != "" {
+					if err == nil || err.Error() != testCase.wantedErr {
+						return errors.Errorf(
+							"Wanted error '%s'; got '%v'",
+							testCase.wantedErr,
+							err,
+						)
+					}
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+
+				got := make(map[string]struct{}, len(paths))
+				for _, path := range paths {
+					relPath, err := filepath.Rel(dir, path)
+					if err != nil {
+						return err
+					}
+					got[relPath] = struct{}{}
+				}
+				if len(got) != len(testCase.wanted) {
+					return errors.Errorf(
+						"Wanted %s; got %s",
+						stringList(testCase.wanted),
+						stringList(paths),
+					)
+				}
+				for _, wanted := range testCase.wanted {
+					if _, found := got[wanted]; !found {
+						return errors.Errorf(
+							"Wanted %s; got %s",
+							stringList(testCase.wanted),
+							stringList(paths),
+						)
+					}
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestFreezeTarget_settings(t *testing.T) {
+	branches := starlark.NewDict(4)
+	for condition, value := range map[string]string{
+		"mode=release":         "-O2",
+		"mode=debug,os=linux":  "-g",
+		"mode=debug,arch=wasm": "-gwasm",
+		"default":              "-O0",
+	} {
+		if err := branches.SetKey(
+			starlark.String(condition),
+			starlark.String(value),
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sel, err := starlarkSelect(starlark.Tuple{branches}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mode, err := starlarkSetting(
+		starlark.Tuple{starlark.String("mode")},
+		[]starlark.Tuple{{starlark.String("default"), starlark.String("none")}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	freeze := func(defines map[string]string) (*Derivation, error) {
+		return FreezeTarget(
+			"",
+			hashAlgorithms["sha256"],
+			newTestCache(),
+			nil,
+			nil,
+			buildSettings("linux", "amd64", defines),
+			&Target{
+				Name:    "configured",
+				Builder: "builder",
+				Args:    []Arg{sel.(Arg), mode.(Arg)},
+			},
+		)
+	}
+
+	ids := map[string]string{}
+	for _, testCase := range []struct {
+		defines map[string]string
+		wanted  []string
+	}{
+		{defines: nil, wanted: []string{"-O0", "none"}},
+		{
+			defines: map[string]string{"mode": "release"},
+			wanted:  []string{"-O2", "release"},
+		},
+		{
+			defines: map[string]string{"mode": "debug"},
+			wanted:  []string{"-g", "debug"},
+		},
+		{
+			defines: map[string]string{"mode": "debug", "os": "darwin"},
+			wanted:  []string{"-O0", "debug"},
+		},
+	} {
+		d, err := freeze(testCase.defines)
+		if err != nil {
+			t.Fatalf("Defines %v: unexpected err: %v", testCase.defines, err)
+		}
+		if got := fmtList(d.Args); got != fmtList(testCase.wanted) {
+			t.Fatalf(
+				"Defines %v: wanted args %s; got %s",
+				testCase.defines,
+				fmtList(testCase.wanted),
+				got,
+			)
+		}
+		if other, found := ids[d.ID]; found {
+			t.Fatalf(
+				"Defines %v and %s yielded the same ID '%s'",
+				testCase.defines,
+				other,
+				d.ID,
+			)
+		}
+		ids[d.ID] = fmt.Sprint(testCase.defines)
+	}
+
+	if _, err := freeze(
+		map[string]string{"mode": "debug", "arch": "wasm"},
+	); err == nil {
+		t.Fatal("Wanted an error for an ambiguous select()")
+	}
+
+	if _, err := (Setting{Name: "undefined"}).freezeArg(
+		&freezer{newHasher: sha256.New},
+	); err == nil {
+		t.Fatal("Wanted an error for an undefined setting")
+	}
+}
@@ -3,9 +3,12 @@ module github.com/weberc2/gubernator
 go 1.14
 
 require (
+	github.com/BurntSushi/toml v0.4.1
 	github.com/bmatcuk/doublestar v1.3.1
 	github.com/fatih/color v1.9.0
 	github.com/philandstuff/dhall-golang/v4 v4.0.0
 	github.com/pkg/errors v0.9.1
+	github.com/zeebo/blake3 v0.2.3
 	go.starlark.net v0.0.0-20200723213555-f21d2f77688f
+	gopkg.in/yaml.v2 v2.4.0
 )
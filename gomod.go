@@ -0,0 +1,370 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// The `gomod` module parses go.mod and go.sum files so that Starlark rules can
+// model each Go module dependency as its own target (see `modules/go`). Like
+// the other decoders, it operates on file contents (e.g., from `read_file()`)
+// rather than on paths.
+
+// gomodModule provides `gomod.parse_mod()` and `gomod.parse_sum()`.
+var gomodModule = &starlarkstruct.Module{
+	Name: "gomod",
+	Members: starlark.StringDict{
+		"parse_mod": builtinWrapper("gomod.parse_mod", starlarkGoModParseMod),
+		"parse_sum": builtinWrapper("gomod.parse_sum", starlarkGoModParseSum),
+	},
+}
+
+// starlarkGoModParseMod parses the contents of a go.mod file into a struct
+// with the fields `module`, `go`, `require` (a list of structs with `path`,
+// `version` and `indirect` fields) and `replace` (a list of structs with
+// `old_path`, `old_version`, `new_path` and `new_version` fields; the
+// versions are empty when the directive doesn't specify them).
+func starlarkGoModParseMod(
+	args starlark.Tuple,
+	kwargs []starlark.Tuple,
+) (starlark.Value, error) {
+	var document string
+	if err := starlark.UnpackPositionalArgs(
+		"gomod.parse_mod",
+		args,
+		kwargs,
+		1,
+		&document,
+	); err != nil {
+		return nil, err
+	}
+
+	mod, err := parseGoMod(document)
+	if err != nil {
+		return nil, err
+	}
+
+	require := make([]starlark.Value, len(mod.require))
+	for i, r := range mod.require {
+		require[i] = starlarkstruct.FromStringDict(
+			starlarkstruct.Default,
+			starlark.StringDict{
+				"path":     starlark.String(r.path),
+				"version":  starlark.String(r.version),
+				"indirect": starlark.Bool(r.indirect),
+			},
+		)
+	}
+	replace := make([]starlark.Value, len(mod.replace))
+	for i, r := range mod.replace {
+		replace[i] = starlarkstruct.FromStringDict(
+			starlarkstruct.Default,
+			starlark.StringDict{
+				"old_path":    starlark.String(r.oldPath),
+				"old_version": starlark.String(r.oldVersion),
+				"new_path":    starlark.String(r.newPath),
+				"new_version": starlark.String(r.newVersion),
+			},
+		)
+	}
+	return starlarkstruct.FromStringDict(
+		starlarkstruct.Default,
+		starlark.StringDict{
+			"module":  starlark.String(mod.module),
+			"go":      starlark.String(mod.goVersion),
+			"require": starlark.NewList(require),
+			"replace": starlark.NewList(replace),
+		},
+	), nil
+}
+
+// starlarkGoModParseSum parses the contents of a go.sum file into a list of
+// structs, one per module version, with the fields `path`, `version`, `hash`
+// (the hash of the module's contents) and `go_mod_hash` (the hash of its
+// go.mod file). Modules which are only needed for their go.mod file (e.g., to
+// resolve the module graph) have an empty `hash`. The list is in the order
+// that the module versions first appear in the file.
+func starlarkGoModParseSum(
+	args starlark.Tuple,
+	kwargs []starlark.Tuple,
+) (starlark.Value, error) {
+	var document string
+	if err := starlark.UnpackPositionalArgs(
+		"gomod.parse_sum",
+		args,
+		kwargs,
+		1,
+		&document,
+	); err != nil {
+		return nil, err
+	}
+
+	entries, err := parseGoSum(document)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]starlark.Value, len(entries))
+	for i, entry := range entries {
+		values[i] = starlarkstruct.FromStringDict(
+			starlarkstruct.Default,
+			starlark.StringDict{
+				"path":        starlark.String(entry.path),
+				"version":     starlark.String(entry.version),
+				"hash":        starlark.String(entry.hash),
+				"go_mod_hash": starlark.String(entry.goModHash),
+			},
+		)
+	}
+	return starlark.NewList(values), nil
+}
+
+//
+// go.mod
+//
+
+type goMod struct {
+	module    string
+	goVersion string
+	require   []goModRequire
+	replace   []goModReplace
+}
+
+type goModRequire struct {
+	path     string
+	version  string
+	indirect bool
+}
+
+type goModReplace struct {
+	oldPath    string
+	oldVersion string
+	newPath    string
+	newVersion string
+}
+
+// parseGoMod parses the subset of the go.mod grammar that is needed to model
+// dependencies. Directives which don't affect dependency resolution (e.g.,
+// `exclude`, `retract` and `toolchain`) are accepted but ignored.
+func parseGoMod(document string) (goMod, error) {
+	var mod goMod
+	var block string
+	for i, line := range strings.Split(document, "\n") {
+		fields, comment, err := goModFields(line)
+		if err != nil {
+			return goMod{}, errors.Wrapf(err, "go.mod line %d", i+1)
+		}
+		if len(fields) < 1 {
+			continue
+		}
+
+		// Handle the start and end of `verb ( ... )` blocks. Lines within a
+		// block are treated as though they were prefixed by the verb.
+		if block != "" {
+			if len(fields) == 1 && fields[0] == ")" {
+				block = ""
+				continue
+			}
+			fields = append([]string{block}, fields...)
+		} else if len(fields) == 2 && fields[1] == "(" {
+			block = fields[0]
+			continue
+		}
+
+		if err := mod.addDirective(fields, comment); err != nil {
+			return goMod{}, errors.Wrapf(err, "go.mod line %d", i+1)
+		}
+	}
+	if block != "" {
+		return goMod{}, errors.Errorf("go.mod: unterminated '%s' block", block)
+	}
+	if mod.module == "" {
+		return goMod{}, errors.Errorf("go.mod: missing module directive")
+	}
+	return mod, nil
+}
+
+func (mod *goMod) addDirective(fields []string, comment string) error {
+	verb, args := fields[0], fields[1:]
+	switch verb {
+	case "module":
+		if len(args) != 1 {
+			return errors.Errorf("Usage: module <path>")
+		}
+		mod.module = args[0]
+	case "go":
+		if len(args) != 1 {
+			return errors.Errorf("Usage: go <version>")
+		}
+		mod.goVersion = args[0]
+	case "require":
+		if len(args) != 2 {
+			return errors.Errorf("Usage: require <path> <version>")
+		}
+		mod.require = append(mod.require, goModRequire{
+			path:     args[0],
+			version:  args[1],
+			indirect: strings.TrimSpace(comment) == "indirect",
+		})
+	case "replace":
+		r, err := parseGoModReplace(args)
+		if err != nil {
+			return err
+		}
+		mod.replace = append(mod.replace, r)
+	case "exclude", "retract", "toolchain", "godebug":
+	default:
+		return errors.Errorf("Unknown directive '%s'", verb)
+	}
+	return nil
+}
+
+// parseGoModReplace parses the args of a `replace` directive, which have the
+// form `old [version] => new [version]`.
+func parseGoModReplace(args []string) (goModReplace, error) {
+	arrow := -1
+	for i, arg := range args {
+		if arg == "=>" {
+			arrow = i
+			break
+		}
+	}
+	old, new := args, []string(nil)
+	if arrow >= 0 {
+		old, new = args[:arrow], args[arrow+1:]
+	}
+	if arrow < 0 || len(old) < 1 || len(old) > 2 ||
+		len(new) < 1 || len(new) > 2 {
+		return goModReplace{}, errors.Errorf(
+			"Usage: replace <path> [<version>] => <path> [<version>]",
+		)
+	}
+
+	var r goModReplace
+	r.oldPath, r.newPath = old[0], new[0]
+	if len(old) == 2 {
+		r.oldVersion = old[1]
+	}
+	if len(new) == 2 {
+		r.newVersion = new[1]
+	}
+	return r, nil
+}
+
+// goModFields splits a go.mod line into whitespace-separated fields (with
+// quoted strings unquoted) and its trailing `//` comment, if any.
+func goModFields(line string) ([]string, string, error) {
+	var fields []string
+	for {
+		line = strings.TrimLeft(line, " \t\r")
+		switch {
+		case line == "":
+			return fields, "", nil
+		case strings.HasPrefix(line, "//"):
+			return fields, line[2:], nil
+		case line[0] == '"' || line[0] == '`':
+			end := strings.IndexByte(line[1:], line[0])
+			if line[0] == '"' {
+				end = quotedStringEnd(line)
+			}
+			if end < 0 {
+				return nil, "", errors.Errorf("Unterminated string")
+			}
+			s, err := strconv.Unquote(line[:end+2])
+			if err != nil {
+				return nil, "", errors.Wrap(err, "Unquoting string")
+			}
+			fields = append(fields, s)
+			line = line[end+2:]
+		default:
+			end := strings.IndexAny(line, " \t\r")
+			if end < 0 {
+				end = len(line)
+			}
+			fields = append(fields, line[:end])
+			line = line[end:]
+		}
+	}
+}
+
+// quotedStringEnd returns the index (relative to `line[1:]`) of the quote
+// which terminates the double-quoted string at the start of `line`, skipping
+// escaped quotes, or -1 if the string is unterminated.
+func quotedStringEnd(line string) int {
+	for i := 1; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++
+		case '"':
+			return i - 1
+		}
+	}
+	return -1
+}
+
+//
+// go.sum
+//
+
+type goSumEntry struct {
+	path      string
+	version   string
+	hash      string
+	goModHash string
+}
+
+// parseGoSum parses a go.sum file, merging the content hash and go.mod hash
+// lines for each module version into a single entry.
+func parseGoSum(document string) ([]goSumEntry, error) {
+	var entries []goSumEntry
+	indices := map[[2]string]int{}
+	for i, line := range strings.Split(document, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 1 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, errors.Errorf(
+				"go.sum line %d: expected '<path> <version> <hash>'",
+				i+1,
+			)
+		}
+
+		path, version, hash := fields[0], fields[1], fields[2]
+		version, isGoMod := trimGoModSuffix(version)
+		key := [2]string{path, version}
+		index, found := indices[key]
+		if !found {
+			index = len(entries)
+			indices[key] = index
+			entries = append(entries, goSumEntry{path: path, version: version})
+		}
+
+		entry := &entries[index]
+		field := &entry.hash
+		if isGoMod {
+			field = &entry.goModHash
+		}
+		if *field != "" && *field != hash {
+			return nil, errors.Errorf(
+				"go.sum line %d: conflicting hashes for %s@%s",
+				i+1,
+				path,
+				fields[1],
+			)
+		}
+		*field = hash
+	}
+	return entries, nil
+}
+
+func trimGoModSuffix(version string) (string, bool) {
+	const goModSuffix = "/go.mod"
+	if strings.HasSuffix(version, goModSuffix) {
+		return strings.TrimSuffix(version, goModSuffix), true
+	}
+	return version, false
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/sha256"
+	"hash"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/zeebo/blake3"
+	"go.starlark.net/starlark"
+)
+
+// The hash algorithm identifies derivations, source snapshots and the blobs
+// in the cache. A workspace chooses its algorithm in its WORKSPACE file:
+//
+//     hash_algorithm(name)
+//
+// where `name` is "sha256" (the default) or "blake3". Each algorithm has its
+// own cache directory (named after the algorithm) and derivations record the
+// algorithm that produced their IDs, so builds with different algorithms can
+// share a cache directory without their entries ever colliding.
+
+// defaultHashAlgorithm is the algorithm used by workspaces which don't call
+// `hash_algorithm()`. It's also the algorithm of caches which predate
+// per-algorithm cache directories (see `migrateLegacyCache()`).
+const defaultHashAlgorithm = "sha256"
+
+// hashAlgorithm is a named hash function.
+type hashAlgorithm struct {
+	Name string
+	New  func() hash.Hash
+}
+
+// hashAlgorithms are the supported hash algorithms by name.
+var hashAlgorithms = map[string]hashAlgorithm{
+	"sha256": {Name: "sha256", New: sha256.New},
+	"blake3": {
+		Name: "blake3",
+		New:  func() hash.Hash { return blake3.New() },
+	},
+}
+
+// lookupHashAlgorithm returns the supported hash algorithm named `name`.
+func lookupHashAlgorithm(name string) (hashAlgorithm, error) {
+	algorithm, found := hashAlgorithms[name]
+	if !found {
+		names := make([]string, 0, len(hashAlgorithms))
+		for name := range hashAlgorithms {
+			names = append(names, "'"+name+"'")
+		}
+		sort.Strings(names)
+		return hashAlgorithm{}, errors.Errorf(
+			"Unsupported hash algorithm '%s' (expected one of %s)",
+			name,
+			strings.Join(names, ", "),
+		)
+	}
+	return algorithm, nil
+}
+
+// hashAlgorithm returns the workspace's hash algorithm.
+func (ws *workspace) hashAlgorithm() hashAlgorithm {
+	if ws.algorithm == "" {
+		return hashAlgorithms[defaultHashAlgorithm]
+	}
+	return hashAlgorithms[ws.algorithm]
+}
+
+// starlarkHashAlgorithm implements the `hash_algorithm(name)` builtin, which
+// is only available in WORKSPACE files.
+func starlarkHashAlgorithm(
+	th *starlark.Thread,
+	args starlark.Tuple,
+	kwargs []starlark.Tuple,
+) (starlark.Value, error) {
+	ws, ok := th.Local(workspaceLocal).(*workspace)
+	if !ok {
+		return nil, errors.Errorf(
+			"hash_algorithm() may only be called from a %s file",
+			workspaceFileName,
+		)
+	}
+
+	var name string
+	if err := starlark.UnpackPositionalArgs(
+		"hash_algorithm",
+		args,
+		kwargs,
+		1,
+		&name,
+	); err != nil {
+		return nil, err
+	}
+	if ws.algorithm != "" {
+		return nil, errors.Errorf(
+			"hash_algorithm() may only be called once; the algorithm is "+
+				"already '%s'",
+			ws.algorithm,
+		)
+	}
+	if _, err := lookupHashAlgorithm(name); err != nil {
+		return nil, err
+	}
+	ws.algorithm = name
+	return starlark.None, nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// fileHashCacheName is the name of the file hash cache in the cache
+// directory.
+const fileHashCacheName = "file-hashes.json"
+
+// racyInterval is how recently a file may have been modified for its hash to
+// be cached. A file that is modified again within the resolution of its
+// file system's timestamps keeps the same modification time, so hashes of
+// recently modified files aren't trusted.
+const racyInterval = 2 * time.Second
+
+// fileHashCache remembers the content hashes of source files so that files
+// which haven't changed since they were last hashed don't need to be read
+// again. A file is assumed to be unchanged if its size, modification time
+// and inode are the same as when it was hashed. It is safe for concurrent
+// use.
+type fileHashCache struct {
+	path    string
+	lock    sync.Mutex
+	entries map[string]fileHashEntry
+	dirty   bool
+
+	// used holds the paths which have been hashed since the cache was
+	// loaded (see `prune()`).
+	used map[string]bool
+}
+
+// fileHashEntry is the cached hash of the file at a path.
+type fileHashEntry struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+	Inode   uint64 `json:"inode"`
+	Hash    []byte `json:"hash"`
+}
+
+func newFileHashEntry(fi os.FileInfo, hash []byte) fileHashEntry {
+	return fileHashEntry{
+		Size:    fi.Size(),
+		ModTime: fi.ModTime().UnixNano(),
+		Inode:   fileInode(fi),
+		Hash:    hash,
+	}
+}
+
+// matches returns true if the file described by `fi` is unchanged since the
+// entry was cached.
+func (entry fileHashEntry) matches(fi os.FileInfo) bool {
+	return entry.Size == fi.Size() &&
+		entry.ModTime == fi.ModTime().UnixNano() &&
+		entry.Inode == fileInode(fi)
+}
+
+// loadFileHashCache reads the file hash cache at `path`. A missing or
+// unreadable cache is treated as empty since it can always be rebuilt.
+func loadFileHashCache(path string) *fileHashCache {
+	fhc := &fileHashCache{
+		path:    path,
+		entries: map[string]fileHashEntry{},
+		used:    map[string]bool{},
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fhc
+	}
+	if err := json.Unmarshal(data, &fhc.entries); err != nil {
+		fhc.entries = map[string]fileHashEntry{}
+	}
+	return fhc
+}
+
+// save prunes stale entries (see `prune()`) and writes the cache back to disk
+// if it has changed. The cache is written to a temporary file and renamed
+// into place so concurrent builds never read a partially written cache.
+func (fhc *fileHashCache) save() error {
+	fhc.lock.Lock()
+	defer fhc.lock.Unlock()
+	fhc.prune()
+	if !fhc.dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(fhc.entries)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(fhc.path), fileHashCacheName)
+	if err != nil {
+		return errors.Wrap(err, "Saving file hash cache")
+	}
+	if _, err := tmp.Write(data); err != nil {
+		properClose(tmp)
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "Saving file hash cache")
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "Saving file hash cache")
+	}
+	if err := os.Rename(tmp.Name(), fhc.path); err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "Saving file hash cache")
+	}
+	fhc.dirty = false
+	return nil
+}
+
+// prune removes the entries which weren't looked up since the cache was
+// loaded and whose files have since been deleted or modified, so that the
+// cache doesn't keep growing as files are renamed, edited and removed. The
+// entries of unchanged files are kept even if they weren't looked up, since
+// the cache is shared by every target and workspace. The caller must hold
+// the lock.
+func (fhc *fileHashCache) prune() {
+	for path, entry := range fhc.entries {
+		if fhc.used[path] {
+			continue
+		}
+		if fi, err := os.Lstat(path); err != nil || !entry.matches(fi) {
+			delete(fhc.entries, path)
+			fhc.dirty = true
+		}
+	}
+}
+
+// forget removes the cached hash of the file at `path`, if any.
+func (fhc *fileHashCache) forget(path string) {
+	if fhc == nil {
+		return
+	}
+	fhc.lock.Lock()
+	defer fhc.lock.Unlock()
+	if _, found := fhc.entries[path]; found {
+		delete(fhc.entries, path)
+		fhc.dirty = true
+	}
+}
+
+// hashFileContents returns the hash of the contents of the file at `path`,
+// reading the file only if the cache doesn't have an up-to-date hash for it.
+// A nil cache always reads the file.
+func (fhc *fileHashCache) hashFileContents(
+	path string,
+	fi os.FileInfo,
+	newHasher func() hash.Hash,
+) ([]byte, error) {
+	if fhc != nil {
+		fhc.lock.Lock()
+		fhc.used[path] = true
+		cached, found := fhc.entries[path]
+		fhc.lock.Unlock()
+		if found && cached.matches(fi) {
+			return cached.Hash, nil
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer properClose(f)
+	hasher := newHasher()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return nil, errors.Wrapf(err, "Hashing file '%s'", path)
+	}
+	hash := hasher.Sum(nil)
+
+	if fhc != nil && time.Since(fi.ModTime()) > racyInterval {
+		fhc.lock.Lock()
+		fhc.entries[path] = newFileHashEntry(fi, hash)
+		fhc.dirty = true
+		fhc.lock.Unlock()
+	}
+	return hash, nil
+}
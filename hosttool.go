@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"hash"
+	"hash/adler32"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// Host tools make a build's dependencies on programs installed on the host
+// explicit. A host tool freezes into a derivation whose output is a symlink
+// to the resolved binary, so rules can use it like any other tool target
+// (e.g., `$cachePath/${GoTool}`), and whose hash covers the binary's contents
+// and the output of its probe command.
+
+//
+// HostTool
+//
+
+// Type implements the starlark.Value.Type() method.
+func (ht *HostTool) Type() string { return "HostTool" }
+
+// Freeze implements the starlark.Value.Freeze() method.
+func (ht *HostTool) Freeze() {}
+
+// Truth implements the starlark.Value.Truth() method.
+func (ht *HostTool) Truth() starlark.Bool { return ht != nil }
+
+// Hash32 implements the Arg.Hash32() method.
+func (ht *HostTool) Hash32(h hash.Hash32) {
+	h.Write([]byte(ht.Name))
+	for _, arg := range ht.Probe {
+		h.Write([]byte(arg))
+	}
+	for _, path := range ht.Paths {
+		h.Write([]byte(path))
+	}
+}
+
+// Hash implements the starlark.Value.Hash() method.
+func (ht *HostTool) Hash() (uint32, error) {
+	h := adler32.New()
+	ht.Hash32(h)
+	return h.Sum32(), nil
+}
+
+// Attr implements the starlark.HasAttrs.Attr() method.
+func (ht *HostTool) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "name":
+		return starlark.String(ht.Name), nil
+	case "probe":
+		return stringsToList(ht.Probe), nil
+	case "paths":
+		return stringsToList(ht.Paths), nil
+	default:
+		return nil, nil
+	}
+}
+
+// AttrNames implements the starlark.HasAttrs.AttrNames() method.
+func (ht *HostTool) AttrNames() []string {
+	return []string{"name", "paths", "probe"}
+}
+
+// CompareSameType implements the starlark.Comparable.CompareSameType()
+// method.
+func (ht *HostTool) CompareSameType(
+	op syntax.Token,
+	y starlark.Value,
+	depth int,
+) (bool, error) {
+	return compareEquality(op, ht, y, func() (bool, error) {
+		other := y.(*HostTool)
+		return ht.Name == other.Name &&
+			stringsEqual(ht.Probe, other.Probe) &&
+			stringsEqual(ht.Paths, other.Paths), nil
+	})
+}
+
+// starlarkHostTool implements the `host_tool(name, probe=[], paths=[])`
+// builtin.
+func starlarkHostTool(
+	args starlark.Tuple,
+	kwargs []starlark.Tuple,
+) (starlark.Value, error) {
+	var name string
+	var probe, paths *starlark.List
+	if err := starlark.UnpackArgs(
+		"host_tool",
+		args,
+		kwargs,
+		"name",
+		&name,
+		"probe?",
+		&probe,
+		"paths?",
+		&paths,
+	); err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return nil, errors.Errorf("Argument 'name' must not be empty")
+	}
+
+	tool := HostTool{Name: name}
+	if probe != nil {
+		var err error
+		if tool.Probe, err = starlarkStringList(probe); err != nil {
+			return nil, errors.Wrap(err, "Argument 'probe'")
+		}
+	}
+	if paths != nil {
+		var err error
+		if tool.Paths, err = starlarkStringList(paths); err != nil {
+			return nil, errors.Wrap(err, "Argument 'paths'")
+		}
+	}
+	return &tool, nil
+}
+
+//
+// Freezing
+//
+
+func (ht *HostTool) freezeArg(f *freezer) (ArgValue, error) {
+	key := ht.String()
+	if argValue, found := f.hostTools[key]; found {
+		return argValue, nil
+	}
+
+	binary, err := ht.lookPath(ht.Name)
+	if err != nil {
+		return ArgValue{}, err
+	}
+
+	// The binary's path is its derivation's arg, so it's part of the hash
+	// too: the same binary installed elsewhere is a different derivation.
+	hasher := f.newHasher()
+	writeLengthPrefixed(hasher, []byte(ht.Name))
+	writeLengthPrefixed(hasher, []byte(binary))
+	if err := hashHostFile(binary, hasher); err != nil {
+		return ArgValue{}, errors.Wrapf(err, "Hashing host tool '%s'", binary)
+	}
+
+	var probeOutput string
+	if len(ht.Probe) > 0 {
+		if probeOutput, err = ht.probe(); err != nil {
+			return ArgValue{}, err
+		}
+		hasher.Write([]byte(probeOutput))
+	}
+
+	hash := hasher.Sum(nil)
+	d := &Derivation{
+		ID:            derivationID(hash, ht.Name),
+		Hash:          hash,
+		HashAlgorithm: f.algorithm,
+		Builder:       nativeBuilderPrefix + "host_tool",
+		Args:          []string{binary, probeOutput},
+		Env:           []string{},
+	}
+	argValue := ArgValue{
+		Value:       d.ID,
+		Hash:        hash,
+		Derivations: []*Derivation{d},
+	}
+	if f.hostTools == nil {
+		f.hostTools = map[string]ArgValue{}
+	}
+	f.hostTools[key] = argValue
+	return argValue, nil
+}
+
+// lookPath resolves a binary name against the tool's paths and then `$PATH`.
+// The result is an absolute path with symlinks resolved, so the hash reflects
+// the binary which will actually run.
+func (ht *HostTool) lookPath(name string) (string, error) {
+	for _, dir := range ht.Paths {
+		candidate := filepath.Join(dir, name)
+		if fi, err := os.Stat(candidate); err == nil &&
+			fi.Mode().IsRegular() &&
+			fi.Mode()&0111 != 0 {
+			return filepath.EvalSymlinks(candidate)
+		}
+	}
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return "", errors.Wrapf(err, "Locating host tool '%s'", name)
+	}
+	if path, err = filepath.Abs(path); err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(path)
+}
+
+// probe runs the tool's probe command and returns its combined output.
+func (ht *HostTool) probe() (string, error) {
+	binary, err := ht.lookPath(ht.Probe[0])
+	if err != nil {
+		return "", err
+	}
+	var output bytes.Buffer
+	cmd := exec.Command(binary, ht.Probe[1:]...)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		return "", errors.Wrapf(
+			err,
+			"Probing host tool '%s': OUTPUT: '%s'",
+			ht.Name,
+			&output,
+		)
+	}
+	return output.String(), nil
+}
+
+func hashHostFile(path string, w io.Writer) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer properClose(file)
+	_, err = io.Copy(w, file)
+	return err
+}
+
+//
+// Building
+//
+
+// buildHostTool expects the args `[path, probeOutput]`. The probe output is
+// only included for the sake of the derivation's description.
+func buildHostTool(_ string, args []string, out string) error {
+	if len(args) != 2 {
+		return errors.Errorf(
+			"Expected args [path, probeOutput]; found %d",
+			len(args),
+		)
+	}
+	return os.Symlink(args[0], out)
+}
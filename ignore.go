@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bmatcuk/doublestar"
+	"github.com/pkg/errors"
+)
+
+// ignoreFileNames are the names of the files whose patterns are honored by
+// glob groups with `IgnoreFiles` set. `.g8rignore` is read after `.gitignore`
+// so its rules take precedence.
+var ignoreFileNames = []string{".gitignore", ".g8rignore"}
+
+// ignoreRule is a single parsed line from an ignore file.
+type ignoreRule struct {
+	pattern  string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// ignoreMatcher decides whether paths in a package are ignored according to
+// the `.gitignore` and `.g8rignore` files in the package root and its
+// subdirectories. It follows gitignore semantics: rules in a directory apply
+// to paths beneath that directory, later rules override earlier ones, and a
+// path inside an ignored directory can't be re-included.
+type ignoreMatcher struct {
+	root  string
+	rules map[string][]ignoreRule
+}
+
+func newIgnoreMatcher(root string) *ignoreMatcher {
+	return &ignoreMatcher{root: root, rules: map[string][]ignoreRule{}}
+}
+
+// ignored returns true if the file or directory at `relPath` (relative to the
+// package root) is ignored.
+func (im *ignoreMatcher) ignored(relPath string) (bool, error) {
+	fi, err := os.Lstat(filepath.Join(im.root, relPath))
+	if err != nil {
+		return false, err
+	}
+
+	// Walk down from the top-most directory so that an ignored parent
+	// directory ignores everything beneath it.
+	parts := strings.Split(filepath.ToSlash(relPath), "/")
+	for i := 1; i <= len(parts); i++ {
+		isDir := i < len(parts) || fi.IsDir()
+
+		// Git never tracks its own metadata directory.
+		if isDir && parts[i-1] == ".git" {
+			return true, nil
+		}
+
+		ignored, err := im.match(parts[:i], isDir)
+		if err != nil {
+			return false, err
+		}
+		if ignored {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// match applies the rules from every directory above the path described by
+// `parts` and returns the verdict of the last matching rule.
+func (im *ignoreMatcher) match(parts []string, isDir bool) (bool, error) {
+	ignored := false
+	for depth := 0; depth < len(parts); depth++ {
+		dir := strings.Join(parts[:depth], "/")
+		rules, err := im.load(dir)
+		if err != nil {
+			return false, err
+		}
+
+		rel := strings.Join(parts[depth:], "/")
+		base := parts[len(parts)-1]
+		for _, rule := range rules {
+			if rule.dirOnly && !isDir {
+				continue
+			}
+			subject := base
+			if rule.anchored {
+				subject = rel
+			}
+			matched, err := doublestar.Match(rule.pattern, subject)
+			if err != nil {
+				return false, errors.Wrapf(
+					err,
+					"Matching ignore pattern '%s'",
+					rule.pattern,
+				)
+			}
+			if matched {
+				ignored = !rule.negate
+			}
+		}
+	}
+	return ignored, nil
+}
+
+// load reads and caches the rules for the directory `dir` (relative to the
+// package root).
+func (im *ignoreMatcher) load(dir string) ([]ignoreRule, error) {
+	if rules, found := im.rules[dir]; found {
+		return rules, nil
+	}
+
+	var rules []ignoreRule
+	for _, name := range ignoreFileNames {
+		path := filepath.Join(im.root, filepath.FromSlash(dir), name)
+		fileRules, err := parseIgnoreFile(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Reading ignore file '%s'", path)
+		}
+		rules = append(rules, fileRules...)
+	}
+	im.rules[dir] = rules
+	return rules, nil
+}
+
+// parseIgnoreFile parses the rules from an ignore file. A missing file has no
+// rules.
+func parseIgnoreFile(path string) ([]ignoreRule, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer properClose(file)
+
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if rule, ok := parseIgnoreRule(scanner.Text()); ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, scanner.Err()
+}
+
+// parseIgnoreRule parses a single line from an ignore file. It returns false
+// for blank lines and comments.
+func parseIgnoreRule(line string) (ignoreRule, bool) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false
+	}
+
+	var rule ignoreRule
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+
+	// A pattern containing a slash anywhere but at the end is relative to the
+	// directory containing the ignore file; otherwise it matches a file or
+	// directory name at any depth.
+	if strings.Contains(line, "/") {
+		rule.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	rule.pattern = line
+	return rule, line != ""
+}
@@ -0,0 +1,11 @@
+package main
+
+import "os"
+
+// fileInode returns 0 since Windows doesn't report file IDs in
+// `os.FileInfo`; the file hash cache relies on sizes and modification times.
+func fileInode(fi os.FileInfo) uint64 { return 0 }
+
+// fileLinks returns 0 (unknown) since Windows doesn't report link counts in
+// `os.FileInfo`.
+func fileLinks(fi os.FileInfo) uint64 { return 0 }
@@ -1,12 +1,15 @@
 package main
 
 import (
-	"crypto/sha256"
+	"flag"
 	"fmt"
-	"hash"
 	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
 
 	"github.com/pkg/errors"
 	"go.starlark.net/starlark"
@@ -28,27 +31,111 @@ func main() {
 		panic(err)
 	}
 
-	cache, err := FileSystemCacheFromTempDir(cacheDir)
+	toolchains := mapFlag{}
+	flag.Var(
+		toolchains,
+		"toolchain",
+		"Use the `type=module:global` toolchain for every toolchain(type) "+
+			"reference in the build (may be repeated)",
+	)
+	defines := mapFlag{}
+	flag.Var(
+		defines,
+		"define",
+		"Set the build setting `name=value` for setting() and select() "+
+			"(may be repeated)",
+	)
+	flag.Usage = func() {
+		fmt.Fprintf(
+			flag.CommandLine.Output(),
+			"Usage: %s [flags] [module] [target]\n"+
+				"       %s fetch\n"+
+				"       %s cache stats\n"+
+				"       %s cache migrate\n"+
+				"       %s resolve <prefix>\n",
+			os.Args[0],
+			os.Args[0],
+			os.Args[0],
+			os.Args[0],
+			os.Args[0],
+		)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	// Git packages are fetched into the cache directory, but outside of the
+	// content-addressed store.
+	gitDir := filepath.Join(cacheDir, gitCacheDirName)
+	packageHashes := loadFileHashCache(
+		filepath.Join(cacheDir, packageHashCacheName),
+	)
+
+	if flag.Arg(0) == "fetch" {
+		if err := fetch(root, gitDir, packageHashes); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	// Each hash algorithm has its own directory in the cache directory.
+	ws, packages, err := loadRootWorkspace(root)
 	if err != nil {
 		panic(err)
 	}
+	algorithm := ws.hashAlgorithm()
+	cache, err := FileSystemCacheFromTempDir(
+		filepath.Join(cacheDir, algorithm.Name),
+		algorithm.New,
+	)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := cache.Close(); err != nil {
+			log.Printf("WARN failed to remove temporary directory: %v", err)
+		}
+	}()
+
+	if flag.Arg(0) == "cache" {
+		if err := cacheCommand(
+			cacheDir,
+			cache,
+			flag.Args()[1:],
+		); err != nil {
+			panic(err)
+		}
+		return
+	}
+	if flag.Arg(0) == "resolve" {
+		if err := resolveID(cache, flag.Args()[1:]); err != nil {
+			panic(err)
+		}
+		return
+	}
+	warnLegacyCache(cacheDir)
 
 	module := "."
-	if len(os.Args) > 1 {
-		module = os.Args[1]
+	if flag.NArg() > 0 {
+		module = flag.Arg(0)
 	}
 	target := "__DEFAULT__"
-	if len(os.Args) > 2 {
-		target = os.Args[2]
+	if flag.NArg() > 1 {
+		target = flag.Arg(1)
 	}
 
 	if err := buildTarget(
-		sha256.New,
+		algorithm,
 		cache,
-		cacheDir, // use the cache dir as the base dir for temp dirs
+		cache.tmpDir, // build in the cache's temp dir (on its file system)
 		root,
+		gitDir,
+		packageHashes,
+		ws,
+		packages,
 		module,
 		target,
+		toolchains,
+		defines,
 	); err != nil {
 		if err, ok := err.(*starlark.EvalError); ok {
 			panic(err.Backtrace())
@@ -58,19 +145,42 @@ func main() {
 }
 
 func buildTarget(
-	newHash func() hash.Hash,
+	algorithm hashAlgorithm,
 	cache *FileSystemCache,
 	tmpDirBase string,
 	root string,
+	gitDir string,
+	packageHashes *fileHashCache,
+	ws *workspace,
+	packages map[string]string,
 	module string,
 	target string,
+	toolchainOverrides map[string]string,
+	defines map[string]string,
 ) error {
-	packages, err := loadPackages(root)
+	scopes, err := resolvePackages(
+		root,
+		gitDir,
+		packageHashes,
+		ws,
+		packages,
+		false,
+	)
+	if err != nil {
+		return err
+	}
+	if err := packageHashes.save(); err != nil {
+		return err
+	}
+
+	load := makeLoader(root, scopes)
+	overrides, err := resolveToolchainOverrides(load, toolchainOverrides)
 	if err != nil {
-		return errors.Wrap(err, "Loading packages")
+		return err
 	}
+	toolchains := ws.resolveToolchains(runtime.GOOS, runtime.GOARCH, overrides)
 
-	globals, err := execModule(module, makeLoader(root, packages))
+	globals, err := execModule(module, load)
 	if err != nil {
 		return err
 	}
@@ -89,9 +199,26 @@ func buildTarget(
 		)
 	}
 
-	d, err := FreezeTarget(root, newHash, cache, t)
-	if err != nil {
-		return errors.Wrapf(err, "Freezing target '%s'", t.Name)
+	fileHashes := loadFileHashCache(
+		filepath.Join(cache.root, fileHashCacheName),
+	)
+	d, freezeErr := FreezeTarget(
+		root,
+		algorithm,
+		cache,
+		fileHashes,
+		toolchains,
+		buildSettings(runtime.GOOS, runtime.GOARCH, defines),
+		t,
+	)
+
+	// Save the file hash cache even if freezing failed, since stale entries
+	// may have been dropped.
+	if err := fileHashes.save(); err != nil {
+		return err
+	}
+	if freezeErr != nil {
+		return errors.Wrapf(freezeErr, "Freezing target '%s'", t.Name)
 	}
 
 	if err := BuildRecursive(cache, d, tmpDirBase); err != nil {
@@ -102,6 +229,132 @@ func buildTarget(
 	return nil
 }
 
+// fetch fetches the packages declared by the workspace at `root` and
+// their dependencies.
+func fetch(root string, gitDir string, packageHashes *fileHashCache) error {
+	if _, _, err := loadWorkspacePackages(
+		root,
+		gitDir,
+		packageHashes,
+		true,
+	); err != nil {
+		return err
+	}
+	return packageHashes.save()
+}
+
+// cacheCommand runs a `g8r cache` subcommand against the workspace's cache
+// in the cache directory at `cacheDir`.
+func cacheCommand(
+	cacheDir string,
+	cache *FileSystemCache,
+	args []string,
+) error {
+	if len(args) == 1 {
+		switch args[0] {
+		case "stats":
+			stats, err := cache.Stats()
+			if err != nil {
+				return errors.Wrap(err, "Computing cache stats")
+			}
+			return stats.write(os.Stdout)
+		case "migrate":
+			migrated, removed, err := migrateLegacyCache(cacheDir)
+			if err != nil {
+				return errors.Wrap(err, "Migrating cache")
+			}
+			fmt.Printf(
+				"Migrated %d files to %s and removed %d unreachable entries\n",
+				migrated,
+				filepath.Join(cacheDir, defaultHashAlgorithm),
+				removed,
+			)
+			return nil
+		}
+	}
+	return errors.Errorf("Usage: g8r cache stats|migrate")
+}
+
+// resolveID prints the path of the cache entry whose ID (or source snapshot
+// name) starts with the prefix in `args`, followed by its derivation record,
+// if it has one.
+func resolveID(cache *FileSystemCache, args []string) error {
+	if len(args) != 1 || args[0] == "" {
+		return errors.Errorf("Usage: g8r resolve <prefix>")
+	}
+	prefix := args[0]
+	names, err := cache.Resolve(prefix)
+	if err != nil {
+		return errors.Wrapf(err, "Resolving '%s'", prefix)
+	}
+	switch len(names) {
+	case 0:
+		return errors.Errorf("No cache entry matches '%s'", prefix)
+	case 1:
+		fmt.Println(filepath.Join(cache.root, names[0]))
+		record, err := cache.DerivationRecord(names[0])
+		if err != nil {
+			return err
+		}
+		if record != nil {
+			return record.write(os.Stdout)
+		}
+		return nil
+	default:
+		return errors.Errorf(
+			"Prefix '%s' is ambiguous; it matches:\n    %s",
+			prefix,
+			strings.Join(names, "\n    "),
+		)
+	}
+}
+
+// loadWorkspacePackages evaluates the WORKSPACE file at `root` and returns
+// the workspace along with the scopes of its packages (see
+// `resolvePackages()`). The WORKSPACE file itself can only load modules from
+// the packages in `.vendor`.
+func loadWorkspacePackages(
+	root string,
+	gitDir string,
+	packageHashes *fileHashCache,
+	fetching bool,
+) (*workspace, packageScopes, error) {
+	ws, packages, err := loadRootWorkspace(root)
+	if err != nil {
+		return nil, nil, err
+	}
+	scopes, err := resolvePackages(
+		root,
+		gitDir,
+		packageHashes,
+		ws,
+		packages,
+		fetching,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ws, scopes, nil
+}
+
+// loadRootWorkspace evaluates the WORKSPACE file at `root` and returns the
+// workspace along with the packages in `.vendor`, without resolving the
+// workspace's packages.
+func loadRootWorkspace(root string) (*workspace, map[string]string, error) {
+	packages, err := loadPackages(root)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Loading packages")
+	}
+	ws, err := loadWorkspace(
+		root,
+		makeLoader(root, vendoredScopes(root, packages)),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ws, packages, nil
+}
+
 func findRoot(dir string) (string, error) {
 	if dir == "." {
 		wd, err := os.Getwd()
@@ -157,7 +410,39 @@ func loadPackages(root string) (map[string]string, error) {
 	return packages, nil
 }
 
+// mapFlag collects repeated `key=value` flags. It implements the flag.Value
+// interface.
+type mapFlag map[string]string
+
+func (mf mapFlag) String() string {
+	pairs := make([]string, 0, len(mf))
+	for key, value := range mf {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (mf mapFlag) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i < 1 {
+		return errors.Errorf("Expected 'key=value'; found '%s'", value)
+	}
+	mf[value[:i]] = value[i+1:]
+	return nil
+}
+
 const (
 	workspaceFileName   = "WORKSPACE"
 	vendorDirectoryName = ".vendor"
+
+	// gitCacheDirName is the name of the directory in the cache directory
+	// where git packages are fetched.
+	gitCacheDirName = "git"
+
+	// packageHashCacheName is the name of the file in the cache directory
+	// which caches the sha256 hashes of the files in `.vendor` (see
+	// `hashPackageTree()`). It's separate from the caches of source file
+	// hashes since those use the workspace's hash algorithm.
+	packageHashCacheName = "package-hashes.json"
 )
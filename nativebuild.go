@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.starlark.net/starlark"
+)
+
+// Native builders are derivation builders implemented in Go rather than as
+// external programs. They run inside `Build()` without spawning a process,
+// but otherwise behave like any other builder: their targets are frozen,
+// hashed and cached like any other target and they can be used as arguments
+// to other targets.
+
+// nativeBuilderPrefix prefixes the `Builder` of targets whose builder is
+// implemented in Go.
+const nativeBuilderPrefix = "g8r:"
+
+// nativeBuilder builds a derivation's output at `out` given its frozen args.
+// `cachePath` is the root of the build cache against which cache-relative
+// args are resolved.
+type nativeBuilder func(cachePath string, args []string, out string) error
+
+// nativeBuilders maps builder names (including the prefix) to their
+// implementations.
+var nativeBuilders = map[string]nativeBuilder{
+	nativeBuilderPrefix + "write_file": buildWriteFile,
+	nativeBuilderPrefix + "directory":  buildDirectory,
+	nativeBuilderPrefix + "merge":      buildMerge,
+	nativeBuilderPrefix + "tar":        buildTar,
+	nativeBuilderPrefix + "zip":        buildZip,
+	nativeBuilderPrefix + "extract":    buildExtract,
+	nativeBuilderPrefix + "oci_image":  buildOCIImage,
+	nativeBuilderPrefix + "host_tool":  buildHostTool,
+}
+
+//
+// write_file
+//
+
+// starlarkWriteFile implements the `write_file(name, content,
+// executable=False)` builtin, which returns a target whose output is a single
+// file with the given contents. `content` may be a string or a `sub()`.
+func starlarkWriteFile(
+	args starlark.Tuple,
+	kwargs []starlark.Tuple,
+) (starlark.Value, error) {
+	var name string
+	var content starlark.Value
+	var executable bool
+	if err := starlark.UnpackArgs(
+		"write_file",
+		args,
+		kwargs,
+		"name",
+		&name,
+		"content",
+		&content,
+		"executable?",
+		&executable,
+	); err != nil {
+		return nil, err
+	}
+
+	contentArg, err := starlarkValueToContentArg(content)
+	if err != nil {
+		return nil, errors.Wrap(err, "Argument 'content'")
+	}
+
+	mode := os.FileMode(0644)
+	if executable {
+		mode = 0755
+	}
+	return &Target{
+		Name:    name,
+		Builder: nativeBuilderPrefix + "write_file",
+		Args:    []Arg{String(formatMode(mode)), contentArg},
+		Env:     []string{},
+	}, nil
+}
+
+// buildWriteFile expects the args `[mode, content]`.
+func buildWriteFile(_ string, args []string, out string) error {
+	if len(args) != 2 {
+		return errors.Errorf("Expected args [mode, content]; found %d", len(args))
+	}
+	mode, err := parseMode(args[0])
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(out, []byte(args[1]), mode)
+}
+
+//
+// directory
+//
+
+const (
+	// directoryEntryContent is a directory entry whose arg is the literal
+	// contents of the file.
+	directoryEntryContent = "content"
+
+	// directoryEntryCopy is a directory entry whose arg is a cache path
+	// (file or directory) to copy into the output.
+	directoryEntryCopy = "copy"
+
+	// directoryEntryLink is a directory entry whose arg is a cache path to
+	// symlink to from the output.
+	directoryEntryLink = "link"
+)
+
+// starlarkDirectory implements the `directory(name, files={...})` builtin,
+// which returns a target whose output is a directory. The keys of `files`
+// are paths relative to the output directory; string (and `sub()`) values
+// become the contents of the file at that path, while targets, paths and
+// globs are copied into the directory.
+func starlarkDirectory(
+	args starlark.Tuple,
+	kwargs []starlark.Tuple,
+) (starlark.Value, error) {
+	var name string
+	var files *starlark.Dict
+	if err := starlark.UnpackArgs(
+		"directory",
+		args,
+		kwargs,
+		"name",
+		&name,
+		"files",
+		&files,
+	); err != nil {
+		return nil, err
+	}
+
+	entryArgs, err := directoryEntryArgs(files)
+	if err != nil {
+		return nil, err
+	}
+	return &Target{
+		Name:    name,
+		Builder: nativeBuilderPrefix + "directory",
+		Args:    entryArgs,
+		Env:     []string{},
+	}, nil
+}
+
+// directoryEntryArgs converts a dict of directory entries into flat
+// `[kind, relpath, value, ...]` args, sorted by path so that the target hash
+// doesn't depend on dict order.
+func directoryEntryArgs(entries *starlark.Dict) ([]Arg, error) {
+	items := entries.Items()
+	sort.Slice(items, func(i, j int) bool {
+		return items[i][0].String() < items[j][0].String()
+	})
+
+	args := make([]Arg, 0, len(items)*3)
+	for _, item := range items {
+		relPath, ok := item[0].(starlark.String)
+		if !ok {
+			return nil, errors.Errorf(
+				"TypeError: entry keys must be str; found %s",
+				item[0].Type(),
+			)
+		}
+		if err := validateEntryPath(string(relPath)); err != nil {
+			return nil, err
+		}
+
+		kind := directoryEntryCopy
+		var value Arg
+		switch x := item[1].(type) {
+		case starlark.String:
+			kind, value = directoryEntryContent, String(x)
+		case *Sub:
+			kind, value = directoryEntryContent, x
+		default:
+			arg, err := starlarkValueToArg(x)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Entry '%s'", relPath)
+			}
+			value = arg
+		}
+		args = append(args, String(kind), String(relPath), value)
+	}
+	return args, nil
+}
+
+// validateEntryPath makes sure an entry can't be written outside of the
+// output directory.
+func validateEntryPath(relPath string) error {
+	if relPath == "" ||
+		filepath.IsAbs(relPath) ||
+		hasParentElement(relPath) {
+		return errors.Errorf(
+			"Entry path '%s' must be relative to the output directory",
+			relPath,
+		)
+	}
+	return nil
+}
+
+// hasParentElement returns true if any element of the slash-separated path
+// is `..`. (Names which merely contain `..`, like `v1..2.txt`, are fine.)
+func hasParentElement(path string) bool {
+	for _, element := range strings.Split(filepath.ToSlash(path), "/") {
+		if element == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// buildDirectory expects args in `[kind, relpath, value, ...]` triples.
+func buildDirectory(cachePath string, args []string, out string) error {
+	if len(args)%3 != 0 {
+		return errors.Errorf(
+			"Expected args in [kind, path, value] triples; found %d args",
+			len(args),
+		)
+	}
+	if err := os.MkdirAll(out, 0755); err != nil {
+		return err
+	}
+
+	for i := 0; i < len(args); i += 3 {
+		kind, relPath, value := args[i], args[i+1], args[i+2]
+		if err := validateEntryPath(relPath); err != nil {
+			return err
+		}
+		dst := filepath.Join(out, relPath)
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+
+		switch kind {
+		case directoryEntryContent:
+			if err := ioutil.WriteFile(dst, []byte(value), 0644); err != nil {
+				return errors.Wrapf(err, "Writing entry '%s'", relPath)
+			}
+		case directoryEntryCopy:
+			if err := copyTree(filepath.Join(cachePath, value), dst); err != nil {
+				return errors.Wrapf(err, "Copying entry '%s'", relPath)
+			}
+		case directoryEntryLink:
+			if err := os.Symlink(filepath.Join(cachePath, value), dst); err != nil {
+				return errors.Wrapf(err, "Linking entry '%s'", relPath)
+			}
+		default:
+			return errors.Errorf("Unknown directory entry kind '%s'", kind)
+		}
+	}
+	return nil
+}
+
+//
+// merge
+//
+
+// starlarkMerge implements the `merge(name, srcs)` builtin, which returns a
+// target whose output is a directory containing the union of the `srcs`
+// directories. Files may appear in more than one source only if their
+// contents are identical, which makes it possible to compose directory trees
+// with overlapping structure (e.g., per-module Go module caches).
+func starlarkMerge(
+	args starlark.Tuple,
+	kwargs []starlark.Tuple,
+) (starlark.Value, error) {
+	var name string
+	var srcs *starlark.List
+	if err := starlark.UnpackArgs(
+		"merge",
+		args,
+		kwargs,
+		"name",
+		&name,
+		"srcs",
+		&srcs,
+	); err != nil {
+		return nil, err
+	}
+
+	srcArgs := make([]Arg, srcs.Len())
+	for i := range srcArgs {
+		arg, err := starlarkValueToArtifactArg(srcs.Index(i))
+		if err != nil {
+			return nil, errors.Wrapf(err, "Argument 'srcs[%d]'", i)
+		}
+		srcArgs[i] = arg
+	}
+	return &Target{
+		Name:    name,
+		Builder: nativeBuilderPrefix + "merge",
+		Args:    srcArgs,
+		Env:     []string{},
+	}, nil
+}
+
+// buildMerge expects each arg to be the cache path of a directory to merge.
+func buildMerge(cachePath string, args []string, out string) error {
+	if err := os.MkdirAll(out, 0755); err != nil {
+		return err
+	}
+	for _, src := range args {
+		if err := mergeTree(filepath.Join(cachePath, src), out); err != nil {
+			return errors.Wrapf(err, "Merging '%s'", src)
+		}
+	}
+	return nil
+}
+
+// mergeTree copies the directory tree at `src` into `dst`. Files which already
+// exist in `dst` are left in place if they are identical to the ones in `src`;
+// otherwise an error is returned.
+func mergeTree(src, dst string) error {
+	return filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, relPath)
+		if fi.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+
+		existing, err := os.Lstat(target)
+		if os.IsNotExist(err) {
+			return copyTree(path, target)
+		}
+		if err != nil {
+			return err
+		}
+		same, err := sameFile(path, fi, target, existing)
+		if err != nil {
+			return err
+		}
+		if !same {
+			return errors.Errorf("Conflicting file '%s'", relPath)
+		}
+		return nil
+	})
+}
+
+// sameFile reports whether two files (or symlinks) have the same type,
+// permissions and contents. Write permissions are ignored since cached files
+// are read-only while the files in the output directory are still writable.
+func sameFile(
+	a string,
+	aInfo os.FileInfo,
+	b string,
+	bInfo os.FileInfo,
+) (bool, error) {
+	if (aInfo.Mode()^bInfo.Mode())&^0222 != 0 {
+		return false, nil
+	}
+	if aInfo.Mode()&os.ModeSymlink != 0 {
+		aLink, err := os.Readlink(a)
+		if err != nil {
+			return false, err
+		}
+		bLink, err := os.Readlink(b)
+		if err != nil {
+			return false, err
+		}
+		return aLink == bLink, nil
+	}
+	if aInfo.Size() != bInfo.Size() {
+		return false, nil
+	}
+	aData, err := ioutil.ReadFile(a)
+	if err != nil {
+		return false, err
+	}
+	bData, err := ioutil.ReadFile(b)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(aData, bData), nil
+}
+
+//
+// helpers
+//
+
+// starlarkValueToContentArg converts a value into an arg whose frozen value
+// is the contents of a file.
+func starlarkValueToContentArg(v starlark.Value) (Arg, error) {
+	switch x := v.(type) {
+	case starlark.String:
+		return String(x), nil
+	case *Sub:
+		return x, nil
+	default:
+		return nil, errors.Errorf(
+			"TypeError: expected str or Sub; found %s",
+			v.Type(),
+		)
+	}
+}
+
+// copyTree copies the file or directory at `src` to `dst`, preserving file
+// modes (but not ownership or timestamps).
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, relPath)
+
+		switch {
+		case fi.IsDir():
+			return os.MkdirAll(target, 0755)
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case fi.Mode().IsRegular():
+			return copyFile(path, target, fi.Mode().Perm())
+		default:
+			return errors.Errorf(
+				"Can't copy '%s': unsupported file type %s",
+				path,
+				fi.Mode().Type(),
+			)
+		}
+	})
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer properClose(in)
+
+	// Output files must be writable until the build finishes; `Build()`
+	// makes them immutable afterwards.
+	out, err := os.OpenFile(
+		dst,
+		os.O_WRONLY|os.O_CREATE|os.O_TRUNC,
+		mode|0200,
+	)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		properClose(out)
+		return err
+	}
+	return out.Close()
+}
+
+func formatMode(mode os.FileMode) string {
+	return "0" + strconv.FormatUint(uint64(mode.Perm()), 8)
+}
+
+func parseMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Parsing file mode '%s'", s)
+	}
+	return os.FileMode(mode), nil
+}
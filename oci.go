@@ -0,0 +1,592 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.starlark.net/starlark"
+)
+
+// `oci_image()` builds an OCI image layout directory
+// (https://github.com/opencontainers/image-spec/blob/master/image-layout.md)
+// natively, without a Docker daemon. Each layer is a reproducible gzipped tar
+// of an artifact, and the config is written with fixed timestamps, so the
+// same inputs always produce the same image digest.
+
+const (
+	ociIndexMediaType    = "application/vnd.oci.image.index.v1+json"
+	ociManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	ociConfigMediaType   = "application/vnd.oci.image.config.v1+json"
+	ociLayerMediaType    = "application/vnd.oci.image.layer.v1.tar+gzip"
+)
+
+// ociImageSettings are the image settings which `starlarkOCIImage` encodes
+// as JSON in the target's first arg.
+type ociImageSettings struct {
+	OS         string   `json:"os"`
+	Arch       string   `json:"arch"`
+	Entrypoint []string `json:"entrypoint,omitempty"`
+	Cmd        []string `json:"cmd,omitempty"`
+	Env        []string `json:"env,omitempty"`
+	WorkingDir string   `json:"workingDir,omitempty"`
+	BaseSHA256 string   `json:"baseSHA256,omitempty"`
+	HasBase    bool     `json:"hasBase"`
+}
+
+// starlarkOCIImage implements the `oci_image(name, layers=[], base=None,
+// base_sha256=None, entrypoint=None, cmd=None, env={}, workdir=None,
+// os="linux", arch="amd64")` builtin. `layers` are artifacts (targets, paths
+// and globs) whose contents are added to the image's root file system in
+// order. `base` is an OCI image layout directory or a tarball of one; when
+// `base_sha256` is given, the tarball's checksum is verified before it's
+// used.
+func starlarkOCIImage(
+	args starlark.Tuple,
+	kwargs []starlark.Tuple,
+) (starlark.Value, error) {
+	var name string
+	var layers *starlark.List
+	var base, entrypoint, cmd, env starlark.Value
+	settings := ociImageSettings{OS: "linux", Arch: "amd64"}
+	if err := starlark.UnpackArgs(
+		"oci_image",
+		args,
+		kwargs,
+		"name",
+		&name,
+		"layers?",
+		&layers,
+		"base?",
+		&base,
+		"base_sha256?",
+		&settings.BaseSHA256,
+		"entrypoint?",
+		&entrypoint,
+		"cmd?",
+		&cmd,
+		"env?",
+		&env,
+		"workdir?",
+		&settings.WorkingDir,
+		"os?",
+		&settings.OS,
+		"arch?",
+		&settings.Arch,
+	); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if settings.Entrypoint, err = optionalStringList(entrypoint); err != nil {
+		return nil, errors.Wrap(err, "Argument 'entrypoint'")
+	}
+	if settings.Cmd, err = optionalStringList(cmd); err != nil {
+		return nil, errors.Wrap(err, "Argument 'cmd'")
+	}
+	if settings.Env, err = envList(env); err != nil {
+		return nil, errors.Wrap(err, "Argument 'env'")
+	}
+
+	targetArgs := []Arg{nil}
+	if base != nil && base != starlark.None {
+		baseArg, err := starlarkValueToArtifactArg(base)
+		if err != nil {
+			return nil, errors.Wrap(err, "Argument 'base'")
+		}
+		settings.HasBase = true
+		targetArgs = append(targetArgs, baseArg)
+	} else if settings.BaseSHA256 != "" {
+		return nil, errors.Errorf("Argument 'base_sha256' requires 'base'")
+	}
+	if layers != nil {
+		for i := 0; i < layers.Len(); i++ {
+			layerArg, err := starlarkValueToArtifactArg(layers.Index(i))
+			if err != nil {
+				return nil, errors.Wrapf(err, "Argument 'layers[%d]'", i)
+			}
+			targetArgs = append(targetArgs, layerArg)
+		}
+	}
+
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return nil, err
+	}
+	targetArgs[0] = String(data)
+	return &Target{
+		Name:    name,
+		Builder: nativeBuilderPrefix + "oci_image",
+		Args:    targetArgs,
+		Env:     []string{},
+	}, nil
+}
+
+// optionalStringList converts an optional Starlark list of strings.
+func optionalStringList(v starlark.Value) ([]string, error) {
+	if v == nil || v == starlark.None {
+		return nil, nil
+	}
+	return starlarkStringList(v)
+}
+
+// envList converts a dict of environment variables or a list of `KEY=value`
+// strings into a list of `KEY=value` strings.
+func envList(v starlark.Value) ([]string, error) {
+	d, ok := v.(*starlark.Dict)
+	if !ok {
+		return optionalStringList(v)
+	}
+	env := make([]string, 0, d.Len())
+	for _, item := range d.Items() {
+		key, keyOK := item[0].(starlark.String)
+		value, valueOK := item[1].(starlark.String)
+		if !keyOK || !valueOK {
+			return nil, errors.Errorf("TypeError: expected dict of str to str")
+		}
+		env = append(env, string(key)+"="+string(value))
+	}
+	sort.Strings(env)
+	return env, nil
+}
+
+// ociDescriptor is an OCI content descriptor.
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Platform    *ociPlatform      `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+}
+
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+// buildOCIImage expects the args `[settings, base?, layers...]`.
+func buildOCIImage(cachePath string, args []string, out string) error {
+	if len(args) < 1 {
+		return errors.Errorf("Expected args [settings, base?, layers...]")
+	}
+	var settings ociImageSettings
+	if err := json.Unmarshal([]byte(args[0]), &settings); err != nil {
+		return errors.Wrap(err, "Parsing image settings")
+	}
+	args = args[1:]
+
+	layout := ociLayout(out)
+	if err := os.MkdirAll(layout.blobDir(), 0755); err != nil {
+		return err
+	}
+
+	// Start from the base image's config and layers, if any.
+	config := map[string]interface{}{}
+	var layers []ociDescriptor
+	if settings.HasBase {
+		if len(args) < 1 {
+			return errors.Errorf("Missing base image argument")
+		}
+		var err error
+		config, layers, err = layout.importBase(
+			filepath.Join(cachePath, args[0]),
+			settings,
+		)
+		if err != nil {
+			return errors.Wrap(err, "Importing base image")
+		}
+		args = args[1:]
+	}
+
+	// Add each layer to the image.
+	var diffIDs []string
+	for _, layer := range args {
+		desc, diffID, err := layout.writeLayer(filepath.Join(cachePath, layer))
+		if err != nil {
+			return errors.Wrapf(err, "Writing layer '%s'", layer)
+		}
+		layers = append(layers, desc)
+		diffIDs = append(diffIDs, diffID)
+	}
+
+	configDesc, err := layout.writeJSON(
+		ociConfigMediaType,
+		updateOCIConfig(config, settings, diffIDs),
+	)
+	if err != nil {
+		return errors.Wrap(err, "Writing image config")
+	}
+
+	manifestDesc, err := layout.writeJSON(ociManifestMediaType, ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestMediaType,
+		Config:        configDesc,
+		Layers:        layers,
+	})
+	if err != nil {
+		return errors.Wrap(err, "Writing image manifest")
+	}
+	manifestDesc.Platform = &ociPlatform{
+		Architecture: settings.Arch,
+		OS:           settings.OS,
+	}
+
+	if err := writeJSONFile(filepath.Join(out, "index.json"), ociIndex{
+		SchemaVersion: 2,
+		MediaType:     ociIndexMediaType,
+		Manifests:     []ociDescriptor{manifestDesc},
+	}); err != nil {
+		return err
+	}
+	return writeJSONFile(
+		filepath.Join(out, "oci-layout"),
+		map[string]string{"imageLayoutVersion": "1.0.0"},
+	)
+}
+
+// updateOCIConfig applies the image settings and new layers to a (possibly
+// empty) image config.
+func updateOCIConfig(
+	config map[string]interface{},
+	settings ociImageSettings,
+	diffIDs []string,
+) map[string]interface{} {
+	created := archiveEpoch.Format("2006-01-02T15:04:05Z")
+	config["created"] = created
+	config["architecture"] = settings.Arch
+	config["os"] = settings.OS
+
+	runtime, _ := config["config"].(map[string]interface{})
+	if runtime == nil {
+		runtime = map[string]interface{}{}
+	}
+	if settings.Entrypoint != nil {
+		runtime["Entrypoint"] = settings.Entrypoint
+		// As with Dockerfiles, setting the entrypoint resets the base
+		// image's command.
+		delete(runtime, "Cmd")
+	}
+	if settings.Cmd != nil {
+		runtime["Cmd"] = settings.Cmd
+	}
+	if settings.WorkingDir != "" {
+		runtime["WorkingDir"] = settings.WorkingDir
+	}
+	if len(settings.Env) > 0 {
+		runtime["Env"] = mergeEnv(interfaceStrings(runtime["Env"]), settings.Env)
+	}
+	config["config"] = runtime
+
+	rootfs, _ := config["rootfs"].(map[string]interface{})
+	if rootfs == nil {
+		rootfs = map[string]interface{}{"type": "layers"}
+	}
+	allDiffIDs := interfaceStrings(rootfs["diff_ids"])
+	allDiffIDs = append(allDiffIDs, diffIDs...)
+	if allDiffIDs == nil {
+		allDiffIDs = []string{}
+	}
+	rootfs["diff_ids"] = allDiffIDs
+	config["rootfs"] = rootfs
+
+	history, _ := config["history"].([]interface{})
+	for range diffIDs {
+		history = append(history, map[string]interface{}{
+			"created":    created,
+			"created_by": "g8r oci_image",
+		})
+	}
+	if history != nil {
+		config["history"] = history
+	}
+	return config
+}
+
+// mergeEnv overrides the variables in `base` with those in `overrides`.
+func mergeEnv(base, overrides []string) []string {
+	merged := make([]string, 0, len(base)+len(overrides))
+	overridden := map[string]struct{}{}
+	for _, kv := range overrides {
+		overridden[strings.SplitN(kv, "=", 2)[0]] = struct{}{}
+	}
+	for _, kv := range base {
+		if _, found := overridden[strings.SplitN(kv, "=", 2)[0]]; !found {
+			merged = append(merged, kv)
+		}
+	}
+	return append(merged, overrides...)
+}
+
+func interfaceStrings(v interface{}) []string {
+	items, _ := v.([]interface{})
+	var ss []string
+	for _, item := range items {
+		if s, ok := item.(string); ok {
+			ss = append(ss, s)
+		}
+	}
+	return ss
+}
+
+// ociLayout is the root directory of an OCI image layout.
+type ociLayout string
+
+func (l ociLayout) blobDir() string {
+	return filepath.Join(string(l), "blobs", "sha256")
+}
+
+func (l ociLayout) blobPath(digest string) (string, error) {
+	hexDigest := strings.TrimPrefix(digest, "sha256:")
+	if hexDigest == digest || strings.ContainsAny(hexDigest, `/\.`) {
+		return "", errors.Errorf("Unsupported digest '%s'", digest)
+	}
+	return filepath.Join(l.blobDir(), hexDigest), nil
+}
+
+// writeBlob writes a blob from `r` into the layout and returns its
+// descriptor.
+func (l ociLayout) writeBlob(mediaType string, r io.Reader) (ociDescriptor, error) {
+	tmp, err := ioutil.TempFile(l.blobDir(), ".tmp-")
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hasher), r)
+	if err != nil {
+		properClose(tmp)
+		return ociDescriptor{}, err
+	}
+	if err := tmp.Close(); err != nil {
+		return ociDescriptor{}, err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return ociDescriptor{}, err
+	}
+
+	desc := ociDescriptor{
+		MediaType: mediaType,
+		Digest:    "sha256:" + hex.EncodeToString(hasher.Sum(nil)),
+		Size:      size,
+	}
+	path, err := l.blobPath(desc.Digest)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return ociDescriptor{}, err
+	}
+	committed = true
+	return desc, nil
+}
+
+func (l ociLayout) writeJSON(mediaType string, v interface{}) (ociDescriptor, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	return l.writeBlob(mediaType, bytes.NewReader(data))
+}
+
+// readJSON parses the blob whose digest is `digest`, failing if the blob's
+// contents don't match the digest.
+func (l ociLayout) readJSON(digest string, v interface{}) error {
+	path, err := l.blobPath(digest)
+	if err != nil {
+		return err
+	}
+	if err := verifySHA256(path, digest); err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// writeLayer writes a reproducible gzipped tarball of `root` as a layer and
+// returns its descriptor and diff ID (the digest of the uncompressed tar).
+func (l ociLayout) writeLayer(root string) (ociDescriptor, string, error) {
+	pr, pw := io.Pipe()
+	diffHasher := sha256.New()
+	go func() {
+		gz := gzip.NewWriter(pw)
+		err := writeTar(io.MultiWriter(gz, diffHasher), root)
+		if err == nil {
+			err = gz.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	desc, err := l.writeBlob(ociLayerMediaType, pr)
+	if err != nil {
+		pr.CloseWithError(err)
+		return ociDescriptor{}, "", err
+	}
+	return desc, "sha256:" + hex.EncodeToString(diffHasher.Sum(nil)), nil
+}
+
+// importBase copies the base image's layers into the layout and returns its
+// config and layer descriptors. `base` may be an image layout directory or a
+// tarball of one. Every blob that is read or copied from the base must match
+// its digest, so a corrupted or tampered base can't be passed off as the
+// image that its manifest describes.
+func (l ociLayout) importBase(
+	base string,
+	settings ociImageSettings,
+) (map[string]interface{}, []ociDescriptor, error) {
+	fi, err := os.Stat(base)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !fi.IsDir() {
+		if settings.BaseSHA256 != "" {
+			if err := verifySHA256(base, settings.BaseSHA256); err != nil {
+				return nil, nil, err
+			}
+		}
+		tmpDir, err := ioutil.TempDir(filepath.Dir(string(l)), "base-")
+		if err != nil {
+			return nil, nil, err
+		}
+		defer os.RemoveAll(tmpDir)
+		if err := extractArchive(base, tmpDir); err != nil {
+			return nil, nil, err
+		}
+		base = tmpDir
+	} else if settings.BaseSHA256 != "" {
+		return nil, nil, errors.Errorf(
+			"'base_sha256' requires the base to be a tarball",
+		)
+	}
+	baseLayout := ociLayout(base)
+
+	var index ociIndex
+	data, err := ioutil.ReadFile(filepath.Join(base, "index.json"))
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, nil, errors.Wrap(err, "Parsing index.json")
+	}
+	manifestDesc, err := selectOCIManifest(index, settings)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var manifest ociManifest
+	if err := baseLayout.readJSON(manifestDesc.Digest, &manifest); err != nil {
+		return nil, nil, errors.Wrap(err, "Reading base manifest")
+	}
+	config := map[string]interface{}{}
+	if err := baseLayout.readJSON(manifest.Config.Digest, &config); err != nil {
+		return nil, nil, errors.Wrap(err, "Reading base config")
+	}
+
+	for _, layer := range manifest.Layers {
+		src, err := baseLayout.blobPath(layer.Digest)
+		if err != nil {
+			return nil, nil, err
+		}
+		dst, err := l.blobPath(layer.Digest)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := copyFile(src, dst, 0644); err != nil {
+			return nil, nil, errors.Wrapf(err, "Copying layer %s", layer.Digest)
+		}
+
+		// The copy is verified (rather than the original) so that the layout
+		// never holds a blob which doesn't match its digest.
+		if err := verifySHA256(dst, layer.Digest); err != nil {
+			os.Remove(dst)
+			return nil, nil, errors.Wrapf(err, "Copying layer %s", layer.Digest)
+		}
+	}
+	return config, manifest.Layers, nil
+}
+
+// selectOCIManifest picks the manifest for the image's platform from an
+// index. An index with a single manifest is used as-is.
+func selectOCIManifest(
+	index ociIndex,
+	settings ociImageSettings,
+) (ociDescriptor, error) {
+	if len(index.Manifests) == 1 {
+		return index.Manifests[0], nil
+	}
+	for _, desc := range index.Manifests {
+		if desc.Platform != nil &&
+			desc.Platform.OS == settings.OS &&
+			desc.Platform.Architecture == settings.Arch {
+			return desc, nil
+		}
+	}
+	return ociDescriptor{}, errors.Errorf(
+		"Base image has no manifest for %s/%s",
+		settings.OS,
+		settings.Arch,
+	)
+}
+
+// verifySHA256 checks the SHA-256 checksum of the file at `path`.
+func verifySHA256(path, wanted string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer properClose(file)
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return err
+	}
+	got := hex.EncodeToString(hasher.Sum(nil))
+	if got != strings.ToLower(strings.TrimPrefix(wanted, "sha256:")) {
+		return errors.Errorf(
+			"Checksum mismatch for '%s': wanted %s; got %s",
+			path,
+			wanted,
+			got,
+		)
+	}
+	return nil
+}
+
+func writeJSONFile(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
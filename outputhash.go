@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Fixed-output targets declare the hash of their output up front (see
+// `Target.OutputHash`). Output hashes have the form `<algorithm>:<digest>`.
+// g8r verifies `sha256:<hex>` hashes of file outputs itself; hashes in other
+// formats (e.g., the `h1:` hashes from go.sum files) are opaque to g8r and
+// must be verified by the target's builder.
+
+// outputHashSHA256 is the prefix for output hashes which are verified by g8r.
+const outputHashSHA256 = "sha256:"
+
+// validateOutputHash checks that an output hash is well-formed.
+func validateOutputHash(outputHash string) error {
+	i := strings.Index(outputHash, ":")
+	if i < 1 || i == len(outputHash)-1 {
+		return errors.Errorf(
+			"Output hash '%s' must have the form '<algorithm>:<digest>'",
+			outputHash,
+		)
+	}
+	if strings.HasPrefix(outputHash, outputHashSHA256) {
+		digest, err := hex.DecodeString(outputHash[len(outputHashSHA256):])
+		if err != nil || len(digest) != sha256.Size {
+			return errors.Errorf(
+				"Output hash '%s' must have a 64-character hex digest",
+				outputHash,
+			)
+		}
+	}
+	return nil
+}
+
+// verifyOutputHash checks the output at `path` against `outputHash` if it is
+// in a format that g8r knows how to verify.
+func verifyOutputHash(path, outputHash string) error {
+	if !strings.HasPrefix(outputHash, outputHashSHA256) {
+		return nil
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return errors.Errorf(
+				"Builder succeeded but didn't create output file",
+			)
+		}
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return errors.Errorf(
+			"Output hash '%s' requires a regular file output",
+			outputHash,
+		)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer properClose(f)
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return errors.Wrap(err, "Hashing output")
+	}
+
+	found := outputHashSHA256 + hex.EncodeToString(hasher.Sum(nil))
+	if found != outputHash {
+		return errors.Errorf(
+			"Output hash mismatch: wanted '%s'; found '%s'",
+			outputHash,
+			found,
+		)
+	}
+	return nil
+}
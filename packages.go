@@ -0,0 +1,698 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.starlark.net/starlark"
+)
+
+// External packages are declared in the WORKSPACE file with
+//
+//     package(name, source, version="", sha256="", mapping={})
+//
+// and fetched into `.vendor/<name>` by `g8r fetch`. A source is either a git
+// repository (`git+<url>`, where `version` is the branch, tag or commit to
+// check out) or a tar, gzipped tar or zip archive (a URL or a path relative
+// to the workspace root). An archive whose entries are all inside of a single
+// top-level directory is unpacked from that directory.
+//
+// `sha256` is the hash of the package's contents (see `hashPackageTree()`).
+// `g8r fetch` records the hash (and, for git packages, the commit) of every
+// package it fetches in the WORKSPACE.lock file, and as long as a package's
+// declaration doesn't change, later fetches are pinned to the locked commit
+// and must reproduce the locked hash.
+
+const lockFileName = "WORKSPACE.lock"
+
+// packageDecl is a package declared with `package()`.
+type packageDecl struct {
+	Name    string
+	Source  string
+	Version string
+	SHA256  string
+
+	// Mapping renames the packages that the package depends on (see
+	// resolve.go).
+	Mapping map[string]string
+}
+
+const gitSourcePrefix = "git+"
+
+func (decl *packageDecl) isGit() bool {
+	return strings.HasPrefix(decl.Source, gitSourcePrefix)
+}
+
+// starlarkPackage implements the `package(name, source, version="",
+// sha256="", mapping={})` builtin, which is only available in WORKSPACE
+// files.
+func starlarkPackage(
+	th *starlark.Thread,
+	args starlark.Tuple,
+	kwargs []starlark.Tuple,
+) (starlark.Value, error) {
+	ws, ok := th.Local(workspaceLocal).(*workspace)
+	if !ok {
+		return nil, errors.Errorf(
+			"package() may only be called from a %s file",
+			workspaceFileName,
+		)
+	}
+
+	var decl packageDecl
+	var mapping *starlark.Dict
+	if err := starlark.UnpackArgs(
+		"package",
+		args,
+		kwargs,
+		"name",
+		&decl.Name,
+		"source",
+		&decl.Source,
+		"version?",
+		&decl.Version,
+		"sha256?",
+		&decl.SHA256,
+		"mapping?",
+		&mapping,
+	); err != nil {
+		return nil, err
+	}
+	var err error
+	if decl.Mapping, err = unpackPackageMapping(mapping); err != nil {
+		return nil, err
+	}
+
+	if err := ws.validateNewPackageName(decl.Name); err != nil {
+		return nil, err
+	}
+	if decl.isGit() && decl.Version == "" {
+		return nil, errors.Errorf(
+			"Package '%s': git packages require a version",
+			decl.Name,
+		)
+	}
+	if decl.SHA256 != "" {
+		if b, err := hex.DecodeString(decl.SHA256); err != nil ||
+			len(b) != sha256.Size {
+			return nil, errors.Errorf(
+				"Package '%s': invalid sha256 '%s'",
+				decl.Name,
+				decl.SHA256,
+			)
+		}
+	}
+
+	ws.packages = append(ws.packages, decl)
+	return starlark.None, nil
+}
+
+// validatePackageName makes sure that a package name can be used in load
+// addresses (`<package>:<module>`) and as a directory name.
+func validatePackageName(name string) error {
+	if name == "" ||
+		strings.HasPrefix(name, ".") ||
+		strings.ContainsAny(name, `:/\`) {
+		return errors.Errorf("Invalid package name '%s'", name)
+	}
+	return nil
+}
+
+// unpackPackageMapping converts the `mapping` argument of `package()` and
+// `git_package()` (a dict of package names) into a map.
+func unpackPackageMapping(mapping *starlark.Dict) (map[string]string, error) {
+	if mapping == nil {
+		return nil, nil
+	}
+	m := make(map[string]string, mapping.Len())
+	for _, item := range mapping.Items() {
+		from, ok := item[0].(starlark.String)
+		if !ok {
+			return nil, errors.Errorf(
+				"TypeError: argument 'mapping': expected str keys; found %s",
+				item[0].Type(),
+			)
+		}
+		to, ok := item[1].(starlark.String)
+		if !ok {
+			return nil, errors.Errorf(
+				"TypeError: argument 'mapping': expected str values; found %s",
+				item[1].Type(),
+			)
+		}
+		if err := validatePackageName(string(to)); err != nil {
+			return nil, errors.Wrap(err, "Argument 'mapping'")
+		}
+		m[string(from)] = string(to)
+	}
+	return m, nil
+}
+
+// validateNewPackageName makes sure that a package name is valid and that
+// no other package has been declared with the same name.
+func (ws *workspace) validateNewPackageName(name string) error {
+	if err := validatePackageName(name); err != nil {
+		return err
+	}
+	for _, decl := range ws.declarations() {
+		if decl.packageName() == name {
+			return errors.Errorf(
+				"Package '%s' is declared more than once",
+				name,
+			)
+		}
+	}
+	return nil
+}
+
+//
+// Lock file
+//
+
+// lockFile is the contents of the WORKSPACE.lock file.
+type lockFile struct {
+	Packages map[string]lockedPackage `json:"packages"`
+}
+
+// lockedPackage records how a package was fetched.
+type lockedPackage struct {
+	Source  string `json:"source"`
+	Version string `json:"version,omitempty"`
+
+	// Commit is the commit that a git package's version resolved to.
+	Commit string `json:"commit,omitempty"`
+	SHA256 string `json:"sha256"`
+}
+
+// readLockFile reads the lock file in the workspace at `root`. A missing lock
+// file is empty.
+func readLockFile(root string) (*lockFile, error) {
+	lock := lockFile{Packages: map[string]lockedPackage{}}
+	data, err := ioutil.ReadFile(filepath.Join(root, lockFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &lock, nil
+		}
+		return nil, errors.Wrap(err, "Reading lock file")
+	}
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return nil, errors.Wrapf(err, "Parsing %s", lockFileName)
+	}
+	if lock.Packages == nil {
+		lock.Packages = map[string]lockedPackage{}
+	}
+	return &lock, nil
+}
+
+func (lock *lockFile) write(root string) error {
+	data, err := json.MarshalIndent(lock, "", "    ")
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(
+		ioutil.WriteFile(
+			filepath.Join(root, lockFileName),
+			append(data, '\n'),
+			0644,
+		),
+		"Writing lock file",
+	)
+}
+
+//
+// Fetching
+//
+
+// fetchPackage fetches a package into `vendorDir/name` (unless it's already
+// there) and returns its lock file entry. `locked` is the package's previous
+// entry, if any. Relative sources are relative to `root`. `packageHashes`
+// caches the hashes of the files in `vendorDir`.
+func fetchPackage(
+	root string,
+	vendorDir string,
+	name string,
+	decl packageDecl,
+	locked lockedPackage,
+	packageHashes *fileHashCache,
+) (lockedPackage, error) {
+	result := lockedPackage{
+		Source:  decl.Source,
+		Version: decl.Version,
+		SHA256:  decl.SHA256,
+	}
+
+	// The lock file pins the package for as long as its declaration is
+	// unchanged.
+	if locked.SHA256 != "" &&
+		locked.Source == decl.Source &&
+		locked.Version == decl.Version {
+		if decl.SHA256 != "" && decl.SHA256 != locked.SHA256 {
+			return lockedPackage{}, errors.Errorf(
+				"Declared sha256 %s doesn't match the locked sha256 %s",
+				decl.SHA256,
+				locked.SHA256,
+			)
+		}
+		result.SHA256, result.Commit = locked.SHA256, locked.Commit
+	}
+
+	// Skip the package if it has already been fetched (unless its commit
+	// still needs to be resolved).
+	dst := filepath.Join(vendorDir, name)
+	if result.SHA256 != "" && (!decl.isGit() || result.Commit != "") {
+		hash, err := hashPackageTree(dst, packageHashes)
+		if err == nil && hash == result.SHA256 {
+			return result, nil
+		}
+	}
+
+	tmpDir, err := ioutil.TempDir(vendorDir, ".fetch-")
+	if err != nil {
+		return lockedPackage{}, err
+	}
+	defer func() {
+		if err := os.RemoveAll(tmpDir); err != nil {
+			log.Printf(
+				"WARN failed to remove temporary directory '%s': %v",
+				tmpDir,
+				err,
+			)
+		}
+	}()
+
+	src := filepath.Join(tmpDir, "src")
+	if decl.isGit() {
+		ref := decl.Version
+		if result.Commit != "" {
+			ref = result.Commit
+		}
+		if result.Commit, err = fetchGitPackage(
+			root,
+			strings.TrimPrefix(decl.Source, gitSourcePrefix),
+			ref,
+			src,
+		); err != nil {
+			return lockedPackage{}, err
+		}
+	} else if err := fetchArchivePackage(
+		root,
+		decl.Source,
+		tmpDir,
+		src,
+	); err != nil {
+		return lockedPackage{}, err
+	}
+
+	hash, err := hashPackageTree(src, nil)
+	if err != nil {
+		return lockedPackage{}, err
+	}
+	if result.SHA256 != "" && hash != result.SHA256 {
+		return lockedPackage{}, errors.Errorf(
+			"Hash mismatch: expected sha256 %s; got %s",
+			result.SHA256,
+			hash,
+		)
+	}
+	result.SHA256 = hash
+
+	if _, err := os.Stat(filepath.Join(src, workspaceFileName)); err != nil {
+		if os.IsNotExist(err) {
+			return lockedPackage{}, errors.Errorf(
+				"Package has no %s file",
+				workspaceFileName,
+			)
+		}
+		return lockedPackage{}, err
+	}
+
+	if err := os.RemoveAll(dst); err != nil {
+		return lockedPackage{}, err
+	}
+	return result, os.Rename(src, dst)
+}
+
+// fetchGitPackage checks out `ref` (a branch, tag or commit) of the git
+// repository at `url` into `dst` (without the `.git` directory) and returns
+// the commit that `ref` resolved to. Relative paths are relative to the
+// workspace root.
+func fetchGitPackage(root, url, ref, dst string) (string, error) {
+	if !strings.Contains(url, "://") && !filepath.IsAbs(url) {
+		url = filepath.Join(root, url)
+	}
+	if _, err := runGit(
+		"",
+		"clone",
+		"--quiet",
+		"--no-checkout",
+		url,
+		dst,
+	); err != nil {
+		return "", err
+	}
+
+	// Branches other than the default branch are only available as
+	// remote-tracking branches.
+	var commit string
+	for _, candidate := range []string{ref, "origin/" + ref} {
+		out, err := runGit(
+			dst,
+			"rev-parse",
+			"--verify",
+			"--quiet",
+			candidate+"^{commit}",
+		)
+		if err == nil {
+			commit = strings.TrimSpace(out)
+			break
+		}
+	}
+	if commit == "" {
+		return "", errors.Errorf("Version '%s' not found in '%s'", ref, url)
+	}
+
+	if _, err := runGit(
+		dst,
+		"checkout",
+		"--quiet",
+		"--detach",
+		commit,
+	); err != nil {
+		return "", err
+	}
+	return commit, os.RemoveAll(filepath.Join(dst, ".git"))
+}
+
+func runGit(dir string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", errors.Wrapf(
+			err,
+			"Running `git %s`: %s",
+			strings.Join(args, " "),
+			strings.TrimSpace(stderr.String()),
+		)
+	}
+	return stdout.String(), nil
+}
+
+// fetchArchivePackage downloads (if `source` is an HTTP(S) URL) and unpacks
+// an archive into `dst`, using `tmpDir` for intermediate files.
+func fetchArchivePackage(root, source, tmpDir, dst string) error {
+	archive := filepath.Join(tmpDir, "archive")
+	switch {
+	case strings.HasPrefix(source, "http://"),
+		strings.HasPrefix(source, "https://"):
+		if err := download(source, archive); err != nil {
+			return err
+		}
+	case strings.HasPrefix(source, "file://"):
+		archive = strings.TrimPrefix(source, "file://")
+	case filepath.IsAbs(source):
+		archive = source
+	default:
+		archive = filepath.Join(root, source)
+	}
+
+	extracted := filepath.Join(tmpDir, "extracted")
+	if err := extractArchive(archive, extracted); err != nil {
+		return errors.Wrapf(err, "Extracting '%s'", source)
+	}
+
+	// Unpack archives whose contents are in a single top-level directory
+	// (e.g., `project-1.0/`) from that directory.
+	fileInfos, err := ioutil.ReadDir(extracted)
+	if err != nil {
+		return err
+	}
+	if len(fileInfos) == 1 && fileInfos[0].IsDir() {
+		extracted = filepath.Join(extracted, fileInfos[0].Name())
+	}
+	return os.Rename(extracted, dst)
+}
+
+func download(url, dst string) error {
+	rsp, err := http.Get(url)
+	if err != nil {
+		return errors.Wrapf(err, "Downloading '%s'", url)
+	}
+	defer properClose(rsp.Body)
+	if rsp.StatusCode != http.StatusOK {
+		return errors.Errorf("Downloading '%s': %s", url, rsp.Status)
+	}
+
+	file, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer properClose(file)
+	_, err = io.Copy(file, rsp.Body)
+	return errors.Wrapf(err, "Downloading '%s'", url)
+}
+
+// hashPackageTree hashes the contents of a package directory: the path, mode
+// and symlink target of every entry (with the modes normalized as they are
+// for archives) and the contents of every file. The result is hex-encoded.
+// The hashes of the files' contents are looked up in `fileHashes`, which may
+// be nil.
+func hashPackageTree(dir string, fileHashes *fileHashCache) (string, error) {
+	hasher := sha256.New()
+	if err := walkArchiveEntries(dir, func(e archiveEntry) error {
+		hasher.Write([]byte(e.name))
+		hasher.Write([]byte{0})
+		hasher.Write([]byte(formatMode(e.mode)))
+		hasher.Write([]byte{0})
+		hasher.Write([]byte(e.link))
+		hasher.Write([]byte{0})
+		if e.fi.Mode().IsRegular() {
+			hash, err := fileHashes.hashFileContents(e.path, e.fi, sha256.New)
+			if err != nil {
+				return err
+			}
+			hasher.Write(hash)
+		}
+		return nil
+	}); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+//
+// Git packages
+//
+
+// Git packages are declared in the WORKSPACE file with
+//
+//     git_package(name, remote, commit, mapping={})
+//
+// Unlike `package()`s, they don't need to be fetched ahead of time: the
+// commit is fetched (if it hasn't been already) into a bare mirror of the
+// remote, and its tree is checked out into a directory named after the
+// commit, both in the g8r cache. Since a commit identifies its contents,
+// every machine which builds the workspace loads the same package.
+
+// gitPackageDecl is a package declared with `git_package()`.
+type gitPackageDecl struct {
+	Name    string
+	Remote  string
+	Commit  string
+	Mapping map[string]string
+}
+
+// starlarkGitPackage implements the `git_package(name, remote, commit,
+// mapping={})` builtin, which is only available in WORKSPACE files.
+func starlarkGitPackage(
+	th *starlark.Thread,
+	args starlark.Tuple,
+	kwargs []starlark.Tuple,
+) (starlark.Value, error) {
+	ws, ok := th.Local(workspaceLocal).(*workspace)
+	if !ok {
+		return nil, errors.Errorf(
+			"git_package() may only be called from a %s file",
+			workspaceFileName,
+		)
+	}
+
+	var decl gitPackageDecl
+	var mapping *starlark.Dict
+	if err := starlark.UnpackArgs(
+		"git_package",
+		args,
+		kwargs,
+		"name",
+		&decl.Name,
+		"remote",
+		&decl.Remote,
+		"commit",
+		&decl.Commit,
+		"mapping?",
+		&mapping,
+	); err != nil {
+		return nil, err
+	}
+	var err error
+	if decl.Mapping, err = unpackPackageMapping(mapping); err != nil {
+		return nil, err
+	}
+
+	if err := ws.validateNewPackageName(decl.Name); err != nil {
+		return nil, err
+	}
+	if !isCommitID(decl.Commit) {
+		return nil, errors.Errorf(
+			"Package '%s': commit must be a full commit hash; found '%s'",
+			decl.Name,
+			decl.Commit,
+		)
+	}
+
+	ws.gitPackages = append(ws.gitPackages, decl)
+	return starlark.None, nil
+}
+
+// isCommitID returns true if `s` is a full (SHA-1 or SHA-256) commit hash.
+func isCommitID(s string) bool {
+	if len(s) != 40 && len(s) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil && strings.ToLower(s) == s
+}
+
+// fetchGitCommit returns the directory containing the tree of `commit`,
+// fetching it from `remote` if it isn't already checked out. Relative remote
+// paths are relative to the workspace root.
+func fetchGitCommit(root, gitDir, remote, commit string) (string, error) {
+	checkout := filepath.Join(gitDir, "checkouts", commit)
+	if _, err := os.Stat(checkout); err == nil {
+		return checkout, nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	if !strings.Contains(remote, "://") && !filepath.IsAbs(remote) {
+		remote = filepath.Join(root, remote)
+	}
+
+	// Each remote has a bare mirror which accumulates the commits that have
+	// been fetched from it.
+	remoteHash := sha256.Sum256([]byte(remote))
+	mirror := filepath.Join(
+		gitDir,
+		"mirrors",
+		hex.EncodeToString(remoteHash[:])+".git",
+	)
+	if _, err := os.Stat(mirror); os.IsNotExist(err) {
+		_, err := runGit("", "init", "--quiet", "--bare", mirror)
+		if err != nil {
+			return "", err
+		}
+	} else if err != nil {
+		return "", err
+	}
+
+	hasCommit := func() bool {
+		_, err := runGit(mirror, "cat-file", "-e", commit+"^{commit}")
+		return err == nil
+	}
+	if !hasCommit() {
+		// Servers which don't allow fetching commits by hash require
+		// fetching all of their refs instead.
+		_, err := runGit(mirror, "fetch", "--quiet", remote, commit)
+		if err != nil {
+			if _, err := runGit(
+				mirror,
+				"fetch",
+				"--quiet",
+				remote,
+				"+refs/*:refs/remotes/origin/*",
+			); err != nil {
+				return "", err
+			}
+		}
+		if !hasCommit() {
+			return "", errors.Errorf(
+				"Commit %s not found in '%s'",
+				commit,
+				remote,
+			)
+		}
+	}
+
+	// Check the tree out into a temporary directory and move it into place
+	// so that a checkout is never partial.
+	if err := os.MkdirAll(filepath.Dir(checkout), 0755); err != nil {
+		return "", err
+	}
+	tmpDir, err := ioutil.TempDir(filepath.Dir(checkout), ".checkout-")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := os.RemoveAll(tmpDir); err != nil {
+			log.Printf(
+				"WARN failed to remove temporary directory '%s': %v",
+				tmpDir,
+				err,
+			)
+		}
+	}()
+
+	src := filepath.Join(tmpDir, "src")
+	if err := gitArchive(mirror, commit, src); err != nil {
+		return "", err
+	}
+	if err := os.Rename(src, checkout); err != nil {
+		// Another process may have checked out the same commit.
+		if _, statErr := os.Stat(checkout); statErr == nil {
+			return checkout, nil
+		}
+		return "", err
+	}
+	return checkout, nil
+}
+
+// gitArchive extracts the tree of `commit` in the repository `repo` into
+// `dst`.
+func gitArchive(repo, commit, dst string) error {
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", "archive", "--format=tar", commit)
+	cmd.Dir = repo
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if err := extractTar(stdout, dst); err != nil {
+		_ = cmd.Wait()
+		return err
+	}
+	if err := cmd.Wait(); err != nil {
+		return errors.Wrapf(
+			err,
+			"Running `git archive`: %s",
+			strings.TrimSpace(stderr.String()),
+		)
+	}
+	return nil
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// A package declares its own dependencies in its WORKSPACE file the same way
+// that a workspace does, so the packages that a workspace depends on form a
+// graph. Packages are resolved breadth-first, starting with the workspace's
+// own declarations, and each package is known by a single name throughout
+// the graph: if two packages depend on different versions of a package with
+// the same name, the workspace must either declare that package itself (the
+// workspace's declarations take precedence) or give one of the versions
+// another name with `mapping`. For example,
+//
+//     git_package("b", remote, commit, mapping = {"util": "util2"})
+//
+// resolves `b`'s dependency on `util` as `util2`, so `b` loads from
+// `util2` (which `b` still calls `util`) while other packages load from
+// `util`.
+//
+// Modules in a package load from the packages that the package declares
+// (by the names that it uses for them) and, for compatibility with packages
+// that don't declare their dependencies, from the workspace's packages.
+
+// dependencyDecl is a package declared in a WORKSPACE file.
+type dependencyDecl interface {
+	packageName() string
+
+	// packageMapping renames the declared package's dependencies.
+	packageMapping() map[string]string
+
+	// versionKey identifies the declared version of the package. Two
+	// declarations of a package conflict if their keys are different.
+	versionKey() string
+
+	// describe describes the declared version for error messages.
+	describe() string
+}
+
+func (decl packageDecl) packageName() string { return decl.Name }
+
+func (decl packageDecl) packageMapping() map[string]string {
+	return decl.Mapping
+}
+
+func (decl packageDecl) versionKey() string { return decl.describe() }
+
+func (decl packageDecl) describe() string {
+	if decl.Version == "" {
+		return decl.Source
+	}
+	return decl.Source + "@" + decl.Version
+}
+
+func (decl gitPackageDecl) packageName() string { return decl.Name }
+
+func (decl gitPackageDecl) packageMapping() map[string]string {
+	return decl.Mapping
+}
+
+// versionKey implements dependencyDecl.versionKey(). A commit identifies its
+// contents regardless of which remote it's fetched from.
+func (decl gitPackageDecl) versionKey() string { return decl.Commit }
+
+func (decl gitPackageDecl) describe() string {
+	return decl.Remote + "@" + decl.Commit
+}
+
+// declarations returns the packages declared by the workspace.
+func (ws *workspace) declarations() []dependencyDecl {
+	decls := make([]dependencyDecl, 0, len(ws.packages)+len(ws.gitPackages))
+	for _, decl := range ws.packages {
+		decls = append(decls, decl)
+	}
+	for _, decl := range ws.gitPackages {
+		decls = append(decls, decl)
+	}
+	return decls
+}
+
+// resolvedPackage is a package in the dependency graph.
+type resolvedPackage struct {
+	decl dependencyDecl
+	dir  string
+
+	// requiredBy is the chain of packages through which the workspace
+	// depends on the package. It is empty for the workspace's own
+	// declarations.
+	requiredBy []string
+}
+
+// dependent is the workspace or a package whose declarations are being
+// resolved.
+type dependent struct {
+	dir   string
+	path  []string
+	decls []dependencyDecl
+
+	// workspaceName maps the names that the dependent uses for its
+	// dependencies to the names by which the workspace knows them.
+	workspaceName func(string) string
+}
+
+type packageResolver struct {
+	root          string
+	gitDir        string
+	packageHashes *fileHashCache
+	fetching      bool
+	lock          *lockFile
+	newLock       lockFile
+	resolved      map[string]*resolvedPackage
+}
+
+// resolvePackages resolves the packages that the workspace at `root` depends
+// on, directly and transitively, and returns the scope of every package.
+// `vendored` holds the packages found in `.vendor`. If `fetching` is true,
+// `package()`s are fetched into `.vendor` and the lock file is updated;
+// otherwise they must already have been fetched. Git packages are fetched
+// into `gitDir` as necessary. `packageHashes` caches the hashes of the files
+// in `.vendor` so that verifying unchanged packages doesn't read them again.
+func resolvePackages(
+	root string,
+	gitDir string,
+	packageHashes *fileHashCache,
+	ws *workspace,
+	vendored map[string]string,
+	fetching bool,
+) (packageScopes, error) {
+	lock, err := readLockFile(root)
+	if err != nil {
+		return nil, err
+	}
+	r := packageResolver{
+		root:          root,
+		gitDir:        gitDir,
+		packageHashes: packageHashes,
+		fetching:      fetching,
+		lock:          lock,
+		newLock:       lockFile{Packages: map[string]lockedPackage{}},
+		resolved:      map[string]*resolvedPackage{},
+	}
+
+	queue := []*dependent{{
+		dir:           root,
+		decls:         ws.declarations(),
+		workspaceName: func(name string) string { return name },
+	}}
+	var dependents []*dependent
+	for len(queue) > 0 {
+		d := queue[0]
+		queue = queue[1:]
+		dependents = append(dependents, d)
+
+		for _, decl := range d.decls {
+			dep, err := r.resolveDecl(d, decl)
+			if err != nil {
+				return nil, err
+			}
+			if dep != nil {
+				queue = append(queue, dep)
+			}
+		}
+	}
+
+	if fetching {
+		if err := r.writeLock(); err != nil {
+			return nil, err
+		}
+	}
+
+	// The workspace loads from the packages it declares and the other
+	// packages in `.vendor`.
+	workspaceScope := make(map[string]string, len(vendored))
+	for name, dir := range vendored {
+		workspaceScope[name] = dir
+	}
+	for _, decl := range dependents[0].decls {
+		workspaceScope[decl.packageName()] = r.resolved[decl.packageName()].dir
+	}
+
+	scopes := vendoredScopes(root, workspaceScope)
+	for _, d := range dependents[1:] {
+		scope := make(map[string]string, len(workspaceScope)+len(d.decls))
+		for name, dir := range workspaceScope {
+			scope[name] = dir
+		}
+		for _, decl := range d.decls {
+			name := decl.packageName()
+			scope[name] = r.resolved[d.workspaceName(name)].dir
+		}
+		scopes[d.dir] = scope
+	}
+	return scopes, nil
+}
+
+// resolveDecl resolves a package declared by `d`. If the package hasn't been
+// resolved before, it returns the package as a dependent so that its own
+// declarations are resolved.
+func (r *packageResolver) resolveDecl(
+	d *dependent,
+	decl dependencyDecl,
+) (*dependent, error) {
+	name := d.workspaceName(decl.packageName())
+	if existing, found := r.resolved[name]; found {
+		if len(existing.requiredBy) > 0 &&
+			existing.versionKey() != decl.versionKey() {
+			return nil, errors.Errorf(
+				"Conflicting versions of package '%s':\n"+
+					"    %s requires %s\n"+
+					"    %s requires %s\n"+
+					"Declare '%s' in the workspace's %s file to choose a "+
+					"version, or use `mapping` to give one of them another "+
+					"name",
+				name,
+				requirementChain(existing.requiredBy),
+				existing.decl.describe(),
+				requirementChain(d.path),
+				decl.describe(),
+				name,
+				workspaceFileName,
+			)
+		}
+		return nil, nil
+	}
+
+	dir, err := r.fetch(d.dir, name, decl)
+	if err != nil {
+		return nil, errors.Wrapf(
+			err,
+			"Package '%s' (required by %s)",
+			name,
+			requirementChain(d.path),
+		)
+	}
+	r.resolved[name] = &resolvedPackage{
+		decl:       decl,
+		dir:        dir,
+		requiredBy: d.path,
+	}
+
+	ws, err := loadWorkspace(dir, makeLoader(dir, nil))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Package '%s'", name)
+	}
+	mapping := decl.packageMapping()
+	parentName := d.workspaceName
+	return &dependent{
+		dir:   dir,
+		path:  append(append([]string{}, d.path...), name),
+		decls: ws.declarations(),
+		workspaceName: func(name string) string {
+			if mapped, found := mapping[name]; found {
+				name = mapped
+			}
+			return parentName(name)
+		},
+	}, nil
+}
+
+func (rp *resolvedPackage) versionKey() string { return rp.decl.versionKey() }
+
+// fetch returns the directory of a package, fetching it as necessary.
+// Relative sources are relative to `declaringDir`, the root of the package
+// which declares it.
+func (r *packageResolver) fetch(
+	declaringDir string,
+	name string,
+	decl dependencyDecl,
+) (string, error) {
+	switch decl := decl.(type) {
+	case gitPackageDecl:
+		return fetchGitCommit(declaringDir, r.gitDir, decl.Remote, decl.Commit)
+	case packageDecl:
+		vendorDir := filepath.Join(r.root, vendorDirectoryName)
+		dir := filepath.Join(vendorDir, name)
+		if r.fetching {
+			if err := os.MkdirAll(vendorDir, 0755); err != nil {
+				return "", err
+			}
+			locked, err := fetchPackage(
+				declaringDir,
+				vendorDir,
+				name,
+				decl,
+				r.lock.Packages[name],
+				r.packageHashes,
+			)
+			if err != nil {
+				return "", err
+			}
+			r.newLock.Packages[name] = locked
+			return dir, nil
+		}
+
+		locked, found := r.lock.Packages[name]
+		if !found ||
+			locked.Source != decl.Source ||
+			locked.Version != decl.Version {
+			return "", errors.Errorf("Not fetched (run `g8r fetch`)")
+		}
+		if _, err := os.Stat(dir); err != nil {
+			if os.IsNotExist(err) {
+				return "", errors.Errorf("Not fetched (run `g8r fetch`)")
+			}
+			return "", err
+		}
+
+		// The vendored package must be the one in the lock file so that
+		// every build of the workspace uses the same packages.
+		hash, err := hashPackageTree(dir, r.packageHashes)
+		if err != nil {
+			return "", errors.Wrapf(err, "Hashing '%s'", dir)
+		}
+		if hash != locked.SHA256 {
+			return "", errors.Errorf(
+				"'%s' doesn't match the sha256 %s in %s (run `g8r fetch`)",
+				dir,
+				locked.SHA256,
+				lockFileName,
+			)
+		}
+		return dir, nil
+	default:
+		panic(errors.Errorf("Unexpected declaration type %T", decl))
+	}
+}
+
+// writeLock writes the lock file for the fetched packages and removes the
+// packages which were locked but are no longer declared from `.vendor`.
+func (r *packageResolver) writeLock() error {
+	vendorDir := filepath.Join(r.root, vendorDirectoryName)
+	for name := range r.lock.Packages {
+		if _, found := r.newLock.Packages[name]; !found {
+			if err := os.RemoveAll(filepath.Join(vendorDir, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return r.newLock.write(r.root)
+}
+
+// requirementChain formats the chain of packages through which the workspace
+// depends on a package.
+func requirementChain(path []string) string {
+	return strings.Join(append([]string{"the workspace"}, path...), " -> ")
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkjson"
+	"go.starlark.net/starlarkstruct"
+	"gopkg.in/yaml.v2"
+)
+
+// The `json`, `yaml` and `toml` modules let Starlark modules parse manifests
+// (e.g., package.json, Cargo.toml) and generate config files. Decoded
+// documents are plain Starlark values (dicts, lists, strings, numbers, bools
+// and None). JSON objects keep their document order; the YAML and TOML
+// decoders don't preserve key order, so their mappings are sorted by key to
+// keep evaluation deterministic.
+
+// jsonModule provides `json.encode()`, `json.decode()` and `json.indent()`.
+var jsonModule = starlarkjson.Module
+
+// yamlModule provides `yaml.decode()`.
+var yamlModule = &starlarkstruct.Module{
+	Name: "yaml",
+	Members: starlark.StringDict{
+		"decode": builtinWrapper("yaml.decode", starlarkYAMLDecode),
+	},
+}
+
+// tomlModule provides `toml.decode()`.
+var tomlModule = &starlarkstruct.Module{
+	Name: "toml",
+	Members: starlark.StringDict{
+		"decode": builtinWrapper("toml.decode", starlarkTOMLDecode),
+	},
+}
+
+// structBuiltin is the `struct(**kwargs)` builtin.
+var structBuiltin = starlark.NewBuiltin("struct", starlarkstruct.Make)
+
+func starlarkYAMLDecode(
+	args starlark.Tuple,
+	kwargs []starlark.Tuple,
+) (starlark.Value, error) {
+	var document string
+	if err := starlark.UnpackPositionalArgs(
+		"yaml.decode",
+		args,
+		kwargs,
+		1,
+		&document,
+	); err != nil {
+		return nil, err
+	}
+
+	var v interface{}
+	if err := yaml.Unmarshal([]byte(document), &v); err != nil {
+		return nil, err
+	}
+	return goToStarlark(v)
+}
+
+func starlarkTOMLDecode(
+	args starlark.Tuple,
+	kwargs []starlark.Tuple,
+) (starlark.Value, error) {
+	var document string
+	if err := starlark.UnpackPositionalArgs(
+		"toml.decode",
+		args,
+		kwargs,
+		1,
+		&document,
+	); err != nil {
+		return nil, err
+	}
+
+	var v map[string]interface{}
+	if _, err := toml.Decode(document, &v); err != nil {
+		return nil, err
+	}
+	return goToStarlark(v)
+}
+
+// goToStarlark converts a decoded document into plain Starlark values.
+func goToStarlark(v interface{}) (starlark.Value, error) {
+	switch x := v.(type) {
+	case nil:
+		return starlark.None, nil
+	case bool:
+		return starlark.Bool(x), nil
+	case string:
+		return starlark.String(x), nil
+	case int:
+		return starlark.MakeInt(x), nil
+	case int64:
+		return starlark.MakeInt64(x), nil
+	case uint64:
+		return starlark.MakeUint64(x), nil
+	case float64:
+		return starlark.Float(x), nil
+	case *big.Int:
+		return starlark.MakeBigInt(x), nil
+	case time.Time:
+		return starlark.String(x.Format(time.RFC3339Nano)), nil
+	case []interface{}:
+		values := make([]starlark.Value, len(x))
+		for i, elem := range x {
+			value, err := goToStarlark(elem)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Index %d", i)
+			}
+			values[i] = value
+		}
+		return starlark.NewList(values), nil
+	case []map[string]interface{}:
+		// TOML arrays of tables
+		values := make([]starlark.Value, len(x))
+		for i, elem := range x {
+			value, err := goToStarlark(elem)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Index %d", i)
+			}
+			values[i] = value
+		}
+		return starlark.NewList(values), nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(x))
+		for key := range x {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		d := starlark.NewDict(len(x))
+		for _, key := range keys {
+			value, err := goToStarlark(x[key])
+			if err != nil {
+				return nil, errors.Wrapf(err, "Key '%s'", key)
+			}
+			if err := d.SetKey(starlark.String(key), value); err != nil {
+				return nil, err
+			}
+		}
+		return d, nil
+	case map[interface{}]interface{}:
+		// YAML mappings may have non-string keys; convert the keys too and
+		// sort them by their string representation.
+		type entry struct {
+			key   starlark.Value
+			value interface{}
+		}
+		entries := make([]entry, 0, len(x))
+		for key, value := range x {
+			k, err := goToStarlark(key)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry{k, value})
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].key.String() < entries[j].key.String()
+		})
+
+		d := starlark.NewDict(len(x))
+		for _, e := range entries {
+			value, err := goToStarlark(e.value)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Key %s", e.key)
+			}
+			if err := d.SetKey(e.key, value); err != nil {
+				return nil, err
+			}
+		}
+		return d, nil
+	default:
+		return nil, errors.Errorf("Unsupported value type %T", v)
+	}
+}
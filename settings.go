@@ -0,0 +1,396 @@
+package main
+
+import (
+	"hash"
+	"hash/adler32"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// Build settings configure a build from the command line
+// (`--define name=value`). The `os` and `arch` settings are always defined
+// and default to the host platform (in `runtime.GOOS` and `runtime.GOARCH`
+// terms).
+//
+// Like toolchains, settings are resolved when targets are frozen rather than
+// when modules are evaluated: `setting(name)` is replaced by the setting's
+// value and `select({condition: value, ...})` by the value of the branch
+// whose condition matches. A target's ID therefore only changes with the
+// settings that it actually depends on, so each configuration's derivations
+// are cached side by side with the others'.
+
+// defaultSelectCondition is the `select()` condition which matches when no
+// other condition does.
+const defaultSelectCondition = "default"
+
+// buildSettings returns the settings for a build on the given platform with
+// the given `--define` flags.
+func buildSettings(
+	goos string,
+	goarch string,
+	defines map[string]string,
+) map[string]string {
+	settings := map[string]string{"os": goos, "arch": goarch}
+	for name, value := range defines {
+		settings[name] = value
+	}
+	return settings
+}
+
+//
+// Setting
+//
+
+// Setting is a reference to a build setting. It is resolved to the setting's
+// value when it is frozen.
+type Setting struct {
+	Name string
+
+	// Default is the value used when the setting isn't defined. It is only
+	// meaningful if HasDefault is true.
+	Default    string
+	HasDefault bool
+}
+
+// String implements the starlark.Value.String() method.
+func (s Setting) String() string { return "setting(" + s.Name + ")" }
+
+// Type implements the starlark.Value.Type() method.
+func (s Setting) Type() string { return "Setting" }
+
+// Freeze implements the starlark.Value.Freeze() method.
+func (s Setting) Freeze() {}
+
+// Truth implements the starlark.Value.Truth() method.
+func (s Setting) Truth() starlark.Bool { return starlark.True }
+
+// Hash32 implements the Arg.Hash32() method.
+func (s Setting) Hash32(h hash.Hash32) {
+	h.Write([]byte(s.Name))
+	if s.HasDefault {
+		h.Write([]byte(s.Default))
+	}
+}
+
+// Hash implements the starlark.Value.Hash() method.
+func (s Setting) Hash() (uint32, error) {
+	return starlark.String(s.Name).Hash()
+}
+
+// Attr implements the starlark.HasAttrs.Attr() method.
+func (s Setting) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "name":
+		return starlark.String(s.Name), nil
+	case "default":
+		if !s.HasDefault {
+			return starlark.None, nil
+		}
+		return starlark.String(s.Default), nil
+	default:
+		return nil, nil
+	}
+}
+
+// AttrNames implements the starlark.HasAttrs.AttrNames() method.
+func (s Setting) AttrNames() []string { return []string{"default", "name"} }
+
+// CompareSameType implements the starlark.Comparable.CompareSameType()
+// method.
+func (s Setting) CompareSameType(
+	op syntax.Token,
+	y starlark.Value,
+	depth int,
+) (bool, error) {
+	return compareEquality(op, s, y, func() (bool, error) {
+		return s == y.(Setting), nil
+	})
+}
+
+// starlarkSetting implements the `setting(name, default=None)` builtin.
+func starlarkSetting(
+	args starlark.Tuple,
+	kwargs []starlark.Tuple,
+) (starlark.Value, error) {
+	var name string
+	var def starlark.Value = starlark.None
+	if err := starlark.UnpackArgs(
+		"setting",
+		args,
+		kwargs,
+		"name",
+		&name,
+		"default?",
+		&def,
+	); err != nil {
+		return nil, err
+	}
+
+	s := Setting{Name: name}
+	switch x := def.(type) {
+	case starlark.NoneType:
+	case starlark.String:
+		s.Default, s.HasDefault = string(x), true
+	default:
+		return nil, errors.Errorf(
+			"TypeError: argument 'default': expected str or None; found %s",
+			def.Type(),
+		)
+	}
+	return s, nil
+}
+
+func (s Setting) freezeArg(f *freezer) (ArgValue, error) {
+	value, found := f.settings[s.Name]
+	if !found {
+		if !s.HasDefault {
+			return ArgValue{}, errors.Errorf(
+				"Build setting '%s' is not defined (pass `--define %s=<value>`)",
+				s.Name,
+				s.Name,
+			)
+		}
+		value = s.Default
+	}
+	return String(value).freezeArg(f)
+}
+
+//
+// Select
+//
+
+// Select is a value which depends on the build settings. It is resolved to
+// the value of the branch whose conditions all match when it is frozen.
+type Select struct {
+	Branches []SelectBranch
+}
+
+// SelectBranch is a single `condition: value` entry of a `select()`.
+type SelectBranch struct {
+	// Condition is the branch's condition as written, either
+	// `name=value[,name=value...]` or "default".
+	Condition string
+	Value     Arg
+
+	// Settings is the parsed condition: the setting values which must all
+	// match for the branch to be selected. It is nil for the default branch.
+	Settings map[string]string
+}
+
+// parseSelectCondition parses a `name=value[,name=value...]` condition.
+func parseSelectCondition(condition string) (map[string]string, error) {
+	settings := map[string]string{}
+	for _, term := range strings.Split(condition, ",") {
+		i := strings.Index(term, "=")
+		if i < 1 {
+			return nil, errors.Errorf(
+				"Invalid condition '%s': expected 'name=value[,name=value...]' "+
+					"or '%s'",
+				condition,
+				defaultSelectCondition,
+			)
+		}
+		name, value := strings.TrimSpace(term[:i]), strings.TrimSpace(term[i+1:])
+		if other, found := settings[name]; found && other != value {
+			return nil, errors.Errorf(
+				"Invalid condition '%s': setting '%s' can't be both '%s' and '%s'",
+				condition,
+				name,
+				other,
+				value,
+			)
+		}
+		settings[name] = value
+	}
+	return settings, nil
+}
+
+// matches returns true if every setting in the branch's condition has the
+// required value.
+func (b *SelectBranch) matches(settings map[string]string) bool {
+	for name, value := range b.Settings {
+		if actual, found := settings[name]; !found || actual != value {
+			return false
+		}
+	}
+	return true
+}
+
+// String implements the starlark.Value.String() method.
+func (s *Select) String() string {
+	branches := make([]string, len(s.Branches))
+	for i, branch := range s.Branches {
+		branches[i] = starlark.String(branch.Condition).String() + ": " +
+			branch.Value.String()
+	}
+	return "select({" + strings.Join(branches, ", ") + "})"
+}
+
+// Type implements the starlark.Value.Type() method.
+func (s *Select) Type() string { return "Select" }
+
+// Freeze implements the starlark.Value.Freeze() method.
+func (s *Select) Freeze() {}
+
+// Truth implements the starlark.Value.Truth() method.
+func (s *Select) Truth() starlark.Bool { return s != nil }
+
+// Hash32 implements the Arg.Hash32() method.
+func (s *Select) Hash32(h hash.Hash32) {
+	for _, branch := range s.Branches {
+		h.Write([]byte(branch.Condition))
+		branch.Value.Hash32(h)
+	}
+}
+
+// Hash implements the starlark.Value.Hash() method.
+func (s *Select) Hash() (uint32, error) {
+	h := adler32.New()
+	s.Hash32(h)
+	return h.Sum32(), nil
+}
+
+// CompareSameType implements the starlark.Comparable.CompareSameType()
+// method.
+func (s *Select) CompareSameType(
+	op syntax.Token,
+	y starlark.Value,
+	depth int,
+) (bool, error) {
+	return compareEquality(op, s, y, func() (bool, error) {
+		other := y.(*Select)
+		if len(s.Branches) != len(other.Branches) {
+			return false, nil
+		}
+		for i, branch := range s.Branches {
+			if branch.Condition != other.Branches[i].Condition {
+				return false, nil
+			}
+			equal, err := starlark.EqualDepth(
+				argToStarlarkValue(branch.Value),
+				argToStarlarkValue(other.Branches[i].Value),
+				depth-1,
+			)
+			if err != nil || !equal {
+				return false, err
+			}
+		}
+		return true, nil
+	})
+}
+
+// starlarkSelect implements the `select(branches)` builtin. `branches` is a
+// dict whose keys are conditions and whose values are target arguments.
+func starlarkSelect(
+	args starlark.Tuple,
+	kwargs []starlark.Tuple,
+) (starlark.Value, error) {
+	var branches *starlark.Dict
+	if err := starlark.UnpackPositionalArgs(
+		"select",
+		args,
+		kwargs,
+		1,
+		&branches,
+	); err != nil {
+		return nil, err
+	}
+	if branches.Len() < 1 {
+		return nil, errors.Errorf("Expected at least one branch")
+	}
+
+	var s Select
+	for _, item := range branches.Items() {
+		condition, ok := item[0].(starlark.String)
+		if !ok {
+			return nil, errors.Errorf(
+				"TypeError: expected condition of type str; found %s",
+				item[0].Type(),
+			)
+		}
+		value, err := starlarkValueToArg(item[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "Condition '%s'", condition)
+		}
+		branch := SelectBranch{Condition: string(condition), Value: value}
+		if branch.Condition != defaultSelectCondition {
+			if branch.Settings, err = parseSelectCondition(
+				branch.Condition,
+			); err != nil {
+				return nil, err
+			}
+		}
+		s.Branches = append(s.Branches, branch)
+	}
+	return &s, nil
+}
+
+// resolve picks the branch for the given settings: the only non-default
+// branch which matches or, if none do, the default branch. It is an error
+// for more than one non-default branch to match.
+func (s *Select) resolve(settings map[string]string) (Arg, error) {
+	var selected, def *SelectBranch
+	for i := range s.Branches {
+		branch := &s.Branches[i]
+		if branch.Settings == nil {
+			def = branch
+			continue
+		}
+		if !branch.matches(settings) {
+			continue
+		}
+		if selected != nil {
+			return nil, errors.Errorf(
+				"Ambiguous select(): conditions '%s' and '%s' both match",
+				selected.Condition,
+				branch.Condition,
+			)
+		}
+		selected = branch
+	}
+	if selected == nil {
+		selected = def
+	}
+	if selected == nil {
+		return nil, errors.Errorf(
+			"No select() condition matches the build settings (%s) and "+
+				"there is no '%s' condition",
+			s.relevantSettings(settings),
+			defaultSelectCondition,
+		)
+	}
+	return selected.Value, nil
+}
+
+// relevantSettings formats the values of the settings which the select's
+// conditions refer to (for error messages).
+func (s *Select) relevantSettings(settings map[string]string) string {
+	names := map[string]struct{}{}
+	for _, branch := range s.Branches {
+		for name := range branch.Settings {
+			names[name] = struct{}{}
+		}
+	}
+	pairs := make([]string, 0, len(names))
+	for name := range names {
+		value, found := settings[name]
+		if !found {
+			value = "<undefined>"
+		}
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
+
+func (s *Select) freezeArg(f *freezer) (ArgValue, error) {
+	value, err := s.resolve(f.settings)
+	if err != nil {
+		return ArgValue{}, err
+	}
+	return value.freezeArg(f)
+}
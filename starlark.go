@@ -12,6 +12,7 @@ import (
 
 	"github.com/pkg/errors"
 	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
 )
 
 //
@@ -37,6 +38,31 @@ func (p Path) Hash() (uint32, error) {
 	return adler32.Checksum([]byte(p)), nil
 }
 
+// Attr implements the starlark.HasAttrs.Attr() method.
+func (p Path) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "path":
+		return starlark.String(p), nil
+	default:
+		return nil, nil
+	}
+}
+
+// AttrNames implements the starlark.HasAttrs.AttrNames() method.
+func (p Path) AttrNames() []string { return []string{"path"} }
+
+// CompareSameType implements the starlark.Comparable.CompareSameType()
+// method.
+func (p Path) CompareSameType(
+	op syntax.Token,
+	y starlark.Value,
+	depth int,
+) (bool, error) {
+	return compareEquality(op, p, y, func() (bool, error) {
+		return p == y.(Path), nil
+	})
+}
+
 // starlarkPath parses Starlark kw/args and returns a corresponding `Path`
 func starlarkPath(
 	args starlark.Tuple,
@@ -78,14 +104,22 @@ func (gg GlobGroup) Type() string {
 // Freeze implements the starlark.Value.Freeze() method.
 func (gg GlobGroup) Freeze() {}
 
-// Truth implements the starlark.Value.Truth() method.
-func (gg GlobGroup) Truth() starlark.Bool { return starlark.True }
+// Truth implements the starlark.Value.Truth() method. A glob group is truthy
+// if it has at least one pattern.
+func (gg GlobGroup) Truth() starlark.Bool { return len(gg.Patterns) > 0 }
 
 // Hash32 implements the Arg.Hash32() method.
 func (gg GlobGroup) Hash32(h hash.Hash32) {
-	for _, p := range gg {
+	for _, p := range gg.Patterns {
 		h.Write([]byte(p))
 	}
+	for _, p := range gg.Exclude {
+		h.Write([]byte("!"))
+		h.Write([]byte(p))
+	}
+	if gg.IgnoreFiles {
+		h.Write([]byte{1})
+	}
 }
 
 // Hash implements the starlark.Value.Hash() method.
@@ -95,6 +129,40 @@ func (gg GlobGroup) Hash() (uint32, error) {
 	return h.Sum32(), nil
 }
 
+// Attr implements the starlark.HasAttrs.Attr() method.
+func (gg GlobGroup) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "patterns":
+		return stringsToList(gg.Patterns), nil
+	case "exclude":
+		return stringsToList(gg.Exclude), nil
+	case "gitignore":
+		return starlark.Bool(gg.IgnoreFiles), nil
+	default:
+		return nil, nil
+	}
+}
+
+// AttrNames implements the starlark.HasAttrs.AttrNames() method.
+func (gg GlobGroup) AttrNames() []string {
+	return []string{"exclude", "gitignore", "patterns"}
+}
+
+// CompareSameType implements the starlark.Comparable.CompareSameType()
+// method.
+func (gg GlobGroup) CompareSameType(
+	op syntax.Token,
+	y starlark.Value,
+	depth int,
+) (bool, error) {
+	return compareEquality(op, gg, y, func() (bool, error) {
+		other := y.(GlobGroup)
+		return stringsEqual(gg.Patterns, other.Patterns) &&
+			stringsEqual(gg.Exclude, other.Exclude) &&
+			gg.IgnoreFiles == other.IgnoreFiles, nil
+	})
+}
+
 //
 // String
 //
@@ -110,7 +178,7 @@ func (s String) Hash32(h hash.Hash32) { h.Write([]byte(s)) }
 func (s *Sub) Type() string { return "Sub" }
 
 // Truth implements the starlark.Value.Truth() method.
-func (s *Sub) Truth() starlark.Bool { return s == nil }
+func (s *Sub) Truth() starlark.Bool { return s != nil }
 
 // Hash32 implements the Arg.Hash32() method.
 func (s *Sub) Hash32(h hash.Hash32) {
@@ -131,6 +199,62 @@ func (s *Sub) Hash() (uint32, error) {
 // Freeze implements the starlark.Value.Freeze() method.
 func (s *Sub) Freeze() {}
 
+// Attr implements the starlark.HasAttrs.Attr() method.
+func (s *Sub) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "format":
+		return starlark.String(s.Format), nil
+	case "substitutions":
+		d := starlark.NewDict(len(s.Substitutions))
+		for _, sub := range s.Substitutions {
+			if err := d.SetKey(
+				starlark.String(sub.Key),
+				argToStarlarkValue(sub.Value),
+			); err != nil {
+				return nil, err
+			}
+		}
+		d.Freeze()
+		return d, nil
+	default:
+		return nil, nil
+	}
+}
+
+// AttrNames implements the starlark.HasAttrs.AttrNames() method.
+func (s *Sub) AttrNames() []string {
+	return []string{"format", "substitutions"}
+}
+
+// CompareSameType implements the starlark.Comparable.CompareSameType()
+// method.
+func (s *Sub) CompareSameType(
+	op syntax.Token,
+	y starlark.Value,
+	depth int,
+) (bool, error) {
+	return compareEquality(op, s, y, func() (bool, error) {
+		other := y.(*Sub)
+		if s.Format != other.Format ||
+			len(s.Substitutions) != len(other.Substitutions) {
+			return false, nil
+		}
+		for i, sub := range s.Substitutions {
+			if sub.Key != other.Substitutions[i].Key {
+				return false, nil
+			}
+			if eq, err := starlark.EqualDepth(
+				argToStarlarkValue(sub.Value),
+				argToStarlarkValue(other.Substitutions[i].Value),
+				depth-1,
+			); err != nil || !eq {
+				return false, err
+			}
+		}
+		return true, nil
+	})
+}
+
 // starlarkSub parses Starlark kw/args and returns a corresponding `*Sub`
 // wrapped in a `starlark.Value` interface. This is used in the `sub()`
 // starlark predefined/builtin function.
@@ -193,7 +317,7 @@ func (t *Target) Type() string { return "Target" }
 func (t *Target) Freeze() {}
 
 // Truth implements the starlark.Value.Truth() method.
-func (t *Target) Truth() starlark.Bool { return starlark.Bool(t == nil) }
+func (t *Target) Truth() starlark.Bool { return t != nil }
 
 // Hash32 implements the Arg.Hash32() method.
 func (t *Target) Hash32(h hash.Hash32) {
@@ -205,6 +329,7 @@ func (t *Target) Hash32(h hash.Hash32) {
 	for _, env := range t.Env {
 		h.Write([]byte(env))
 	}
+	h.Write([]byte(t.OutputHash))
 }
 
 // Hash implements the starlark.Value.Hash() method.
@@ -214,6 +339,82 @@ func (t *Target) Hash() (uint32, error) {
 	return h.Sum32(), nil
 }
 
+// Attr implements the starlark.HasAttrs.Attr() method. The returned `args`
+// and `env` lists are frozen copies; modifying a target requires building a
+// new one with `target()`.
+func (t *Target) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "name":
+		return starlark.String(t.Name), nil
+	case "builder":
+		return starlark.String(t.Builder), nil
+	case "args":
+		values := make([]starlark.Value, len(t.Args))
+		for i, arg := range t.Args {
+			values[i] = argToStarlarkValue(arg)
+		}
+		l := starlark.NewList(values)
+		l.Freeze()
+		return l, nil
+	case "env":
+		return stringsToList(t.Env), nil
+	case "output_hash":
+		if t.OutputHash == "" {
+			return starlark.None, nil
+		}
+		return starlark.String(t.OutputHash), nil
+	case "visibility":
+		return stringsToList(t.visibility()), nil
+	default:
+		return nil, nil
+	}
+}
+
+// AttrNames implements the starlark.HasAttrs.AttrNames() method.
+func (t *Target) AttrNames() []string {
+	return []string{
+		"args",
+		"builder",
+		"env",
+		"name",
+		"output_hash",
+		"visibility",
+	}
+}
+
+// CompareSameType implements the starlark.Comparable.CompareSameType()
+// method. Two targets are equal if they have the same name, builder, args,
+// env and output hash.
+func (t *Target) CompareSameType(
+	op syntax.Token,
+	y starlark.Value,
+	depth int,
+) (bool, error) {
+	return compareEquality(op, t, y, func() (bool, error) {
+		other := y.(*Target)
+		if t == other {
+			return true, nil
+		}
+		if t.Name != other.Name ||
+			t.Builder != other.Builder ||
+			t.OutputHash != other.OutputHash ||
+			!stringsEqual(t.Env, other.Env) ||
+			len(t.Args) != len(other.Args) {
+			return false, nil
+		}
+		for i, arg := range t.Args {
+			if eq, err := starlark.EqualDepth(
+				argToStarlarkValue(arg),
+				argToStarlarkValue(other.Args[i]),
+				depth-1,
+			); err != nil || !eq {
+				return false, err
+			}
+		}
+		return true, nil
+	})
+}
+
 // starlarkTarget parses Starlark kw/args and returns a corresponding `*Target`
 // wrapped in a `starlark.Value` interface. This is used in the `target()`
 // starlark predefined/builtin function.
@@ -230,22 +431,11 @@ func starlarkTarget(
 		)
 	}
 
-	// Make sure we have exactly the right number of keyword arguments.
-	if len(kwargs) != 4 {
-		found := make([]string, len(kwargs))
-		for i, kwarg := range kwargs {
-			found[i] = string(kwarg[0].(starlark.String))
-		}
-		return nil, errors.Errorf(
-			"Expected kwargs {name, builder, args, env}; found {%s}",
-			strings.Join(found, ", "),
-		)
-	}
-
 	// Iterate through the keyword arguments and grab the values for each
 	// kwarg, putting them into the right `starlark.Value` variable. We'll
 	// convert these to Go values for the `*Target` struct later.
 	var nameKwarg, builderKwarg, argsKwarg, envKwarg starlark.Value
+	var outputHashKwarg, visibilityKwarg starlark.Value
 	for _, kwarg := range kwargs {
 		switch key := kwarg[0].(starlark.String); key {
 		case "name":
@@ -268,11 +458,42 @@ func starlarkTarget(
 				return nil, errors.Errorf("Duplicate argument 'env' found")
 			}
 			envKwarg = kwarg[1]
+		case "output_hash":
+			if outputHashKwarg != nil {
+				return nil, errors.Errorf(
+					"Duplicate argument 'output_hash' found",
+				)
+			}
+			outputHashKwarg = kwarg[1]
+		case "visibility":
+			if visibilityKwarg != nil {
+				return nil, errors.Errorf(
+					"Duplicate argument 'visibility' found",
+				)
+			}
+			visibilityKwarg = kwarg[1]
 		default:
 			return nil, errors.Errorf("Unexpected argument '%s' found", key)
 		}
 	}
 
+	// Make sure all of the required keyword arguments were passed.
+	if nameKwarg == nil ||
+		builderKwarg == nil ||
+		argsKwarg == nil ||
+		envKwarg == nil {
+		found := make([]string, len(kwargs))
+		for i, kwarg := range kwargs {
+			found[i] = string(kwarg[0].(starlark.String))
+		}
+		return nil, errors.Errorf(
+			"Expected kwargs {name, builder, args, env[, output_hash, "+
+				"visibility]}; "+
+				"found {%s}",
+			strings.Join(found, ", "),
+		)
+	}
+
 	// Ok, now we've made sure we have values for the required keyword args and
 	// that no additional arguments were passed. Next, we'll convert these
 	// `starlark.Value`-typed variables into Go values for the output `*Target`
@@ -336,13 +557,42 @@ func starlarkTarget(
 		env[i] = string(str)
 	}
 
+	// Validate that the optional `output_hash` kwarg was a string.
+	var outputHash starlark.String
+	if outputHashKwarg != nil && outputHashKwarg != starlark.None {
+		if outputHash, ok = outputHashKwarg.(starlark.String); !ok {
+			return nil, errors.Errorf(
+				"TypeError: argument 'output_hash': expected str, got %s",
+				outputHashKwarg.Type(),
+			)
+		}
+		if err := validateOutputHash(string(outputHash)); err != nil {
+			return nil, errors.Wrap(err, "Argument 'output_hash'")
+		}
+	}
+
+	// Validate that the optional `visibility` kwarg was a list of
+	// visibility patterns.
+	var visibility []string
+	if visibilityKwarg != nil && visibilityKwarg != starlark.None {
+		var err error
+		if visibility, err = starlarkStringList(visibilityKwarg); err != nil {
+			return nil, errors.Wrap(err, "Argument 'visibility'")
+		}
+		if err := validateVisibility(visibility); err != nil {
+			return nil, errors.Wrap(err, "Argument 'visibility'")
+		}
+	}
+
 	// By now, all of the fields have been validated, so build and return the
 	// final `*Target`.
 	return &Target{
-		Name:    string(name),
-		Builder: string(builder),
-		Args:    args_,
-		Env:     env,
+		Name:       string(name),
+		Builder:    string(builder),
+		Args:       args_,
+		Env:        env,
+		OutputHash: string(outputHash),
+		Visibility: visibility,
 	}, nil
 }
 
@@ -365,6 +615,66 @@ func starlarkValueToArg(v starlark.Value) (Arg, error) {
 	}
 }
 
+// argToStarlarkValue is the inverse of `starlarkValueToArg`; it converts an
+// `Arg` back into a Starlark value so it can be inspected from Starlark.
+func argToStarlarkValue(arg Arg) starlark.Value {
+	switch x := arg.(type) {
+	case starlark.Value:
+		return x
+	case String:
+		return starlark.String(x)
+	default:
+		panic(fmt.Sprintf("Arg type %T is not a starlark value", arg))
+	}
+}
+
+// compareEquality DRYs up the `CompareSameType()` implementations for types
+// which only support (in)equality. `eq` is only invoked for `==` and `!=`.
+func compareEquality(
+	op syntax.Token,
+	x starlark.Value,
+	y starlark.Value,
+	eq func() (bool, error),
+) (bool, error) {
+	switch op {
+	case syntax.EQL:
+		return eq()
+	case syntax.NEQ:
+		result, err := eq()
+		return !result, err
+	default:
+		return false, errors.Errorf(
+			"%s %s %s not implemented",
+			x.Type(),
+			op,
+			y.Type(),
+		)
+	}
+}
+
+// stringsToList converts a string slice into a frozen Starlark list.
+func stringsToList(ss []string) *starlark.List {
+	values := make([]starlark.Value, len(ss))
+	for i, s := range ss {
+		values[i] = starlark.String(s)
+	}
+	l := starlark.NewList(values)
+	l.Freeze()
+	return l
+}
+
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 //
 // execFile
 //
@@ -395,29 +705,80 @@ func builtinWrapper(
 // loadFunc is a signature for a starlark loader function.
 type loadFunc func(*starlark.Thread, string) (starlark.StringDict, error)
 
+// packageScopes maps the root directory of each package in a workspace
+// (including the workspace itself) to the packages which its modules can load
+// from, by the names that the package uses for them.
+type packageScopes map[string]map[string]string
+
+// vendoredScopes returns the scopes for a workspace whose packages were
+// vendored without declaring their dependencies: every package loads from the
+// workspace's packages.
+func vendoredScopes(root string, packages map[string]string) packageScopes {
+	scopes := packageScopes{root: packages}
+	for _, dir := range packages {
+		scopes[dir] = packages
+	}
+	return scopes
+}
+
 // makeLoader makes a load function for a given workspace.
-func makeLoader(root string, packages map[string]string) loadFunc {
+func makeLoader(root string, scopes packageScopes) loadFunc {
 	return makeLoaderHelper(
 		root,
-		packages,
+		scopes,
 		map[string]*cacheEntry{},
-		starlark.StringDict{
-			"target": builtinWrapper("target", starlarkTarget),
-			"sub":    builtinWrapper("sub", starlarkSub),
-			"path":   builtinWrapper("path", starlarkPath),
-			"glob":   builtinWrapper("glob", starlarkGlob),
-		},
+		starlarkBuiltins(),
 	)
 }
 
+// starlarkBuiltins returns the predefined globals available to every module.
+func starlarkBuiltins() starlark.StringDict {
+	return starlark.StringDict{
+		"target": builtinWrapper("target", starlarkTarget),
+		"sub":    builtinWrapper("sub", starlarkSub),
+		"path":   builtinWrapper("path", starlarkPath),
+		"glob":   builtinWrapper("glob", starlarkGlob),
+
+		"host_tool": builtinWrapper("host_tool", starlarkHostTool),
+		"toolchain": builtinWrapper("toolchain", starlarkToolchain),
+		"setting":   builtinWrapper("setting", starlarkSetting),
+		"select":    builtinWrapper("select", starlarkSelect),
+
+		"write_file": builtinWrapper("write_file", starlarkWriteFile),
+		"directory":  builtinWrapper("directory", starlarkDirectory),
+		"merge":      builtinWrapper("merge", starlarkMerge),
+		"tree":       builtinWrapper("tree", starlarkTree),
+		"tar":        builtinWrapper("tar", starlarkTar),
+		"zip":        builtinWrapper("zip", starlarkZip),
+		"extract":    builtinWrapper("extract", starlarkExtract),
+		"oci_image":  builtinWrapper("oci_image", starlarkOCIImage),
+
+		"read_file": threadBuiltinWrapper("read_file", starlarkReadFile),
+		"list_dir":  threadBuiltinWrapper("list_dir", starlarkListDir),
+		"exists":    threadBuiltinWrapper("exists", starlarkExists),
+
+		"json":   jsonModule,
+		"yaml":   yamlModule,
+		"toml":   tomlModule,
+		"gomod":  gomodModule,
+		"struct": structBuiltin,
+	}
+}
+
 type cacheEntry struct {
 	globals starlark.StringDict
 	err     error
+
+	// inputs are what the module's evaluation read (see `moduleInputs`).
+	inputs moduleInputs
 }
 
+// makeLoaderHelper makes a load function for the modules in the package at
+// `root`. The cache is keyed by file path since the same address refers to
+// different modules in different packages.
 func makeLoaderHelper(
 	root string,
-	packages map[string]string,
+	scopes packageScopes,
 	cache map[string]*cacheEntry,
 	builtins starlark.StringDict,
 ) loadFunc {
@@ -425,32 +786,31 @@ func makeLoaderHelper(
 		th *starlark.Thread,
 		addr string,
 	) (starlark.StringDict, error) {
-		e, ok := cache[addr]
+		// Parse the address into a (package, module) tuple. If the package is
+		// an empty string, then it's the same package as the caller module.
+		pkg, module := parseModule(addr)
+
+		// Get the file path for the given (pkg, module)
+		packageRoot, filePath, err := resolveModule(
+			root,
+			scopes[root],
+			pkg,
+			module,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		e, ok := cache[filePath]
 		if e == nil {
-			// Addr is already in the process of being loaded.
+			// The module is already in the process of being loaded.
 			if ok {
 				return nil, errors.Errorf("Cycle in load graph")
 			}
 
-			// Add a placeholder to indicate that the addr loading is in
+			// Add a placeholder to indicate that the module loading is in
 			// progress.
-			cache[addr] = nil
-
-			// Parse the address into a (package, module) tuple. If the
-			// package is an empty string, then it's the same package as the
-			// caller module.
-			pkg, module := parseModule(addr)
-
-			// Get the file path for the given (pkg, module)
-			packageRoot, filePath, err := resolveModule(
-				root,
-				packages,
-				pkg,
-				module,
-			)
-			if err != nil {
-				return nil, err
-			}
+			cache[filePath] = nil
 
 			// Read the target module, if any
 			data, err := ioutil.ReadFile(filePath)
@@ -465,18 +825,43 @@ func makeLoaderHelper(
 				return nil, errors.Wrapf(err, "Loading module '%s'", module)
 			}
 
-			// Execute the target module in a new thread.
-			globals, err := starlark.ExecFile(
-				&starlark.Thread{
-					Name: filePath,
-					Load: makeLoaderHelper(packageRoot, packages, cache, builtins),
-				},
-				addr,
-				data,
-				builtins,
-			)
-			e = &cacheEntry{globals, err}
-			cache[addr] = e
+			// Execute the target module in a new thread. Dhall modules are
+			// evaluated by the Dhall front end; everything else is Starlark.
+			thread := &starlark.Thread{
+				Name: filePath,
+				Load: makeLoaderHelper(packageRoot, scopes, cache, builtins),
+			}
+			label := newModuleLabel(packageRoot, filePath)
+			inputs := moduleInputs{}
+			labels, _ := th.Local(moduleLabelsLocal).(map[string]moduleLabel)
+			if labels == nil {
+				labels = map[string]moduleLabel{}
+			}
+			labels[filePath] = label
+			thread.SetLocal(packageRootLocal, packageRoot)
+			thread.SetLocal(moduleLabelLocal, label)
+			thread.SetLocal(moduleLabelsLocal, labels)
+			thread.SetLocal(moduleInputsLocal, inputs)
+			var globals starlark.StringDict
+			if strings.HasSuffix(filePath, dhallModuleSuffix) {
+				globals, err = execDhallModule(thread, filePath, data)
+			} else {
+				// The module is evaluated under its file path so that its
+				// call frames can be attributed to it (see `labelTarget()`).
+				globals, err = starlark.ExecFile(
+					thread,
+					filePath,
+					data,
+					labelBuiltins(builtins, label),
+				)
+			}
+			e = &cacheEntry{globals: globals, err: err, inputs: inputs}
+			cache[filePath] = e
+		}
+
+		// A module depends on everything that the modules it loads read.
+		if mi, ok := th.Local(moduleInputsLocal).(moduleInputs); ok {
+			mi.merge(e.inputs)
 		}
 		return e.globals, e.err
 	}
@@ -503,10 +888,11 @@ func resolveModule(
 		return "", "", moduleNotFoundErr{pkg: pkg, module: module}
 	}
 
-	// If the module doesn't have the suffix '.star', then assume it's
-	// the default file in a directory.
+	// If the module doesn't have the suffix '.star' or '.dhall', then assume
+	// it's the default file in a directory.
 	path := filepath.Join(root, module)
-	if !strings.HasSuffix(module, ".star") {
+	if !strings.HasSuffix(module, ".star") &&
+		!strings.HasSuffix(module, dhallModuleSuffix) {
 		path = filepath.Join(path, "default.star")
 	}
 
@@ -532,25 +918,76 @@ func (err moduleNotFoundErr) Error() string {
 	)
 }
 
+// starlarkGlob parses Starlark kw/args and returns a corresponding
+// `GlobGroup`. Positional arguments are include patterns; the optional
+// `exclude` kwarg is a list of patterns to remove from the matches, and the
+// optional `gitignore` kwarg excludes files matched by the package's
+// `.gitignore` and `.g8rignore` files.
 func starlarkGlob(
 	args starlark.Tuple,
 	kwargs []starlark.Tuple,
 ) (starlark.Value, error) {
-	if len(kwargs) != 0 {
-		return nil, errors.Errorf(
-			"Expected exactly 0 positional arguments; found %d",
-			len(kwargs),
-		)
+	var gg GlobGroup
+	gg.Patterns = make([]string, len(args))
+	for i, arg := range args {
+		s, ok := arg.(starlark.String)
+		if !ok {
+			return nil, errors.Errorf(
+				"TypeError: argument %d: expected str; found %s",
+				i,
+				arg.Type(),
+			)
+		}
+		gg.Patterns[i] = string(s)
 	}
 
-	globs := make(GlobGroup, len(args))
-	for i, arg := range args {
-		if s, ok := arg.(starlark.String); ok {
-			globs[i] = string(s)
+	for _, kwarg := range kwargs {
+		switch key := kwarg[0].(starlark.String); key {
+		case "exclude":
+			exclude, err := starlarkStringList(kwarg[1])
+			if err != nil {
+				return nil, errors.Wrap(err, "Argument 'exclude'")
+			}
+			gg.Exclude = exclude
+		case "gitignore":
+			b, ok := kwarg[1].(starlark.Bool)
+			if !ok {
+				return nil, errors.Errorf(
+					"TypeError: argument 'gitignore': expected bool; found %s",
+					kwarg[1].Type(),
+				)
+			}
+			gg.IgnoreFiles = bool(b)
+		default:
+			return nil, errors.Errorf("Unexpected argument '%s' found", key)
 		}
 	}
 
-	return globs, nil
+	return gg, nil
+}
+
+// starlarkStringList converts a Starlark list of strings into a `[]string`.
+func starlarkStringList(v starlark.Value) ([]string, error) {
+	l, ok := v.(*starlark.List)
+	if !ok {
+		return nil, errors.Errorf(
+			"TypeError: expected list; found %s",
+			v.Type(),
+		)
+	}
+	ss := make([]string, l.Len())
+	for i := range ss {
+		s, ok := l.Index(i).(starlark.String)
+		if !ok {
+			return nil, errors.Errorf(
+				"TypeError: element %d: expected str; found %s",
+				i,
+				l.Index(i).Type(),
+			)
+		}
+		ss[i] = string(s)
+	}
+	return ss, nil
 }
 
 func parseModule(s string) (pkg, mod string) {
@@ -1,7 +1,15 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.starlark.net/starlark"
 )
 
 func TestResolveModule(t *testing.T) {
@@ -91,3 +99,1213 @@ func TestResolveModule(t *testing.T) {
 		})
 	}
 }
+
+func TestTargetAttrs(t *testing.T) {
+	if err := withTempDir(func(root string) error {
+		if err := ioutil.WriteFile(
+			filepath.Join(root, "default.star"),
+			[]byte(`
+dep = target(name="dep", builder="bash", args=["-c", "touch $out"], env=[])
+t = target(
+    name = "t",
+    builder = "bash",
+    args = ["-c", sub("cat ${Dep}", Dep=dep), path("foo"), glob("*.go")],
+    env = ["A=b"],
+)
+copy = target(name=t.name, builder=t.builder, args=t.args, env=t.env)
+
+name = t.name
+builder = t.builder
+env = t.env
+dep_name = t.args[1].substitutions["Dep"].name
+format = t.args[1].format
+path_ = t.args[2].path
+patterns = t.args[3].patterns
+equal = t == copy and t != dep and path("foo") == path("foo")
+truthy = bool(t) and bool(t.args[1]) and bool(glob("*")) and not glob()
+`),
+			0644,
+		); err != nil {
+			return err
+		}
+
+		globals, err := execModule("", makeLoader(root, nil))
+		if err != nil {
+			return err
+		}
+
+		for name, wanted := range map[string]string{
+			"name":     `"t"`,
+			"builder":  `"bash"`,
+			"env":      `["A=b"]`,
+			"dep_name": `"dep"`,
+			"format":   `"cat ${Dep}"`,
+			"path_":    `"foo"`,
+			"patterns": `["*.go"]`,
+			"equal":    "True",
+			"truthy":   "True",
+		} {
+			if got := globals[name].String(); got != wanted {
+				return errors.Errorf(
+					"Global '%s': wanted %s; got %s",
+					name,
+					wanted,
+					got,
+				)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileBuiltins(t *testing.T) {
+	files := map[string]string{
+		"default.star": `
+load("lib.star", "versions")
+all_versions = versions
+names = list_dir()
+has_versions = exists("versions.txt")
+has_missing = exists("missing.txt")
+`,
+		"lib.star":     `versions = read_file("versions.txt").splitlines()`,
+		"versions.txt": "go1.14\ngo1.15\n",
+		"sub/file":     "",
+		"escape.star":  `read_file("../secret")`,
+	}
+
+	if err := withTempDir(func(root string) error {
+		for relPath, contents := range files {
+			filePath := filepath.Join(root, relPath)
+			if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(
+				filePath,
+				[]byte(contents),
+				0644,
+			); err != nil {
+				return err
+			}
+		}
+
+		cache := map[string]*cacheEntry{}
+		load := makeLoaderHelper(root, nil, cache, starlarkBuiltins())
+		globals, err := execModule("", load)
+		if err != nil {
+			return err
+		}
+
+		for name, wanted := range map[string]string{
+			"all_versions": `["go1.14", "go1.15"]`,
+			"names": `["default.star", "escape.star", "lib.star", "sub/", ` +
+				`"versions.txt"]`,
+			"has_versions": "True",
+			"has_missing":  "False",
+		} {
+			if got := globals[name].String(); got != wanted {
+				return errors.Errorf(
+					"Global '%s': wanted %s; got %s",
+					name,
+					wanted,
+					got,
+				)
+			}
+		}
+
+		if _, err := execModule("escape.star", load); err == nil {
+			return errors.Errorf("Wanted error reading outside of the package")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileBuiltins_inputs(t *testing.T) {
+	if err := withTempDir(func(root string) error {
+		freeze := func(versions string) (*Derivation, error) {
+			if err := writeTestFiles(root, map[string]string{
+				"lib.star": `versions = read_file("versions.txt").splitlines()`,
+				"default.star": `
+load("lib.star", "versions")
+tool = target(name = "tool", builder = "bash", args = [versions[0]], env = [])
+`,
+				"versions.txt": versions,
+			}); err != nil {
+				return nil, err
+			}
+			globals, err := execModule("", makeLoader(root, nil))
+			if err != nil {
+				return nil, err
+			}
+			target, ok := globals["tool"].(*Target)
+			if !ok {
+				return nil, errors.Errorf("Wanted a target; got %s", globals["tool"])
+			}
+			if _, ok := target.Inputs[filepath.Join(root, "versions.txt")]; !ok {
+				return nil, errors.Errorf(
+					"Wanted versions.txt among the target's inputs; got %v",
+					target.Inputs,
+				)
+			}
+			return FreezeTarget(
+				root,
+				hashAlgorithms["sha256"],
+				newTestCache(),
+				nil,
+				nil,
+				nil,
+				target,
+			)
+		}
+
+		// Only the unused second line changes, so the target's args are the
+		// same but its ID must not be.
+		before, err := freeze("go1.14\ngo1.15\n")
+		if err != nil {
+			return err
+		}
+		after, err := freeze("go1.14\ngo1.16\n")
+		if err != nil {
+			return err
+		}
+		if before.ID == after.ID {
+			return errors.Errorf(
+				"Wanted a new derivation ID after editing a file that the " +
+					"module read",
+			)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSerializationBuiltins(t *testing.T) {
+	if err := withTempDir(func(root string) error {
+		if err := ioutil.WriteFile(
+			filepath.Join(root, "default.star"),
+			[]byte(`
+manifest = json.decode('{"name": "app", "deps": {"b": "2", "a": "1"}}')
+encoded = json.encode(struct(name=manifest["name"], count=2))
+versions = yaml.decode("""
+go: "1.14"
+tools:
+  - gofmt
+  - golint
+1: one
+""")
+cargo = toml.decode("""
+[package]
+name = "crate"
+version = "0.1.0"
+
+[dependencies]
+serde = "1.0"
+""")
+s = struct(a=1, b="two")
+fields = [s.a, s.b]
+`),
+			0644,
+		); err != nil {
+			return err
+		}
+
+		globals, err := execModule("", makeLoader(root, nil))
+		if err != nil {
+			return err
+		}
+
+		for name, wanted := range map[string]string{
+			"manifest": `{"name": "app", "deps": {"b": "2", "a": "1"}}`,
+			"encoded":  `"{\"count\":2,\"name\":\"app\"}"`,
+			"versions": `{"go": "1.14", "tools": ["gofmt", "golint"], 1: "one"}`,
+			"cargo": `{"dependencies": {"serde": "1.0"}, ` +
+				`"package": {"name": "crate", "version": "0.1.0"}}`,
+			"fields": `[1, "two"]`,
+		} {
+			if got := globals[name].String(); got != wanted {
+				return errors.Errorf(
+					"Global '%s': wanted %s; got %s",
+					name,
+					wanted,
+					got,
+				)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGoModBuiltins(t *testing.T) {
+	if err := withTempDir(func(root string) error {
+		if err := ioutil.WriteFile(
+			filepath.Join(root, "default.star"),
+			[]byte(`
+mod = gomod.parse_mod("""
+module example.com/app // the app
+
+go 1.14
+
+require github.com/pkg/errors v0.9.1
+require (
+	"github.com/fatih/color" v1.9.0
+	golang.org/x/sys v0.0.0-20200625212154-ddb9806d33ae // indirect
+)
+
+replace github.com/fatih/color v1.9.0 => ../color
+""")
+module = mod.module
+goVersion = mod.go
+require = [(r.path, r.version, r.indirect) for r in mod.require]
+replace = [
+	(r.old_path, r.old_version, r.new_path, r.new_version)
+	for r in mod.replace
+]
+sums = [
+	(s.path, s.version, s.hash, s.go_mod_hash)
+	for s in gomod.parse_sum("""
+github.com/pkg/errors v0.8.1/go.mod h1:mod1=
+github.com/pkg/errors v0.9.1 h1:zip2=
+github.com/pkg/errors v0.9.1/go.mod h1:mod2=
+""")
+]
+`),
+			0644,
+		); err != nil {
+			return err
+		}
+
+		globals, err := execModule("", makeLoader(root, nil))
+		if err != nil {
+			return err
+		}
+
+		for name, wanted := range map[string]string{
+			"module":    `"example.com/app"`,
+			"goVersion": `"1.14"`,
+			"require": `[("github.com/pkg/errors", "v0.9.1", False), ` +
+				`("github.com/fatih/color", "v1.9.0", False), ` +
+				`("golang.org/x/sys", "v0.0.0-20200625212154-ddb9806d33ae", ` +
+				`True)]`,
+			"replace": `[("github.com/fatih/color", "v1.9.0", ` +
+				`"../color", "")]`,
+			"sums": `[("github.com/pkg/errors", "v0.8.1", "", "h1:mod1="), ` +
+				`("github.com/pkg/errors", "v0.9.1", "h1:zip2=", "h1:mod2=")]`,
+		} {
+			if got := globals[name].String(); got != wanted {
+				return errors.Errorf(
+					"Global '%s': wanted %s; got %s",
+					name,
+					wanted,
+					got,
+				)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseRequirements(t *testing.T) {
+	modules, err := filepath.Abs("modules")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, testCase := range []struct {
+		name    string
+		content string
+		wanted  string
+		wantErr string
+	}{{
+		name: "version",
+		content: `six==1.16.0 \
+    --hash=sha256:aaaa`,
+		wanted: `[("six", "1.16.0", "", "aaaa")]`,
+	}, {
+		name:    "url",
+		content: `pkg @ https://example.com/pkg.whl#frag --hash=sha256:bbbb`,
+		wanted:  `[("pkg", "", "https://example.com/pkg.whl#frag", "bbbb")]`,
+	}, {
+		name: "comments and continuations",
+		content: `# A comment
+six==1.16.0 \
+    --hash=sha256:aaaa  # trailing comment
+
+attrs==20.3.0 --hash=sha256:cccc
+`,
+		wanted: `[("six", "1.16.0", "", "aaaa"), ` +
+			`("attrs", "20.3.0", "", "cccc")]`,
+	}, {
+		name:    "extras",
+		content: `requests[socks]==2.31.0 --hash=sha256:dddd`,
+		wanted:  `[("requests", "2.31.0", "", "dddd")]`,
+	}, {
+		name:    "missing hash",
+		content: `six==1.16.0`,
+		wantErr: "expected exactly one sha256 hash",
+	}, {
+		name:    "multiple hashes",
+		content: `six==1.16.0 --hash=sha256:aaaa --hash=sha256:bbbb`,
+		wantErr: "expected exactly one sha256 hash",
+	}, {
+		name:    "markers",
+		content: `six==1.16.0; python_version < "3.8" --hash=sha256:aaaa`,
+		wantErr: "environment markers are not supported",
+	}, {
+		name:    "unpinned",
+		content: `six>=1.16.0 --hash=sha256:aaaa`,
+		wantErr: "expected 'name==version' or 'name @ url'",
+	}} {
+		t.Run(testCase.name, func(t *testing.T) {
+			if err := withTempDir(func(root string) error {
+				if err := os.Symlink(
+					modules,
+					filepath.Join(root, "modules"),
+				); err != nil {
+					return err
+				}
+				if err := writeTestFiles(root, map[string]string{
+					"requirements.lock": testCase.content,
+					"default.star": `
+load("modules/python", "parse_requirements")
+requirements = [
+    (r.name, r.version, r.url, r.sha256)
+    for r in parse_requirements(read_file("requirements.lock"))
+]
+`,
+				}); err != nil {
+					return err
+				}
+
+				globals, err := execModule("", makeLoader(root, nil))
+				if testCase.wantErr != "" {
+					if err == nil ||
+						!strings.Contains(err.Error(), testCase.wantErr) {
+						return errors.Errorf(
+							"Wanted error '%s'; got %v",
+							testCase.wantErr,
+							err,
+						)
+					}
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				if got := globals["requirements"].String(); got != testCase.wanted {
+					return errors.Errorf(
+						"Wanted %s; got %s",
+						testCase.wanted,
+						got,
+					)
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestWorkspaceToolchains(t *testing.T) {
+	files := map[string]string{
+		"WORKSPACE": `
+register_toolchain("go", path("go-plan9"), os = "plan9")
+register_toolchain("go", path("go-any"))
+register_toolchain("go", path("go-shadowed"))
+register_toolchain("cc", path("cc-wasm"), arch = "wasm")
+`,
+		"toolchains.star": `go = path("go-override")`,
+	}
+
+	if err := withTempDir(func(root string) error {
+		for relPath, contents := range files {
+			if err := ioutil.WriteFile(
+				filepath.Join(root, relPath),
+				[]byte(contents),
+				0644,
+			); err != nil {
+				return err
+			}
+		}
+
+		load := makeLoader(root, nil)
+		ws, err := loadWorkspace(root, load)
+		if err != nil {
+			return err
+		}
+		overrides, err := resolveToolchainOverrides(
+			load,
+			map[string]string{"go": "toolchains.star:go"},
+		)
+		if err != nil {
+			return err
+		}
+
+		for _, testCase := range []struct {
+			goos      string
+			goarch    string
+			overrides map[string]Arg
+			wanted    map[string]string
+		}{
+			{
+				goos:   "linux",
+				goarch: "amd64",
+				wanted: map[string]string{"go": "go-any"},
+			},
+			{
+				goos:   "plan9",
+				goarch: "wasm",
+				wanted: map[string]string{"go": "go-plan9", "cc": "cc-wasm"},
+			},
+			{
+				goos:      "plan9",
+				goarch:    "amd64",
+				overrides: overrides,
+				wanted:    map[string]string{"go": "go-override"},
+			},
+		} {
+			got := ws.resolveToolchains(
+				testCase.goos,
+				testCase.goarch,
+				testCase.overrides,
+			)
+			if len(got) != len(testCase.wanted) {
+				return errors.Errorf(
+					"%s/%s: wanted %d toolchains; got %d",
+					testCase.goos,
+					testCase.goarch,
+					len(testCase.wanted),
+					len(got),
+				)
+			}
+			for typ, wanted := range testCase.wanted {
+				if got[typ] == nil || got[typ].String() != wanted {
+					return errors.Errorf(
+						"%s/%s: wanted '%s' toolchain %s; got %v",
+						testCase.goos,
+						testCase.goarch,
+						typ,
+						wanted,
+						got[typ],
+					)
+				}
+			}
+		}
+
+		if _, err := Toolchain("rust").freezeArg(&freezer{}); err == nil {
+			return errors.Errorf("Wanted an unregistered toolchain error")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWorkspaceHashAlgorithm(t *testing.T) {
+	for _, testCase := range []struct {
+		workspace string
+		wanted    string
+		wantedErr string
+	}{
+		{workspace: ``, wanted: "sha256"},
+		{workspace: `hash_algorithm("blake3")`, wanted: "blake3"},
+		{
+			workspace: `hash_algorithm("md5")`,
+			wantedErr: "Unsupported hash algorithm 'md5'",
+		},
+		{
+			workspace: "hash_algorithm(\"blake3\")\nhash_algorithm(\"sha256\")",
+			wantedErr: "may only be called once",
+		},
+	} {
+		if err := withTempDir(func(root string) error {
+			if err := writeTestFiles(
+				root,
+				map[string]string{"WORKSPACE": testCase.workspace},
+			); err != nil {
+				return err
+			}
+			ws, err := loadWorkspace(root, makeLoader(root, nil))
+			if testCase.wantedErr != "" {
+				if err == nil ||
+					!strings.Contains(err.Error(), testCase.wantedErr) {
+					return errors.Errorf(
+						"Wanted error containing '%s'; got %v",
+						testCase.wantedErr,
+						err,
+					)
+				}
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if got := ws.hashAlgorithm().Name; got != testCase.wanted {
+				return errors.Errorf(
+					"Wanted hash algorithm '%s'; got '%s'",
+					testCase.wanted,
+					got,
+				)
+			}
+			return nil
+		}); err != nil {
+			t.Fatalf("%q: %v", testCase.workspace, err)
+		}
+	}
+}
+
+func writeTestFiles(dir string, files map[string]string) error {
+	for relPath, contents := range files {
+		filePath := filepath.Join(dir, relPath)
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(
+			filePath,
+			[]byte(contents),
+			0644,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gitCommitAll commits every file in the git repository at `repo` and returns
+// the commit hash.
+func gitCommitAll(repo, message string) (string, error) {
+	for _, args := range [][]string{
+		{"add", "--all"},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com",
+			"commit", "--quiet", "-m", message},
+	} {
+		if _, err := runGit(repo, args...); err != nil {
+			return "", err
+		}
+	}
+	commit, err := runGit(repo, "rev-parse", "HEAD")
+	return strings.TrimSpace(commit), err
+}
+
+func TestHashPackageTree_cache(t *testing.T) {
+	if err := withTempDir(func(dir string) error {
+		pkg := filepath.Join(dir, "pkg")
+		if err := writeTestFiles(pkg, map[string]string{
+			"WORKSPACE": "",
+			"lib.star":  "x = 1",
+		}); err != nil {
+			return err
+		}
+		path := filepath.Join(pkg, "lib.star")
+		// Recently modified files aren't cached, so backdate the file.
+		old := time.Now().Add(-time.Hour)
+		if err := os.Chtimes(path, old, old); err != nil {
+			return err
+		}
+
+		fhc := loadFileHashCache(filepath.Join(dir, packageHashCacheName))
+		before, err := hashPackageTree(pkg, fhc)
+		if err != nil {
+			return err
+		}
+
+		// Change the file without changing its size, modification time or
+		// inode so that only a hash that reads the file notices.
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write([]byte("x = 2")); err != nil {
+			properClose(f)
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		if err := os.Chtimes(path, old, old); err != nil {
+			return err
+		}
+
+		cached, err := hashPackageTree(pkg, fhc)
+		if err != nil {
+			return err
+		}
+		if cached != before {
+			return errors.Errorf(
+				"Wanted the cached hash %s; got %s",
+				before,
+				cached,
+			)
+		}
+		uncached, err := hashPackageTree(pkg, nil)
+		if err != nil {
+			return err
+		}
+		if uncached == before {
+			return errors.Errorf("Wanted a new hash without the cache")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFetchPackages(t *testing.T) {
+	if err := withTempDir(func(dir string) error {
+		// A git repository with a tagged commit followed by another commit.
+		repo := filepath.Join(dir, "repo")
+		if err := writeTestFiles(repo, map[string]string{
+			"WORKSPACE":  "",
+			"rules.star": `version = "v1"`,
+		}); err != nil {
+			return err
+		}
+		if _, err := runGit(repo, "init", "--quiet"); err != nil {
+			return err
+		}
+		if _, err := gitCommitAll(repo, "v1"); err != nil {
+			return err
+		}
+		if _, err := runGit(repo, "tag", "v1"); err != nil {
+			return err
+		}
+
+		// An archive whose contents are in a top-level directory.
+		archiveSrc := filepath.Join(dir, "archive")
+		if err := writeTestFiles(archiveSrc, map[string]string{
+			"lib-1.0/WORKSPACE":  "",
+			"lib-1.0/rules.star": `name = "lib"`,
+		}); err != nil {
+			return err
+		}
+		archive, err := os.Create(filepath.Join(dir, "lib.tar"))
+		if err != nil {
+			return err
+		}
+		if err := writeTar(archive, archiveSrc); err != nil {
+			return err
+		}
+		if err := archive.Close(); err != nil {
+			return err
+		}
+
+		root := filepath.Join(dir, "root")
+		writeWorkspace := func(libHash string) error {
+			return writeTestFiles(root, map[string]string{
+				"WORKSPACE": `
+package("gitlib", "git+` + repo + `", version = "v1")
+package("lib", "` + archive.Name() + `", sha256 = "` + libHash + `")
+`,
+				"default.star": `
+load("gitlib:rules.star", gitVersion = "version")
+load("lib:rules.star", libName = "name")
+version = gitVersion
+name = libName
+`,
+			})
+		}
+		gitDir := filepath.Join(dir, "git")
+		fetch := func() error {
+			_, _, err := loadWorkspacePackages(root, gitDir, nil, true)
+			return err
+		}
+		load := func() (starlark.StringDict, error) {
+			_, scopes, err := loadWorkspacePackages(root, gitDir, nil, false)
+			if err != nil {
+				return nil, err
+			}
+			return execModule("", makeLoader(root, scopes))
+		}
+
+		if err := writeWorkspace(""); err != nil {
+			return err
+		}
+		if err := fetch(); err != nil {
+			return err
+		}
+		globals, err := load()
+		if err != nil {
+			return err
+		}
+		if got := globals["version"].String(); got != `"v1"` {
+			return errors.Errorf("Wanted version \"v1\"; got %s", got)
+		}
+
+		lock, err := readLockFile(root)
+		if err != nil {
+			return err
+		}
+		if lock.Packages["gitlib"].Commit == "" {
+			return errors.Errorf("Wanted the git package's commit to be locked")
+		}
+		libHash := lock.Packages["lib"].SHA256
+		if len(libHash) != 64 {
+			return errors.Errorf("Wanted a locked hash; got '%s'", libHash)
+		}
+
+		// Moving the tag doesn't change the package while it's locked.
+		if err := writeTestFiles(repo, map[string]string{
+			"rules.star": `version = "v2"`,
+		}); err != nil {
+			return err
+		}
+		if _, err := gitCommitAll(repo, "v2"); err != nil {
+			return err
+		}
+		if _, err := runGit(repo, "tag", "--force", "v1"); err != nil {
+			return err
+		}
+		if err := os.RemoveAll(
+			filepath.Join(root, vendorDirectoryName),
+		); err != nil {
+			return err
+		}
+		if err := fetch(); err != nil {
+			return err
+		}
+		if globals, err = load(); err != nil {
+			return err
+		}
+		if got := globals["version"].String(); got != `"v1"` {
+			return errors.Errorf("Wanted locked version \"v1\"; got %s", got)
+		}
+
+		// A declared hash must match the package's contents.
+		if err := writeWorkspace(libHash); err != nil {
+			return err
+		}
+		if err := fetch(); err != nil {
+			return err
+		}
+		if err := os.Remove(filepath.Join(root, lockFileName)); err != nil {
+			return err
+		}
+		if err := writeWorkspace(strings.Repeat("0", 64)); err != nil {
+			return err
+		}
+		if err := fetch(); err == nil {
+			return errors.Errorf("Wanted an error for a mismatching hash")
+		}
+
+		// Builds require declared packages to be fetched.
+		if err := writeWorkspace(""); err != nil {
+			return err
+		}
+		if err := fetch(); err != nil {
+			return err
+		}
+		if _, err := load(); err != nil {
+			return err
+		}
+
+		// Builds also require the vendored packages to match the lock file.
+		rulesPath := filepath.Join(
+			root,
+			vendorDirectoryName,
+			"lib",
+			"rules.star",
+		)
+		if err := ioutil.WriteFile(
+			rulesPath,
+			[]byte(`name = "edited"`),
+			0644,
+		); err != nil {
+			return err
+		}
+		if _, err := load(); err == nil ||
+			!strings.Contains(err.Error(), "g8r fetch") {
+			return errors.Errorf(
+				"Wanted an error for an edited package; got %v",
+				err,
+			)
+		}
+		if err := fetch(); err != nil {
+			return err
+		}
+		if globals, err = load(); err != nil {
+			return err
+		}
+		if got := globals["name"].String(); got != `"lib"` {
+			return errors.Errorf("Wanted name \"lib\"; got %s", got)
+		}
+
+		if err := os.RemoveAll(
+			filepath.Join(root, vendorDirectoryName, "lib"),
+		); err != nil {
+			return err
+		}
+		if _, err := load(); err == nil {
+			return errors.Errorf("Wanted an error for an unfetched package")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGitPackages(t *testing.T) {
+	if err := withTempDir(func(dir string) error {
+		// Commit two versions of a library and publish them to a bare
+		// repository.
+		repo := filepath.Join(dir, "repo")
+		if err := writeTestFiles(repo, map[string]string{
+			"WORKSPACE":          "",
+			"rules/default.star": `version = "v1"`,
+		}); err != nil {
+			return err
+		}
+		if _, err := runGit(repo, "init", "--quiet"); err != nil {
+			return err
+		}
+		v1, err := gitCommitAll(repo, "v1")
+		if err != nil {
+			return err
+		}
+		if err := writeTestFiles(repo, map[string]string{
+			"rules/default.star": `version = "v2"`,
+		}); err != nil {
+			return err
+		}
+		v2, err := gitCommitAll(repo, "v2")
+		if err != nil {
+			return err
+		}
+		bare := filepath.Join(dir, "repo.git")
+		if _, err := runGit(
+			dir,
+			"clone",
+			"--quiet",
+			"--bare",
+			repo,
+			bare,
+		); err != nil {
+			return err
+		}
+
+		root := filepath.Join(dir, "root")
+		gitDir := filepath.Join(dir, "git")
+		build := func(commit string) (string, error) {
+			if err := writeTestFiles(root, map[string]string{
+				"WORKSPACE": `git_package("mylib", "file://` + bare +
+					`", "` + commit + `")`,
+				"default.star": `
+load("mylib:rules", "version")
+libVersion = version
+`,
+			}); err != nil {
+				return "", err
+			}
+			_, scopes, err := loadWorkspacePackages(root, gitDir, nil, false)
+			if err != nil {
+				return "", err
+			}
+			globals, err := execModule("", makeLoader(root, scopes))
+			if err != nil {
+				return "", err
+			}
+			return globals["libVersion"].String(), nil
+		}
+
+		for commit, wanted := range map[string]string{
+			v1: `"v1"`,
+			v2: `"v2"`,
+		} {
+			got, err := build(commit)
+			if err != nil {
+				return err
+			}
+			if got != wanted {
+				return errors.Errorf(
+					"Commit %s: wanted version %s; got %s",
+					commit,
+					wanted,
+					got,
+				)
+			}
+			if _, err := os.Stat(
+				filepath.Join(gitDir, "checkouts", commit, "rules"),
+			); err != nil {
+				return errors.Wrap(err, "Wanted a checkout for the commit")
+			}
+		}
+
+		// Checkouts are reused without contacting the remote.
+		if err := os.RemoveAll(bare); err != nil {
+			return err
+		}
+		if _, err := build(v1); err != nil {
+			return err
+		}
+
+		if _, err := build(strings.Repeat("0", 40)); err == nil {
+			return errors.Errorf("Wanted an error for a missing commit")
+		}
+		if _, err := build("v1"); err == nil {
+			return errors.Errorf("Wanted an error for a non-hash commit")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTransitivePackages(t *testing.T) {
+	if err := withTempDir(func(dir string) error {
+		commit := func(repo string, files map[string]string) (string, error) {
+			if err := writeTestFiles(repo, files); err != nil {
+				return "", err
+			}
+			_, err := os.Stat(filepath.Join(repo, ".git"))
+			if os.IsNotExist(err) {
+				if _, err := runGit(repo, "init", "--quiet"); err != nil {
+					return "", err
+				}
+			}
+			return gitCommitAll(repo, "commit")
+		}
+
+		// `a` and `b` depend on different versions of `util`.
+		util := filepath.Join(dir, "util")
+		u1, err := commit(util, map[string]string{
+			"WORKSPACE":          "",
+			"rules/default.star": `version = "u1"`,
+		})
+		if err != nil {
+			return err
+		}
+		u2, err := commit(util, map[string]string{
+			"rules/default.star": `version = "u2"`,
+		})
+		if err != nil {
+			return err
+		}
+		libCommits := map[string]string{}
+		for lib, utilCommit := range map[string]string{"a": u1, "b": u2} {
+			if libCommits[lib], err = commit(
+				filepath.Join(dir, lib),
+				map[string]string{
+					"WORKSPACE": `git_package("util", "` + util + `", "` +
+						utilCommit + `")`,
+					"rules/default.star": `
+load("util:rules", "version")
+utilVersion = version
+`,
+				},
+			); err != nil {
+				return err
+			}
+		}
+
+		root := filepath.Join(dir, "root")
+		gitDir := filepath.Join(dir, "git")
+		build := func(workspace string) (string, error) {
+			if err := writeTestFiles(root, map[string]string{
+				"WORKSPACE": workspace,
+				"default.star": `
+load("a:rules", aVersion = "utilVersion")
+load("b:rules", bVersion = "utilVersion")
+versions = [aVersion, bVersion]
+`,
+			}); err != nil {
+				return "", err
+			}
+			_, scopes, err := loadWorkspacePackages(root, gitDir, nil, false)
+			if err != nil {
+				return "", err
+			}
+			globals, err := execModule("", makeLoader(root, scopes))
+			if err != nil {
+				return "", err
+			}
+			return globals["versions"].String(), nil
+		}
+		gitPackage := func(name, repo, commit, extra string) string {
+			return `git_package("` + name + `", "` + repo + `", "` + commit +
+				`"` + extra + ")\n"
+		}
+		a := gitPackage("a", filepath.Join(dir, "a"), libCommits["a"], "")
+		b := gitPackage("b", filepath.Join(dir, "b"), libCommits["b"], "")
+
+		_, err = build(a + b)
+		wanted := "Conflicting versions of package 'util'"
+		if err == nil || !strings.Contains(err.Error(), wanted) {
+			return errors.Errorf("Wanted a version conflict; got %v", err)
+		}
+
+		for _, testCase := range []struct {
+			workspace string
+			wanted    string
+		}{
+			{
+				// Mapping `b`'s `util` to another name resolves the conflict.
+				workspace: a + gitPackage(
+					"b",
+					filepath.Join(dir, "b"),
+					libCommits["b"],
+					`, mapping = {"util": "util2"}`,
+				),
+				wanted: `["u1", "u2"]`,
+			},
+			{
+				// The workspace's own declaration takes precedence.
+				workspace: a + b + gitPackage("util", util, u2, ""),
+				wanted:    `["u2", "u2"]`,
+			},
+		} {
+			got, err := build(testCase.workspace)
+			if err != nil {
+				return err
+			}
+			if got != testCase.wanted {
+				return errors.Errorf(
+					"Wanted versions %s; got %s",
+					testCase.wanted,
+					got,
+				)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVisibility(t *testing.T) {
+	if err := withTempDir(func(root string) error {
+		if err := writeTestFiles(root, map[string]string{
+			"WORKSPACE":             "",
+			".vendor/lib/WORKSPACE": "",
+			".vendor/lib/rules/default.star": `
+_tool = target(name = "_tool", builder = "bash", args = [], env = [])
+internal = target(
+    name = "internal",
+    builder = "bash",
+    args = [],
+    env = [],
+    visibility = ["//..."],
+)
+
+def rule(name, deps = []):
+    return target(name = name, builder = "bash", args = [_tool] + deps, env = [])
+`,
+			".vendor/lib/other/default.star": `
+load("rules", "internal", "rule")
+usesInternal = target(
+    name = "usesInternal",
+    builder = "bash",
+    args = [internal],
+    env = [],
+)
+
+_helperPrivate = target(name = "_helperPrivate", builder = "bash", args = [], env = [])
+
+def wrap(name):
+    return rule(name, deps = [_helperPrivate])
+`,
+			"default.star": `
+load("lib:rules", "internal", "rule")
+load("lib:other", "usesInternal", "wrap")
+
+def dependsOn(name, dep):
+    return target(name = name, builder = "bash", args = [dep], env = [])
+
+_mine = target(name = "_mine", builder = "bash", args = [], env = [])
+ruleWithPrivateDeps = rule("ruleWithPrivateDeps", deps = [_mine])
+publicDep = dependsOn("publicDep", usesInternal)
+internalDep = dependsOn("internalDep", internal)
+leakedDep = dependsOn("leakedDep", rule("leaky").args[0])
+wrapped = wrap("wrapped")
+visibility = internal.visibility
+`,
+		}); err != nil {
+			return err
+		}
+
+		packages, err := loadPackages(root)
+		if err != nil {
+			return err
+		}
+		globals, err := execModule(
+			"",
+			makeLoader(root, vendoredScopes(root, packages)),
+		)
+		if err != nil {
+			return err
+		}
+		if got := globals["visibility"].String(); got != `["//..."]` {
+			return errors.Errorf("Wanted visibility [\"//...\"]; got %s", got)
+		}
+
+		for _, testCase := range []struct {
+			target string
+			wanted string
+		}{
+			{target: "ruleWithPrivateDeps"},
+			{target: "publicDep"},
+			{target: "wrapped"},
+			{
+				target: "internalDep",
+				wanted: "Target 'internal' (defined in " +
+					filepath.Join(root, ".vendor", "lib") + "//rules) is " +
+					"not visible to target 'internalDep'",
+			},
+			{
+				target: "leakedDep",
+				wanted: "Target '_tool' (defined in " +
+					filepath.Join(root, ".vendor", "lib") + "//rules) is " +
+					"not visible to target 'leakedDep'",
+			},
+		} {
+			_, err := FreezeTarget(
+				root,
+				hashAlgorithms["sha256"],
+				newTestCache(),
+				nil,
+				nil,
+				nil,
+				globals[testCase.target].(*Target),
+			)
+			if testCase.wanted == "" {
+				if err != nil {
+					return errors.Wrapf(err, "Target '%s'", testCase.target)
+				}
+				continue
+			}
+			if err == nil || !strings.Contains(err.Error(), testCase.wanted) {
+				return errors.Errorf(
+					"Target '%s': wanted error '%s'; got %v",
+					testCase.target,
+					testCase.wanted,
+					err,
+				)
+			}
+		}
+
+		_, err = starlarkTarget(nil, []starlark.Tuple{
+			{starlark.String("name"), starlark.String("t")},
+			{starlark.String("builder"), starlark.String("bash")},
+			{starlark.String("args"), starlark.NewList(nil)},
+			{starlark.String("env"), starlark.NewList(nil)},
+			{
+				starlark.String("visibility"),
+				starlark.NewList([]starlark.Value{
+					starlark.String("//foo/.../bar"),
+				}),
+			},
+		})
+		if err == nil {
+			return errors.Errorf("Wanted an invalid visibility error")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -9,14 +9,48 @@ type Path string
 
 func (p Path) String() string { return string(p) }
 
-type GlobGroup []string
+// GlobGroup is a set of files in a package selected by glob patterns.
+type GlobGroup struct {
+	// Patterns are the include patterns. Every pattern must match at least
+	// one file.
+	Patterns []string
+
+	// Exclude patterns remove matched files (or whole directories) from the
+	// group.
+	Exclude []string
+
+	// IgnoreFiles indicates that files matched by `.gitignore` and
+	// `.g8rignore` files in the package should be excluded from the group.
+	IgnoreFiles bool
+}
 
 func (gg GlobGroup) String() string {
 	return jsonSprint(struct {
-		Globs []string `json:"globs"`
-	}{[]string(gg)})
+		Globs       []string `json:"globs"`
+		Exclude     []string `json:"exclude,omitempty"`
+		IgnoreFiles bool     `json:"ignoreFiles,omitempty"`
+	}{gg.Patterns, gg.Exclude, gg.IgnoreFiles})
+}
+
+// HostTool is a program installed on the host (outside of the build cache).
+// It is resolved when it is frozen, and its derivation's hash includes the
+// binary's path and hash and the output of its probe command so that
+// upgrading (or moving) the tool rebuilds the targets that depend on it.
+type HostTool struct {
+	// Name is the name of the binary to look for.
+	Name string
+
+	// Probe is a command (e.g., `["go", "version"]`) whose output identifies
+	// the tool's version. Its first element is resolved the same way as
+	// `Name`.
+	Probe []string
+
+	// Paths are directories to search before `$PATH`.
+	Paths []string
 }
 
+func (ht *HostTool) String() string { return jsonSprint(ht) }
+
 type String string
 
 func (s String) String() string { return string(s) }
@@ -53,6 +87,30 @@ type Target struct {
 	Builder string
 	Args    []Arg
 	Env     []string
+
+	// OutputHash, if set, makes the target a fixed-output target: its
+	// derivation ID depends only on its name and the expected hash of its
+	// output rather than on its builder, args and env. This is useful for
+	// targets which fetch content from the network, since changing how the
+	// content is fetched (e.g., upgrading the tool that fetches it) doesn't
+	// invalidate the cached output.
+	OutputHash string `json:",omitempty"`
+
+	// Visibility lists the modules whose targets may depend on the target
+	// (see visibility.go). If it's empty, the target's visibility depends on
+	// its name.
+	Visibility []string `json:",omitempty"`
+
+	// Module is the module that defined the target and Callers are the
+	// other modules whose code was on the call stack when it was created
+	// (including the module being evaluated). Targets created by Go code
+	// have no module and aren't subject to visibility checks.
+	Module  *moduleLabel  `json:"-"`
+	Callers []moduleLabel `json:"-"`
+
+	// Inputs are what the evaluation of the module that created the target
+	// read (see `moduleInputs`).
+	Inputs moduleInputs `json:"-"`
 }
 
 func (t *Target) String() string { return jsonSprint(t) }
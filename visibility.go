@@ -0,0 +1,242 @@
+package main
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.starlark.net/starlark"
+)
+
+// Visibility controls which modules' targets may depend on a target. A
+// target's visibility is a list of patterns, each of which is one of:
+//
+//     "public"        every module
+//     "private"       only the module that defined the target
+//     "//dir"         the modules in `dir` of the target's package
+//     "//dir/..."     the modules in `dir` and its subdirectories
+//
+// where `//` is the root of the package that defined the target (so
+// `["//..."]` makes a target internal to its package). A target's module can
+// always depend on it. Targets whose names start with an underscore are
+// private by default and all other targets are public, mirroring Starlark's
+// `load()`, which doesn't export globals whose names start with an
+// underscore.
+//
+// A target belongs to the module whose code called the builtin that created
+// it, so a rule can depend on its own module's private targets regardless of
+// which module calls the rule. Targets may also depend on anything which is
+// visible to a module whose code was on the call stack when they were created
+// (e.g., the module that called the rule, or a helper in another module which
+// called the rule on the module's behalf), so rules can be passed their
+// callers' private targets. Visibility is checked when targets are frozen and
+// doesn't affect their derivation IDs.
+
+const (
+	publicVisibility  = "public"
+	privateVisibility = "private"
+
+	moduleLabelLocal = "moduleLabel"
+
+	// moduleLabelsLocal maps the file path of every module that has been
+	// loaded to its label so that call frames can be attributed to modules.
+	moduleLabelsLocal = "moduleLabels"
+)
+
+// moduleLabel identifies a module by the root directory of its package and
+// the module's directory relative to that root (in slash-separated form).
+type moduleLabel struct {
+	Package string
+	Dir     string
+}
+
+// newModuleLabel returns the label of the module file at `filePath` in the
+// package at `packageRoot`.
+func newModuleLabel(packageRoot string, filePath string) moduleLabel {
+	dir, err := filepath.Rel(packageRoot, filepath.Dir(filePath))
+	if err != nil {
+		dir = "."
+	}
+	return moduleLabel{Package: packageRoot, Dir: filepath.ToSlash(dir)}
+}
+
+func (l moduleLabel) String() string {
+	if l.Dir == "." {
+		return l.Package + "//"
+	}
+	return l.Package + "//" + l.Dir
+}
+
+// labelBuiltins returns a copy of `builtins` for the module identified by
+// `label`: the builtins label the targets that they create with the module
+// (see `labelTarget()`). Since Starlark functions resolve builtins in the
+// module that defined them, targets are labeled with the module whose code
+// created them even when they're created on behalf of another module.
+func labelBuiltins(
+	builtins starlark.StringDict,
+	label moduleLabel,
+) starlark.StringDict {
+	labeled := make(starlark.StringDict, len(builtins))
+	for name, value := range builtins {
+		builtin, ok := value.(*starlark.Builtin)
+		if !ok {
+			labeled[name] = value
+			continue
+		}
+		labeled[name] = starlark.NewBuiltin(
+			builtin.Name(),
+			func(
+				th *starlark.Thread,
+				_ *starlark.Builtin,
+				args starlark.Tuple,
+				kwargs []starlark.Tuple,
+			) (starlark.Value, error) {
+				v, err := builtin.CallInternal(th, args, kwargs)
+				if t, ok := v.(*Target); ok && err == nil {
+					labelTarget(th, t, label)
+				}
+				return v, err
+			},
+		)
+	}
+	return labeled
+}
+
+// labelTarget records the module which defined a newly created target and
+// the other modules on the thread's call stack, including the module being
+// evaluated by the thread. Targets which are already labeled (e.g., targets
+// returned unchanged by a builtin) are left alone.
+func labelTarget(th *starlark.Thread, t *Target, label moduleLabel) {
+	if t.Module != nil {
+		return
+	}
+	t.Module = &label
+	t.Inputs, _ = th.Local(moduleInputsLocal).(moduleInputs)
+
+	addCaller := func(caller moduleLabel) {
+		if caller == label {
+			return
+		}
+		for _, existing := range t.Callers {
+			if existing == caller {
+				return
+			}
+		}
+		t.Callers = append(t.Callers, caller)
+	}
+	if caller, ok := th.Local(moduleLabelLocal).(moduleLabel); ok {
+		addCaller(caller)
+	}
+	labels, _ := th.Local(moduleLabelsLocal).(map[string]moduleLabel)
+	for depth := 0; depth < th.CallStackDepth(); depth++ {
+		frame := th.CallFrame(depth)
+		if caller, found := labels[frame.Pos.Filename()]; found {
+			addCaller(caller)
+		}
+	}
+}
+
+// validateVisibility checks the syntax of a target's visibility patterns.
+func validateVisibility(patterns []string) error {
+	for _, pattern := range patterns {
+		if pattern == publicVisibility || pattern == privateVisibility {
+			continue
+		}
+		if !strings.HasPrefix(pattern, "//") {
+			return errors.Errorf(
+				"Invalid visibility '%s': expected '%s', '%s', '//dir' or "+
+					"'//dir/...'",
+				pattern,
+				publicVisibility,
+				privateVisibility,
+			)
+		}
+		dir, _ := splitVisibilityPattern(pattern)
+		for _, element := range strings.Split(dir, "/") {
+			if element == ".." || element == "..." {
+				return errors.Errorf(
+					"Invalid visibility '%s': '%s' may only be used as the "+
+						"last element",
+					pattern,
+					element,
+				)
+			}
+		}
+	}
+	return nil
+}
+
+// splitVisibilityPattern splits a `//dir[/...]` pattern into its directory
+// and whether or not it includes the directory's subdirectories.
+func splitVisibilityPattern(pattern string) (string, bool) {
+	dir := strings.TrimPrefix(pattern, "//")
+	recursive := dir == "..." || strings.HasSuffix(dir, "/...")
+	if recursive {
+		dir = strings.TrimSuffix(strings.TrimSuffix(dir, "..."), "/")
+	}
+	return path.Clean(dir), recursive
+}
+
+// visibility returns the target's visibility patterns, falling back to the
+// default for its name.
+func (t *Target) visibility() []string {
+	if len(t.Visibility) > 0 {
+		return t.Visibility
+	}
+	if strings.HasPrefix(t.Name, "_") {
+		return []string{privateVisibility}
+	}
+	return []string{publicVisibility}
+}
+
+// visibleTo returns true if a target defined in the module identified by
+// `label` may depend on the target.
+func (t *Target) visibleTo(label moduleLabel) bool {
+	if label == *t.Module {
+		return true
+	}
+	for _, pattern := range t.visibility() {
+		switch pattern {
+		case publicVisibility:
+			return true
+		case privateVisibility:
+			continue
+		}
+		if label.Package != t.Module.Package {
+			continue
+		}
+		dir, recursive := splitVisibilityPattern(pattern)
+		if label.Dir == dir ||
+			recursive && (dir == "." || strings.HasPrefix(label.Dir, dir+"/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkVisibility returns an error if `consumer` may not depend on `dep`.
+// Targets which weren't created by a module (e.g., targets built in Go) are
+// exempt.
+func checkVisibility(consumer *Target, dep *Target) error {
+	if consumer == nil || consumer.Module == nil || dep.Module == nil {
+		return nil
+	}
+	if dep.visibleTo(*consumer.Module) {
+		return nil
+	}
+	for _, caller := range consumer.Callers {
+		if dep.visibleTo(caller) {
+			return nil
+		}
+	}
+	return errors.Errorf(
+		"Target '%s' (defined in %s) is not visible to target '%s' "+
+			"(defined in %s); its visibility is [%s]",
+		dep.Name,
+		dep.Module,
+		consumer.Name,
+		consumer.Module,
+		strings.Join(dep.visibility(), ", "),
+	)
+}
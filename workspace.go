@@ -0,0 +1,308 @@
+package main
+
+import (
+	"hash"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// The WORKSPACE file at the root of a workspace is a Starlark file which
+// configures the build as a whole. It has the same builtins as other modules
+// (and can `load()` them) plus the following:
+//
+//     register_toolchain(type, target, os=None, arch=None)
+//     package(name, source, version="", sha256="", mapping={})
+//     git_package(name, remote, commit, mapping={})
+//     hash_algorithm(name)
+//
+// See packages.go and resolve.go for external packages and hashalgorithm.go
+// for hash algorithms.
+//
+// Rules refer to toolchains with `toolchain(type)` rather than taking them as
+// arguments. The reference is resolved when it is frozen: to the toolchain
+// given on the command line for that type (`--toolchain type=module:global`),
+// if any, or else to the first registered toolchain of that type whose `os`
+// and `arch` match the host (`None` matches anything).
+
+// workspaceLocal is the thread-local key for the workspace being configured
+// while the WORKSPACE file is evaluated.
+const workspaceLocal = "workspace"
+
+// workspace is the configuration declared in a WORKSPACE file.
+type workspace struct {
+	toolchains  []toolchainRegistration
+	packages    []packageDecl
+	gitPackages []gitPackageDecl
+
+	// algorithm is the name of the hash algorithm chosen with
+	// `hash_algorithm()`, if any.
+	algorithm string
+}
+
+// toolchainRegistration is a toolchain declared with `register_toolchain()`.
+type toolchainRegistration struct {
+	Type   string
+	Target Arg
+
+	// OS and Arch restrict the platforms the toolchain is used for (in
+	// `runtime.GOOS` and `runtime.GOARCH` terms). Empty strings match any
+	// platform.
+	OS   string
+	Arch string
+}
+
+// loadWorkspace evaluates the WORKSPACE file at `root` with `load` as its
+// loader. An empty WORKSPACE file declares an empty workspace.
+func loadWorkspace(root string, load loadFunc) (*workspace, error) {
+	filePath := filepath.Join(root, workspaceFileName)
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "Reading workspace file")
+	}
+
+	var ws workspace
+	thread := &starlark.Thread{Name: filePath, Load: load}
+	thread.SetLocal(packageRootLocal, root)
+	thread.SetLocal(workspaceLocal, &ws)
+	label := newModuleLabel(root, filePath)
+	thread.SetLocal(moduleLabelLocal, label)
+
+	builtins := starlarkBuiltins()
+	builtins["register_toolchain"] = threadBuiltinWrapper(
+		"register_toolchain",
+		starlarkRegisterToolchain,
+	)
+	builtins["package"] = threadBuiltinWrapper("package", starlarkPackage)
+	builtins["git_package"] = threadBuiltinWrapper(
+		"git_package",
+		starlarkGitPackage,
+	)
+	builtins["hash_algorithm"] = threadBuiltinWrapper(
+		"hash_algorithm",
+		starlarkHashAlgorithm,
+	)
+	if _, err := starlark.ExecFile(
+		thread,
+		workspaceFileName,
+		data,
+		labelBuiltins(builtins, label),
+	); err != nil {
+		return nil, errors.Wrap(err, "Evaluating workspace file")
+	}
+	return &ws, nil
+}
+
+// resolveToolchains picks a toolchain for each registered type given the
+// host platform. Overrides take precedence over registrations.
+func (ws *workspace) resolveToolchains(
+	goos string,
+	goarch string,
+	overrides map[string]Arg,
+) map[string]Arg {
+	toolchains := map[string]Arg{}
+	for _, registration := range ws.toolchains {
+		if _, found := toolchains[registration.Type]; found {
+			continue
+		}
+		if (registration.OS == "" || registration.OS == goos) &&
+			(registration.Arch == "" || registration.Arch == goarch) {
+			toolchains[registration.Type] = registration.Target
+		}
+	}
+	for typ, target := range overrides {
+		toolchains[typ] = target
+	}
+	return toolchains
+}
+
+// starlarkRegisterToolchain implements the `register_toolchain(type, target,
+// os=None, arch=None)` builtin, which is only available in WORKSPACE files.
+func starlarkRegisterToolchain(
+	th *starlark.Thread,
+	args starlark.Tuple,
+	kwargs []starlark.Tuple,
+) (starlark.Value, error) {
+	ws, ok := th.Local(workspaceLocal).(*workspace)
+	if !ok {
+		return nil, errors.Errorf(
+			"register_toolchain() may only be called from a %s file",
+			workspaceFileName,
+		)
+	}
+
+	var typ, goos, goarch string
+	var target starlark.Value
+	if err := starlark.UnpackArgs(
+		"register_toolchain",
+		args,
+		kwargs,
+		"type",
+		&typ,
+		"target",
+		&target,
+		"os?",
+		&goos,
+		"arch?",
+		&goarch,
+	); err != nil {
+		return nil, err
+	}
+
+	arg, err := toolchainValueToArg(target)
+	if err != nil {
+		return nil, errors.Wrap(err, "Argument 'target'")
+	}
+	ws.toolchains = append(ws.toolchains, toolchainRegistration{
+		Type:   typ,
+		Target: arg,
+		OS:     goos,
+		Arch:   goarch,
+	})
+	return starlark.None, nil
+}
+
+// toolchainValueToArg validates that a value can be used as a toolchain.
+func toolchainValueToArg(v starlark.Value) (Arg, error) {
+	switch x := v.(type) {
+	case *Target, *HostTool, Path:
+		return x.(Arg), nil
+	default:
+		return nil, errors.Errorf(
+			"TypeError: expected a Target, HostTool or Path; found %s",
+			v.Type(),
+		)
+	}
+}
+
+// resolveToolchainOverrides loads the toolchains named by `--toolchain`
+// flags. Each override maps a toolchain type to a label of the form
+// `<module address>:<global>`.
+func resolveToolchainOverrides(
+	load loadFunc,
+	overrides map[string]string,
+) (map[string]Arg, error) {
+	args := make(map[string]Arg, len(overrides))
+	for typ, label := range overrides {
+		addr, name := parseLabel(label)
+		if addr == "" {
+			return nil, errors.Errorf(
+				"Toolchain '%s': label '%s' must have the form "+
+					"'<module>:<global>'",
+				typ,
+				label,
+			)
+		}
+		globals, err := load(&starlark.Thread{Name: label, Load: load}, addr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Toolchain '%s'", typ)
+		}
+		value, found := globals[name]
+		if !found {
+			return nil, errors.Errorf(
+				"Toolchain '%s': module '%s' has no global '%s'",
+				typ,
+				addr,
+				name,
+			)
+		}
+		if args[typ], err = toolchainValueToArg(value); err != nil {
+			return nil, errors.Wrapf(err, "Toolchain '%s'", typ)
+		}
+	}
+	return args, nil
+}
+
+//
+// Toolchain
+//
+
+// Toolchain is a reference to the toolchain of a given type (e.g., "go"). It
+// is resolved to a concrete toolchain when it is frozen.
+type Toolchain string
+
+// String implements the starlark.Value.String() method.
+func (tc Toolchain) String() string { return "toolchain(" + string(tc) + ")" }
+
+// Type implements the starlark.Value.Type() method.
+func (tc Toolchain) Type() string { return "Toolchain" }
+
+// Freeze implements the starlark.Value.Freeze() method.
+func (tc Toolchain) Freeze() {}
+
+// Truth implements the starlark.Value.Truth() method.
+func (tc Toolchain) Truth() starlark.Bool { return starlark.True }
+
+// Hash32 implements the Arg.Hash32() method.
+func (tc Toolchain) Hash32(h hash.Hash32) { h.Write([]byte(tc)) }
+
+// Hash implements the starlark.Value.Hash() method.
+func (tc Toolchain) Hash() (uint32, error) {
+	return starlark.String(tc).Hash()
+}
+
+// Attr implements the starlark.HasAttrs.Attr() method.
+func (tc Toolchain) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "type":
+		return starlark.String(tc), nil
+	default:
+		return nil, nil
+	}
+}
+
+// AttrNames implements the starlark.HasAttrs.AttrNames() method.
+func (tc Toolchain) AttrNames() []string { return []string{"type"} }
+
+// CompareSameType implements the starlark.Comparable.CompareSameType()
+// method.
+func (tc Toolchain) CompareSameType(
+	op syntax.Token,
+	y starlark.Value,
+	depth int,
+) (bool, error) {
+	return compareEquality(op, tc, y, func() (bool, error) {
+		return tc == y.(Toolchain), nil
+	})
+}
+
+// starlarkToolchain implements the `toolchain(type)` builtin.
+func starlarkToolchain(
+	args starlark.Tuple,
+	kwargs []starlark.Tuple,
+) (starlark.Value, error) {
+	var typ string
+	if err := starlark.UnpackPositionalArgs(
+		"toolchain",
+		args,
+		kwargs,
+		1,
+		&typ,
+	); err != nil {
+		return nil, err
+	}
+	return Toolchain(typ), nil
+}
+
+func (tc Toolchain) freezeArg(f *freezer) (ArgValue, error) {
+	target, found := f.toolchains[string(tc)]
+	if !found {
+		return ArgValue{}, errors.Errorf(
+			"No '%s' toolchain is registered for this platform",
+			string(tc),
+		)
+	}
+
+	// Toolchains are depended on by the WORKSPACE file which registered them
+	// rather than by the targets which use them.
+	consumer := f.consumer
+	f.consumer = &Target{
+		Name:   workspaceFileName,
+		Module: &moduleLabel{Package: f.packageRoot, Dir: "."},
+	}
+	defer func() { f.consumer = consumer }()
+	return target.freezeArg(f)
+}